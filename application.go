@@ -13,6 +13,7 @@ import (
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/joho/godotenv"
+	_ "modernc.org/sqlite"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
@@ -81,6 +82,46 @@ func main() {
 			// Process history sync events
 			utils.HandleHistorySync(client, messageStore, v, logger)
 
+		case *events.GroupInfo:
+			// Process group metadata and membership changes
+			utils.HandleGroupInfo(client, messageStore, v, logger)
+
+		case *events.JoinedGroup:
+			// Process being added to a group
+			utils.HandleJoinedGroup(client, messageStore, v, logger)
+
+		case *events.PushName:
+			// Process push name changes for the contact directory
+			utils.HandlePushName(messageStore, v, logger)
+
+		case *events.BusinessName:
+			// Process verified business name changes for the contact directory
+			utils.HandleBusinessName(messageStore, v, logger)
+
+		case *events.Contact:
+			// Process address book changes from app state sync
+			utils.HandleContact(messageStore, v, logger)
+
+		case *events.Archive:
+			// Process chats archived or unarchived on another device
+			utils.HandleArchive(messageStore, v, logger)
+
+		case *events.Pin:
+			// Process chats pinned or unpinned on another device
+			utils.HandlePin(messageStore, v, logger)
+
+		case *events.Mute:
+			// Process chats muted or unmuted on another device
+			utils.HandleMute(messageStore, v, logger)
+
+		case *events.MarkChatAsRead:
+			// Process chats marked as read or unread on another device
+			utils.HandleMarkChatAsRead(messageStore, v, logger)
+
+		case *events.MediaRetry:
+			// Process media re-uploaded by the phone after a media retry receipt
+			utils.HandleMediaRetry(messageStore, v, logger)
+
 		case *events.Connected:
 			logger.Infof("Connected to WhatsApp")
 
@@ -110,7 +151,22 @@ func main() {
 		port = "5000"
 	}
 
-	utils.StartRESTServer(client, port, s3Client)
+	// Archive messages that never reached S3, e.g. from history syncs, in the background
+	go utils.RunS3Backfill(context.Background(), client, messageStore, s3Client, logger)
+
+	// Send the replies processors write under output/ back to their chats
+	go utils.RunReplyPipeline(context.Background(), client, messageStore, s3Client, logger)
+
+	// Send scheduled and recurring messages when they fall due
+	go utils.RunScheduler(context.Background(), client, messageStore, s3Client, logger)
+
+	// Run the actions of the auto-responder rules incoming messages match
+	go utils.RunRuleActions(context.Background(), client, messageStore, s3Client, logger)
+
+	// Send broadcasts to their recipients in the background
+	go utils.RunBroadcasts(context.Background(), client, messageStore, s3Client, logger)
+
+	utils.StartRESTServer(client, messageStore, port, s3Client)
 
 	// Create a channel to keep the main goroutine alive
 	exitChan := make(chan os.Signal, 1)
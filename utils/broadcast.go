@@ -0,0 +1,800 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	waLog "go.mau.fi/whatsmeow/util/log"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// Maximum number of recipients of a single broadcast
+	maxBroadcastRecipients = 1000
+	// Pause between recipients when a broadcast doesn't set one, and the shortest allowed
+	defaultBroadcastDelay = 3 * time.Second
+	minBroadcastDelay     = time.Second
+	// How often the broadcast worker looks for broadcasts to send when idle
+	broadcastPollInterval = 5 * time.Second
+)
+
+// Statuses of a broadcast
+const (
+	broadcastPending   = "pending"
+	broadcastRunning   = "running"
+	broadcastCompleted = "completed"
+	broadcastCancelled = "cancelled"
+	broadcastFailed    = "failed"
+)
+
+// Statuses of a broadcast recipient
+const (
+	recipientPending   = "pending"
+	recipientSending   = "sending"
+	recipientSent      = "sent"
+	recipientFailed    = "failed"
+	recipientCancelled = "cancelled"
+)
+
+// Broadcasts and the status of each of their recipients
+const broadcastTables = `
+	CREATE TABLE IF NOT EXISTS broadcasts (
+		id %s,
+		name TEXT,
+		bucket_name TEXT,
+		object_key TEXT,
+		delay_ms INTEGER,
+		status TEXT,
+		error TEXT,
+		created_at TIMESTAMP,
+		started_at TIMESTAMP,
+		completed_at TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS broadcast_recipients (
+		broadcast_id INTEGER,
+		recipient_jid TEXT,
+		position INTEGER,
+		message TEXT,
+		status TEXT,
+		message_id TEXT,
+		error TEXT,
+		sent_at TIMESTAMP,
+		PRIMARY KEY (broadcast_id, recipient_jid),
+		FOREIGN KEY (broadcast_id) REFERENCES broadcasts(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS broadcasts_status_idx ON broadcasts (status, created_at);
+	CREATE INDEX IF NOT EXISTS broadcast_recipients_status_idx ON broadcast_recipients (broadcast_id, status, position);
+`
+
+// The media message of a broadcast once its media is uploaded to WhatsApp, so resuming the
+// broadcast reuses the upload instead of converting and uploading the media again
+const broadcastMediaColumns = `
+	ALTER TABLE broadcasts ADD COLUMN media_message BYTEA;
+`
+
+// BroadcastRequest represents the request body for the broadcast API. The message, template
+// and media are the same as for /api/send, and are rendered for each recipient
+type BroadcastRequest struct {
+	Name       string                      `json:"name,omitempty"`
+	Recipients []BroadcastRecipientRequest `json:"recipients,omitempty"`
+	// Also send to every contact with this tag, see /api/contacts/{jid}/tags
+	Tag        string            `json:"tag,omitempty"`
+	Message    string            `json:"message,omitempty"`
+	TemplateID int64             `json:"template_id,omitempty"`
+	Variables  map[string]string `json:"variables,omitempty"`
+	Language   string            `json:"language,omitempty"`
+	BucketName string            `json:"bucket_name,omitempty"`
+	ObjectKey  string            `json:"object_key,omitempty"`
+	// Pause between recipients, e.g. "5s". Defaults to 3 seconds, and can't be under a second
+	Delay string `json:"delay,omitempty"`
+}
+
+// BroadcastRecipientRequest is a recipient of a broadcast, with its own template variables
+type BroadcastRecipientRequest struct {
+	Recipient string            `json:"recipient"`
+	Variables map[string]string `json:"variables,omitempty"`
+}
+
+// Broadcast represents a broadcast and the progress of its recipients
+type Broadcast struct {
+	ID          int64           `json:"id"`
+	Name        string          `json:"name,omitempty"`
+	BucketName  string          `json:"bucket_name,omitempty"`
+	ObjectKey   string          `json:"object_key,omitempty"`
+	Delay       string          `json:"delay"`
+	Status      string          `json:"status"`
+	Error       string          `json:"error,omitempty"`
+	Recipients  BroadcastCounts `json:"recipients"`
+	CreatedAt   time.Time       `json:"created_at"`
+	StartedAt   *time.Time      `json:"started_at,omitempty"`
+	CompletedAt *time.Time      `json:"completed_at,omitempty"`
+
+	delay time.Duration
+}
+
+// BroadcastCounts holds the number of recipients of a broadcast in each status
+type BroadcastCounts struct {
+	Total     int `json:"total"`
+	Pending   int `json:"pending"`
+	Sending   int `json:"sending"`
+	Sent      int `json:"sent"`
+	Failed    int `json:"failed"`
+	Cancelled int `json:"cancelled"`
+}
+
+// BroadcastRecipient represents the status of a single recipient of a broadcast
+type BroadcastRecipient struct {
+	JID       string     `json:"jid"`
+	Message   string     `json:"message,omitempty"`
+	Status    string     `json:"status"`
+	MessageID string     `json:"message_id,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	SentAt    *time.Time `json:"sent_at,omitempty"`
+}
+
+// Validate the payload of a broadcast request and get its delay
+func (req *BroadcastRequest) validate() (time.Duration, error) {
+	if len(req.Recipients) == 0 && req.Tag == "" {
+		return 0, fmt.Errorf("recipients or tag is required")
+	}
+	if (req.BucketName == "") != (req.ObjectKey == "") {
+		return 0, fmt.Errorf("media needs both a bucket name and an object key")
+	}
+	if req.TemplateID != 0 && req.Message != "" {
+		return 0, fmt.Errorf("a template can't be combined with a message")
+	}
+	if req.Message == "" && req.TemplateID == 0 && req.ObjectKey == "" {
+		return 0, fmt.Errorf("message, template or media is required")
+	}
+
+	if req.Delay == "" {
+		return defaultBroadcastDelay, nil
+	}
+	delay, err := time.ParseDuration(req.Delay)
+	if err != nil || delay < minBroadcastDelay {
+		return 0, fmt.Errorf("delay must be a duration of at least %s", minBroadcastDelay)
+	}
+	return delay, nil
+}
+
+// Get the recipients of a broadcast request with their rendered messages, in order.
+// Listed recipients come first, then tagged contacts that aren't listed. Returns
+// sql.ErrNoRows if the template doesn't exist
+func resolveBroadcastRecipients(messageStore *MessageStore, req *BroadcastRequest) ([]BroadcastRecipient, error) {
+	recipients := append([]BroadcastRecipientRequest{}, req.Recipients...)
+	if req.Tag != "" {
+		tagged, err := messageStore.getTaggedContacts(req.Tag)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get tagged contacts: %v", err)
+		}
+		for _, jid := range tagged {
+			recipients = append(recipients, BroadcastRecipientRequest{Recipient: jid})
+		}
+	}
+
+	seen := make(map[string]bool)
+	var resolved []BroadcastRecipient
+	for _, recipient := range recipients {
+		jid, err := parseRecipientJID(recipient.Recipient)
+		if err != nil {
+			return nil, err
+		}
+		if jid.Server == types.NewsletterServer {
+			return nil, fmt.Errorf("%w: newsletters can't be broadcast to", errInvalidRecipient)
+		}
+		if seen[jid.String()] {
+			continue
+		}
+		seen[jid.String()] = true
+
+		message := req.Message
+		if req.TemplateID != 0 {
+			send := SendMessageRequest{TemplateID: req.TemplateID, Variables: map[string]string{}, Language: req.Language}
+			for name, value := range req.Variables {
+				send.Variables[name] = value
+			}
+			for name, value := range recipient.Variables {
+				send.Variables[name] = value
+			}
+			if err = renderTemplateRequest(messageStore, &send, jid); errors.Is(err, errMissingTemplateVariables) {
+				return nil, fmt.Errorf("%w for %s", err, jid)
+			} else if err != nil {
+				return nil, err
+			}
+			message = send.Message
+			// The template's media is used unless the broadcast has its own
+			if req.ObjectKey == "" {
+				req.BucketName, req.ObjectKey = send.BucketName, send.ObjectKey
+			}
+		}
+		resolved = append(resolved, BroadcastRecipient{JID: jid.String(), Message: message, Status: recipientPending})
+	}
+
+	if len(resolved) == 0 {
+		return nil, fmt.Errorf("%w: the broadcast has no recipients", errInvalidRecipient)
+	}
+	if len(resolved) > maxBroadcastRecipients {
+		return nil, fmt.Errorf("%w: a broadcast can have at most %d recipients", errInvalidRecipient, maxBroadcastRecipients)
+	}
+	return resolved, nil
+}
+
+const broadcastColumns = `id, COALESCE(name, ''), COALESCE(bucket_name, ''), COALESCE(object_key, ''), delay_ms, status,
+	COALESCE(error, ''), created_at, started_at, completed_at`
+
+// Scan a broadcast selected with broadcastColumns
+func scanBroadcast(row rowScanner) (Broadcast, error) {
+	var broadcast Broadcast
+	var delayMs int64
+	var startedAt, completedAt sql.NullTime
+	err := row.Scan(&broadcast.ID, &broadcast.Name, &broadcast.BucketName, &broadcast.ObjectKey, &delayMs,
+		&broadcast.Status, &broadcast.Error, &broadcast.CreatedAt, &startedAt, &completedAt)
+	if err != nil {
+		return Broadcast{}, err
+	}
+	broadcast.delay = time.Duration(delayMs) * time.Millisecond
+	broadcast.Delay = broadcast.delay.String()
+	broadcast.StartedAt = nullTimePointer(startedAt)
+	broadcast.CompletedAt = nullTimePointer(completedAt)
+	return broadcast, nil
+}
+
+// Store a new broadcast with its recipients
+func (store *MessageStore) createBroadcast(req BroadcastRequest, delay time.Duration, recipients []BroadcastRecipient) (int64, error) {
+	tx, err := store.Db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRow(
+		`INSERT INTO broadcasts (name, bucket_name, object_key, delay_ms, status, created_at)
+		VALUES (NULLIF($1, ''), NULLIF($2, ''), NULLIF($3, ''), $4, $5, $6)
+		RETURNING id`,
+		req.Name, req.BucketName, req.ObjectKey, delay.Milliseconds(), broadcastPending, time.Now(),
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	for i, recipient := range recipients {
+		_, err = tx.Exec(
+			`INSERT INTO broadcast_recipients (broadcast_id, recipient_jid, position, message, status)
+			VALUES ($1, $2, $3, $4, $5)`,
+			id, recipient.JID, i, recipient.Message, recipientPending,
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return id, tx.Commit()
+}
+
+// Get the serialized media message stored for a broadcast, if its media was uploaded
+func (store *MessageStore) getBroadcastMedia(id int64) ([]byte, error) {
+	var data []byte
+	err := store.Db.QueryRow("SELECT media_message FROM broadcasts WHERE id = $1", id).Scan(&data)
+	return data, err
+}
+
+// Store the serialized media message of a broadcast
+func (store *MessageStore) setBroadcastMedia(id int64, data []byte) error {
+	_, err := store.Db.Exec("UPDATE broadcasts SET media_message = $2 WHERE id = $1", id, data)
+	return err
+}
+
+// Get a broadcast by ID, with the number of recipients in each status
+func (store *MessageStore) getBroadcast(id int64) (Broadcast, error) {
+	broadcast, err := scanBroadcast(store.Db.QueryRow("SELECT "+broadcastColumns+" FROM broadcasts WHERE id = $1", id))
+	if err != nil {
+		return Broadcast{}, err
+	}
+	broadcast.Recipients, err = store.getBroadcastCounts(id)
+	return broadcast, err
+}
+
+// Get the broadcasts, newest first
+func (store *MessageStore) getBroadcasts() ([]Broadcast, error) {
+	rows, err := store.Db.Query("SELECT " + broadcastColumns + " FROM broadcasts ORDER BY created_at DESC, id DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	broadcasts := []Broadcast{}
+	for rows.Next() {
+		broadcast, err := scanBroadcast(rows)
+		if err != nil {
+			return nil, err
+		}
+		broadcasts = append(broadcasts, broadcast)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range broadcasts {
+		if broadcasts[i].Recipients, err = store.getBroadcastCounts(broadcasts[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return broadcasts, nil
+}
+
+// Get the number of recipients of a broadcast in each status
+func (store *MessageStore) getBroadcastCounts(id int64) (BroadcastCounts, error) {
+	var counts BroadcastCounts
+	rows, err := store.Db.Query("SELECT status, COUNT(*) FROM broadcast_recipients WHERE broadcast_id = $1 GROUP BY status", id)
+	if err != nil {
+		return counts, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var status string
+		var count int
+		if err = rows.Scan(&status, &count); err != nil {
+			return counts, err
+		}
+		counts.Total += count
+		switch status {
+		case recipientPending:
+			counts.Pending = count
+		case recipientSending:
+			counts.Sending = count
+		case recipientSent:
+			counts.Sent = count
+		case recipientFailed:
+			counts.Failed = count
+		case recipientCancelled:
+			counts.Cancelled = count
+		}
+	}
+	return counts, rows.Err()
+}
+
+// Get the recipients of a broadcast, in sending order
+func (store *MessageStore) getBroadcastRecipients(id int64) ([]BroadcastRecipient, error) {
+	rows, err := store.Db.Query(
+		`SELECT recipient_jid, COALESCE(message, ''), status, COALESCE(message_id, ''), COALESCE(error, ''), sent_at
+		FROM broadcast_recipients WHERE broadcast_id = $1 ORDER BY position`,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	recipients := []BroadcastRecipient{}
+	for rows.Next() {
+		var recipient BroadcastRecipient
+		var sentAt sql.NullTime
+		err = rows.Scan(&recipient.JID, &recipient.Message, &recipient.Status, &recipient.MessageID, &recipient.Error, &sentAt)
+		if err != nil {
+			return nil, err
+		}
+		recipient.SentAt = nullTimePointer(sentAt)
+		recipients = append(recipients, recipient)
+	}
+	return recipients, rows.Err()
+}
+
+// Get the oldest broadcast that still has to be sent
+func (store *MessageStore) getNextBroadcast() (Broadcast, error) {
+	return scanBroadcast(store.Db.QueryRow(
+		`SELECT `+broadcastColumns+` FROM broadcasts
+		WHERE status IN ($1, $2)
+		ORDER BY created_at, id
+		LIMIT 1`,
+		broadcastPending, broadcastRunning,
+	))
+}
+
+// Get the status of a broadcast
+func (store *MessageStore) getBroadcastStatus(id int64) (string, error) {
+	var status string
+	err := store.Db.QueryRow("SELECT status FROM broadcasts WHERE id = $1", id).Scan(&status)
+	return status, err
+}
+
+// Start sending a broadcast. Recipients left sending by an earlier run that was interrupted
+// are marked as failed, as there's no telling whether they got the message
+func (store *MessageStore) startBroadcast(id int64) error {
+	_, err := store.Db.Exec(
+		"UPDATE broadcasts SET status = $2, started_at = COALESCE(started_at, $3) WHERE id = $1 AND status = $4",
+		id, broadcastRunning, time.Now(), broadcastPending,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = store.Db.Exec(
+		"UPDATE broadcast_recipients SET status = $2, error = $3 WHERE broadcast_id = $1 AND status = $4",
+		id, recipientFailed, "interrupted while sending", recipientSending,
+	)
+	return err
+}
+
+// Claim the next pending recipient of a broadcast. Returns sql.ErrNoRows once there are none left
+func (store *MessageStore) claimBroadcastRecipient(id int64) (BroadcastRecipient, error) {
+	for {
+		var recipient BroadcastRecipient
+		err := store.Db.QueryRow(
+			`SELECT recipient_jid, COALESCE(message, '') FROM broadcast_recipients
+			WHERE broadcast_id = $1 AND status = $2
+			ORDER BY position
+			LIMIT 1`,
+			id, recipientPending,
+		).Scan(&recipient.JID, &recipient.Message)
+		if err != nil {
+			return BroadcastRecipient{}, err
+		}
+
+		result, err := store.Db.Exec(
+			"UPDATE broadcast_recipients SET status = $3 WHERE broadcast_id = $1 AND recipient_jid = $2 AND status = $4",
+			id, recipient.JID, recipientSending, recipientPending,
+		)
+		if err != nil {
+			return BroadcastRecipient{}, err
+		}
+		// Someone else claimed or cancelled it in the meantime, try the next one
+		if claimed, err := result.RowsAffected(); err != nil {
+			return BroadcastRecipient{}, err
+		} else if claimed > 0 {
+			recipient.Status = recipientSending
+			return recipient, nil
+		}
+	}
+}
+
+// Record the outcome of sending a broadcast to a recipient
+func (store *MessageStore) recordBroadcastRecipient(id int64, jid string, messageID string, sendErr error) error {
+	if sendErr != nil {
+		_, err := store.Db.Exec(
+			"UPDATE broadcast_recipients SET status = $3, error = $4 WHERE broadcast_id = $1 AND recipient_jid = $2",
+			id, jid, recipientFailed, sendErr.Error(),
+		)
+		return err
+	}
+	_, err := store.Db.Exec(
+		"UPDATE broadcast_recipients SET status = $3, message_id = $4, sent_at = $5 WHERE broadcast_id = $1 AND recipient_jid = $2",
+		id, jid, recipientSent, messageID, time.Now(),
+	)
+	return err
+}
+
+// Finish a running broadcast, failed if reason isn't empty. Recipients that weren't sent to are failed along with it
+func (store *MessageStore) finishBroadcast(id int64, reason string) error {
+	tx, err := store.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	status := broadcastCompleted
+	if reason != "" {
+		status = broadcastFailed
+		_, err = tx.Exec(
+			"UPDATE broadcast_recipients SET status = $2, error = $3 WHERE broadcast_id = $1 AND status = $4",
+			id, recipientFailed, reason, recipientPending,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(
+		"UPDATE broadcasts SET status = $2, error = NULLIF($3, ''), completed_at = $4 WHERE id = $1 AND status = $5",
+		id, status, reason, time.Now(), broadcastRunning,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Cancel a broadcast that hasn't finished, along with its pending recipients.
+// Returns sql.ErrNoRows if it doesn't exist or has already finished
+func (store *MessageStore) cancelBroadcast(id int64) error {
+	tx, err := store.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE broadcasts SET status = $2, completed_at = $3 WHERE id = $1 AND status IN ($4, $5)",
+		id, broadcastCancelled, time.Now(), broadcastPending, broadcastRunning,
+	)
+	if err != nil {
+		return err
+	}
+	if cancelled, err := result.RowsAffected(); err != nil {
+		return err
+	} else if cancelled == 0 {
+		return sql.ErrNoRows
+	}
+	_, err = tx.Exec(
+		"UPDATE broadcast_recipients SET status = $2 WHERE broadcast_id = $1 AND status = $3",
+		id, recipientCancelled, recipientPending,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Build the messages sending a broadcast to a recipient. Media uploaded for the broadcast
+// is reused with the recipient's text as its caption, or followed by the text for voice
+// notes, which can't have captions
+func buildBroadcastMessages(media *waProto.Message, text string) []*waProto.Message {
+	if media == nil {
+		return []*waProto.Message{{Conversation: proto.String(text)}}
+	}
+
+	msg := proto.Clone(media).(*waProto.Message)
+	if text == "" {
+		return []*waProto.Message{msg}
+	}
+	switch {
+	case msg.ImageMessage != nil:
+		msg.ImageMessage.Caption = proto.String(text)
+	case msg.VideoMessage != nil:
+		msg.VideoMessage.Caption = proto.String(text)
+	case msg.DocumentMessage != nil:
+		msg.DocumentMessage.Caption = proto.String(text)
+	default:
+		return []*waProto.Message{msg, {Conversation: proto.String(text)}}
+	}
+	return []*waProto.Message{msg}
+}
+
+// Get the media message of a broadcast. Its media is downloaded, converted and uploaded to
+// WhatsApp the first time, and the result is stored so it's reused when the broadcast resumes,
+// until its CDN link is about to expire
+func prepareBroadcastMedia(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, s3Client *s3.Client, broadcast Broadcast, logger waLog.Logger) (*waProto.Message, error) {
+	data, err := messageStore.getBroadcastMedia(broadcast.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		var media waProto.Message
+		if err = proto.Unmarshal(data, &media); err == nil && mediaReferencesValid(extractMediaInfo(&media)) {
+			return &media, nil
+		}
+	}
+
+	mediaData, err := downloadS3Object(ctx, s3Client, broadcast.BucketName, broadcast.ObjectKey)
+	if err != nil {
+		return nil, err
+	}
+	media, _, err := buildMediaMessage(ctx, client, types.EmptyJID, mediaData, broadcast.ObjectKey, "")
+	if err != nil {
+		return nil, err
+	}
+	if data, err = proto.Marshal(media); err == nil {
+		err = messageStore.setBroadcastMedia(broadcast.ID, data)
+	}
+	if err != nil {
+		logger.Warnf("Failed to store media of broadcast %d: %v", broadcast.ID, err)
+	}
+	return media, nil
+}
+
+// Send a broadcast to its pending recipients, one at a time with its delay in between.
+// Its media is prepared once by prepareBroadcastMedia and reused for every recipient.
+// Stops early when the broadcast is cancelled or the connection is lost
+func dispatchBroadcast(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, s3Client *s3.Client, broadcast Broadcast, logger waLog.Logger) {
+	if err := messageStore.startBroadcast(broadcast.ID); err != nil {
+		logger.Warnf("Failed to start broadcast %d: %v", broadcast.ID, err)
+		return
+	}
+
+	var media *waProto.Message
+	if broadcast.ObjectKey != "" {
+		var err error
+		if media, err = prepareBroadcastMedia(ctx, client, messageStore, s3Client, broadcast, logger); err != nil {
+			logger.Warnf("Failed to prepare media of broadcast %d: %v", broadcast.ID, err)
+			if err = messageStore.finishBroadcast(broadcast.ID, fmt.Sprintf("failed to prepare media: %v", err)); err != nil {
+				logger.Warnf("Failed to record failure of broadcast %d: %v", broadcast.ID, err)
+			}
+			return
+		}
+	}
+
+	logger.Infof("Sending broadcast %d", broadcast.ID)
+	for {
+		if ctx.Err() != nil || !client.IsConnected() {
+			return
+		}
+		if status, err := messageStore.getBroadcastStatus(broadcast.ID); err != nil || status != broadcastRunning {
+			return
+		}
+
+		recipient, err := messageStore.claimBroadcastRecipient(broadcast.ID)
+		if errors.Is(err, sql.ErrNoRows) {
+			break
+		} else if err != nil {
+			logger.Warnf("Failed to get next recipient of broadcast %d: %v", broadcast.ID, err)
+			return
+		}
+
+		var messageID string
+		recipientJID, err := types.ParseJID(recipient.JID)
+		for i, msg := range buildBroadcastMessages(media, recipient.Message) {
+			if err != nil {
+				break
+			}
+			var resp whatsmeow.SendResponse
+			if resp, err = client.SendMessage(ctx, recipientJID, msg); err != nil {
+				break
+			}
+			recordSentMessage(client, messageStore, recipientJID, resp, msg)
+			if i == 0 {
+				messageID = resp.ID
+			}
+		}
+		if err != nil {
+			logger.Warnf("Failed to send broadcast %d to %s: %v", broadcast.ID, recipient.JID, err)
+		}
+		if err = messageStore.recordBroadcastRecipient(broadcast.ID, recipient.JID, messageID, err); err != nil {
+			logger.Warnf("Failed to record broadcast %d to %s: %v", broadcast.ID, recipient.JID, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(broadcast.delay):
+		}
+	}
+
+	if err := messageStore.finishBroadcast(broadcast.ID, ""); err != nil {
+		logger.Warnf("Failed to finish broadcast %d: %v", broadcast.ID, err)
+		return
+	}
+	logger.Infof("Finished broadcast %d", broadcast.ID)
+}
+
+// Run the broadcast worker until ctx is cancelled. Broadcasts are sent one at a time, oldest
+// first. Progress is kept per recipient, so a restart picks up where it stopped
+func RunBroadcasts(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, s3Client *s3.Client, logger waLog.Logger) {
+	for {
+		if client.IsConnected() {
+			broadcast, err := messageStore.getNextBroadcast()
+			if err == nil {
+				dispatchBroadcast(ctx, client, messageStore, s3Client, broadcast, logger)
+			} else if !errors.Is(err, sql.ErrNoRows) {
+				logger.Warnf("Failed to get next broadcast: %v", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(broadcastPollInterval):
+		}
+	}
+}
+
+func registerBroadcastRoutes(messageStore *MessageStore) {
+	// Parse the broadcast ID of a request, answering with an error if it's invalid
+	broadcastID := func(w http.ResponseWriter, r *http.Request) (int64, bool) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid broadcast ID", http.StatusBadRequest)
+			return 0, false
+		}
+		return id, true
+	}
+
+	// Answer with a broadcast
+	writeBroadcast := func(w http.ResponseWriter, status int, id int64) {
+		broadcast, err := messageStore.getBroadcast(id)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Broadcast not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting broadcast: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, status, broadcast)
+	}
+
+	// Create a broadcast. Messages are rendered for every recipient up front, then sent in the background
+	http.HandleFunc("POST /api/broadcasts", func(w http.ResponseWriter, r *http.Request) {
+		var req BroadcastRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		delay, err := req.validate()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		recipients, err := resolveBroadcastRecipients(messageStore, &req)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Template not found", http.StatusNotFound)
+			return
+		} else if errors.Is(err, errInvalidRecipient) || errors.Is(err, errMissingTemplateVariables) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Error preparing broadcast: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		id, err := messageStore.createBroadcast(req, delay, recipients)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error creating broadcast: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeBroadcast(w, http.StatusCreated, id)
+	})
+
+	// List broadcasts with their progress
+	http.HandleFunc("GET /api/broadcasts", func(w http.ResponseWriter, r *http.Request) {
+		broadcasts, err := messageStore.getBroadcasts()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting broadcasts: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, broadcasts)
+	})
+
+	// Get a broadcast with its progress
+	http.HandleFunc("GET /api/broadcasts/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := broadcastID(w, r); ok {
+			writeBroadcast(w, http.StatusOK, id)
+		}
+	})
+
+	// Get the status of every recipient of a broadcast
+	http.HandleFunc("GET /api/broadcasts/{id}/recipients", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := broadcastID(w, r)
+		if !ok {
+			return
+		}
+		if _, err := messageStore.getBroadcastStatus(id); errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Broadcast not found", http.StatusNotFound)
+			return
+		}
+		recipients, err := messageStore.getBroadcastRecipients(id)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting broadcast recipients: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, recipients)
+	})
+
+	// Cancel a broadcast. Recipients already sent to keep their message
+	http.HandleFunc("DELETE /api/broadcasts/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := broadcastID(w, r)
+		if !ok {
+			return
+		}
+		err := messageStore.cancelBroadcast(id)
+		if errors.Is(err, sql.ErrNoRows) {
+			if _, err = messageStore.getBroadcastStatus(id); errors.Is(err, sql.ErrNoRows) {
+				http.Error(w, "Broadcast not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Only pending or running broadcasts can be cancelled", http.StatusConflict)
+			}
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Error cancelling broadcast: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeBroadcast(w, http.StatusOK, id)
+	})
+}
@@ -11,10 +11,9 @@ import (
 )
 
 // getChatName determines the appropriate name for a chat based on JID and other info
-func getChatName(client *whatsmeow.Client, messageStore *MessageStore, jid types.JID, chatJID string, conversation interface{}, sender string, logger waLog.Logger) string {
+func getChatName(client *whatsmeow.Client, messageStore MessageRepository, jid types.JID, chatJID string, conversation interface{}, sender string, logger waLog.Logger) string {
 	// First, check if chat already exists in database with a name
-	var existingName string
-	err := messageStore.Db.QueryRow("SELECT name FROM chats WHERE jid = $1", chatJID).Scan(&existingName)
+	existingName, err := messageStore.getStoredChatName(chatJID)
 	if err == nil && existingName != "" {
 		// Chat exists with a name, use that
 		logger.Infof("Using existing chat name for %s: %s", chatJID, existingName)
@@ -79,6 +78,9 @@ func getChatName(client *whatsmeow.Client, messageStore *MessageStore, jid types
 		contact, err := client.Store.Contacts.GetContact(context.Background(), jid)
 		if err == nil && contact.FullName != "" {
 			name = contact.FullName
+		} else if contactName := messageStore.getContactName(chatJID); contactName != "" {
+			// Fallback to the contact directory (push names, business names)
+			name = contactName
 		} else if sender != "" {
 			// Fallback to sender
 			name = sender
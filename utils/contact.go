@@ -0,0 +1,434 @@
+package utils
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waHistorySync"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// Maximum number of phone numbers accepted by a single contact check request
+const maxContactCheckPhones = 500
+
+// ContactResponse represents a stored contact in API responses
+type ContactResponse struct {
+	JID          string    `json:"jid"`
+	PhoneNumber  string    `json:"phone_number,omitempty"`
+	LID          string    `json:"lid,omitempty"`
+	FullName     string    `json:"full_name,omitempty"`
+	FirstName    string    `json:"first_name,omitempty"`
+	PushName     string    `json:"push_name,omitempty"`
+	BusinessName string    `json:"business_name,omitempty"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// CheckContactsRequest represents the request body for the contact check API
+type CheckContactsRequest struct {
+	Phones []string `json:"phones"`
+}
+
+// CheckContactResponse represents the WhatsApp registration status of a single phone number
+type CheckContactResponse struct {
+	Query        string `json:"query"`
+	JID          string `json:"jid,omitempty"`
+	IsOnWhatsApp bool   `json:"is_on_whatsapp"`
+	VerifiedName string `json:"verified_name,omitempty"`
+}
+
+// ContactTagsRequest represents the request body for the contact tags API
+type ContactTagsRequest struct {
+	Tags []string `json:"tags"`
+}
+
+// ContactTagsResponse represents the tags of a contact
+type ContactTagsResponse struct {
+	JID  string   `json:"jid"`
+	Tags []string `json:"tags"`
+}
+
+// Tags grouping contacts, e.g. to broadcast to all of them
+const contactTagsTable = `
+	CREATE TABLE IF NOT EXISTS contact_tags (
+		jid TEXT,
+		tag TEXT,
+		PRIMARY KEY (jid, tag)
+	);
+
+	CREATE INDEX IF NOT EXISTS contact_tags_tag_idx ON contact_tags (tag);
+`
+
+// Phone number of a JID, if it's a phone number based JID
+func jidPhoneNumber(jid types.JID) string {
+	if jid.Server == types.DefaultUserServer {
+		return jid.User
+	}
+	return ""
+}
+
+// Store or update the push name of a contact
+func (store *MessageStore) storeContactPushName(jid types.JID, pushName string) error {
+	_, err := store.Db.Exec(
+		`INSERT INTO contacts (jid, phone_number, push_name, updated_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (jid) DO UPDATE SET
+			phone_number = COALESCE(NULLIF(EXCLUDED.phone_number, ''), contacts.phone_number),
+			push_name = EXCLUDED.push_name,
+			updated_at = EXCLUDED.updated_at`,
+		jid.String(), jidPhoneNumber(jid), pushName, time.Now(),
+	)
+	return err
+}
+
+// Store or update the verified business name of a contact
+func (store *MessageStore) storeContactBusinessName(jid types.JID, businessName string) error {
+	_, err := store.Db.Exec(
+		`INSERT INTO contacts (jid, phone_number, business_name, updated_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (jid) DO UPDATE SET
+			phone_number = COALESCE(NULLIF(EXCLUDED.phone_number, ''), contacts.phone_number),
+			business_name = EXCLUDED.business_name,
+			updated_at = EXCLUDED.updated_at`,
+		jid.String(), jidPhoneNumber(jid), businessName, time.Now(),
+	)
+	return err
+}
+
+// Store or update the address book entry of a contact
+func (store *MessageStore) storeContactDetails(jid types.JID, phoneNumber, lid, fullName, firstName string, timestamp time.Time) error {
+	if phoneNumber == "" {
+		phoneNumber = jidPhoneNumber(jid)
+	}
+	_, err := store.Db.Exec(
+		`INSERT INTO contacts (jid, phone_number, lid, full_name, first_name, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (jid) DO UPDATE SET
+			phone_number = COALESCE(NULLIF(EXCLUDED.phone_number, ''), contacts.phone_number),
+			lid = COALESCE(NULLIF(EXCLUDED.lid, ''), contacts.lid),
+			full_name = EXCLUDED.full_name,
+			first_name = EXCLUDED.first_name,
+			updated_at = EXCLUDED.updated_at`,
+		jid.String(), phoneNumber, lid, fullName, firstName, timestamp,
+	)
+	return err
+}
+
+// Get the best known display name of a contact, or an empty string if unknown
+func (store *MessageStore) getContactName(jid string) string {
+	var name string
+	err := store.Db.QueryRow(
+		`SELECT COALESCE(NULLIF(full_name, ''), NULLIF(business_name, ''), NULLIF(push_name, ''), '')
+		FROM contacts WHERE jid = $1`,
+		jid,
+	).Scan(&name)
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// Replace the tags of a contact
+func (store *MessageStore) setContactTags(jid string, tags []string) error {
+	tx, err := store.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("DELETE FROM contact_tags WHERE jid = $1", jid); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		_, err = tx.Exec("INSERT INTO contact_tags (jid, tag) VALUES ($1, $2) ON CONFLICT (jid, tag) DO NOTHING", jid, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Get the tags of a contact, sorted
+func (store *MessageStore) getContactTags(jid string) ([]string, error) {
+	return store.queryStrings("SELECT tag FROM contact_tags WHERE jid = $1 ORDER BY tag", jid)
+}
+
+// Get the JIDs of the contacts with a tag, sorted
+func (store *MessageStore) getTaggedContacts(tag string) ([]string, error) {
+	return store.queryStrings("SELECT jid FROM contact_tags WHERE tag = $1 ORDER BY jid", tag)
+}
+
+// Run a query selecting a single text column and get its values
+func (store *MessageStore) queryStrings(query string, args ...interface{}) ([]string, error) {
+	rows, err := store.Db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := []string{}
+	for rows.Next() {
+		var value string
+		if err = rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// Escape the wildcards of a LIKE pattern, so they match literally with ESCAPE '\'
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// Search stored contacts by JID, phone number or any of their names
+func (store *MessageStore) searchContacts(query string, limit, offset int) ([]ContactResponse, error) {
+	pattern := "%" + likeEscaper.Replace(strings.ToLower(query)) + "%"
+	rows, err := store.Db.Query(
+		`SELECT jid, COALESCE(phone_number, ''), COALESCE(lid, ''), COALESCE(full_name, ''),
+			COALESCE(first_name, ''), COALESCE(push_name, ''), COALESCE(business_name, ''), updated_at
+		FROM contacts
+		WHERE LOWER(jid) LIKE $1 ESCAPE '\'
+			OR LOWER(COALESCE(full_name, '')) LIKE $1 ESCAPE '\'
+			OR LOWER(COALESCE(first_name, '')) LIKE $1 ESCAPE '\'
+			OR LOWER(COALESCE(push_name, '')) LIKE $1 ESCAPE '\'
+			OR LOWER(COALESCE(business_name, '')) LIKE $1 ESCAPE '\'
+		ORDER BY COALESCE(NULLIF(full_name, ''), NULLIF(push_name, ''), jid)
+		LIMIT $2 OFFSET $3`,
+		pattern, limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	contacts := []ContactResponse{}
+	for rows.Next() {
+		var contact ContactResponse
+		var updatedAt sql.NullTime
+		err = rows.Scan(&contact.JID, &contact.PhoneNumber, &contact.LID, &contact.FullName,
+			&contact.FirstName, &contact.PushName, &contact.BusinessName, &updatedAt)
+		if err != nil {
+			return nil, err
+		}
+		contact.UpdatedAt = updatedAt.Time
+		contacts = append(contacts, contact)
+	}
+	return contacts, rows.Err()
+}
+
+// Handle push name changes noticed on incoming messages
+func HandlePushName(messageStore MessageRepository, evt *events.PushName, logger waLog.Logger) {
+	err := messageStore.storeContactPushName(evt.JID, evt.NewPushName)
+	if err != nil {
+		logger.Warnf("Failed to store push name for %s: %v", evt.JID, err)
+	}
+}
+
+// Handle verified business name changes noticed on incoming messages
+func HandleBusinessName(messageStore MessageRepository, evt *events.BusinessName, logger waLog.Logger) {
+	err := messageStore.storeContactBusinessName(evt.JID, evt.NewBusinessName)
+	if err != nil {
+		logger.Warnf("Failed to store business name for %s: %v", evt.JID, err)
+	}
+}
+
+// Handle address book changes synced through app state
+func HandleContact(messageStore MessageRepository, evt *events.Contact, logger waLog.Logger) {
+	if evt.Action == nil {
+		return
+	}
+
+	var phoneNumber string
+	if pn, err := types.ParseJID(evt.Action.GetPnJID()); err == nil && evt.Action.GetPnJID() != "" {
+		phoneNumber = pn.User
+	}
+
+	timestamp := evt.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	err := messageStore.storeContactDetails(evt.JID, phoneNumber, evt.Action.GetLidJID(),
+		evt.Action.GetFullName(), evt.Action.GetFirstName(), timestamp)
+	if err != nil {
+		logger.Warnf("Failed to store contact %s: %v", evt.JID, err)
+	}
+}
+
+// Store the push name list included in history sync payloads
+func storeHistoryPushNames(messageStore MessageRepository, pushNames []*waHistorySync.Pushname, logger waLog.Logger) {
+	storedCount := 0
+	for _, pushName := range pushNames {
+		if pushName.GetID() == "" || pushName.GetPushname() == "" {
+			continue
+		}
+		jid, err := types.ParseJID(pushName.GetID())
+		if err != nil {
+			logger.Warnf("Failed to parse push name JID %s: %v", pushName.GetID(), err)
+			continue
+		}
+		if err = messageStore.storeContactPushName(jid, pushName.GetPushname()); err != nil {
+			logger.Warnf("Failed to store push name for %s: %v", jid, err)
+			continue
+		}
+		storedCount++
+	}
+	if storedCount > 0 {
+		logger.Infof("Stored %d push names from history sync", storedCount)
+	}
+}
+
+func registerContactRoutes(client *whatsmeow.Client, messageStore MessageRepository) {
+	// Search the contact directory
+	http.HandleFunc("GET /api/contacts", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		limit := 50
+		if value := query.Get("limit"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 || parsed > 500 {
+				http.Error(w, "Limit must be between 1 and 500", http.StatusBadRequest)
+				return
+			}
+			limit = parsed
+		}
+		offset := 0
+		if value := query.Get("offset"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				http.Error(w, "Offset must be a positive number", http.StatusBadRequest)
+				return
+			}
+			offset = parsed
+		}
+
+		contacts, err := messageStore.searchContacts(strings.TrimSpace(query.Get("q")), limit, offset)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error searching contacts: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, contacts)
+	})
+
+	// Check which phone numbers are registered on WhatsApp
+	http.HandleFunc("POST /api/contacts/check", func(w http.ResponseWriter, r *http.Request) {
+		if !client.IsConnected() {
+			http.Error(w, "Not connected to WhatsApp", http.StatusServiceUnavailable)
+			return
+		}
+
+		var req CheckContactsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		if len(req.Phones) == 0 {
+			http.Error(w, "Phones are required", http.StatusBadRequest)
+			return
+		}
+		if len(req.Phones) > maxContactCheckPhones {
+			http.Error(w, fmt.Sprintf("At most %d phones can be checked at once", maxContactCheckPhones), http.StatusBadRequest)
+			return
+		}
+
+		// IsOnWhatsApp expects numbers in international format with a + prefix
+		phones := make([]string, len(req.Phones))
+		for i, phone := range req.Phones {
+			number, err := normalizePhoneNumber(phone)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			phones[i] = "+" + number
+		}
+
+		results, err := client.IsOnWhatsApp(r.Context(), phones)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error checking phones: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		resp := make([]CheckContactResponse, len(results))
+		for i, result := range results {
+			resp[i] = CheckContactResponse{
+				Query:        result.Query,
+				IsOnWhatsApp: result.IsIn,
+			}
+			if result.IsIn {
+				resp[i].JID = result.JID.String()
+			}
+
+			// Remember the result so sends to this number can skip the check
+			err = messageStore.storeRecipientCheck(strings.TrimPrefix(result.Query, "+"), resp[i].JID, result.IsIn)
+			if err != nil {
+				fmt.Printf("Failed to cache recipient check for %s: %v\n", result.Query, err)
+			}
+			if !result.IsIn {
+				continue
+			}
+			if result.VerifiedName != nil && result.VerifiedName.Details != nil {
+				resp[i].VerifiedName = result.VerifiedName.Details.GetVerifiedName()
+				if err = messageStore.storeContactBusinessName(result.JID, resp[i].VerifiedName); err != nil {
+					fmt.Printf("Failed to store business name for %s: %v\n", result.JID, err)
+				}
+			}
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	})
+
+	// Get the tags of a contact
+	http.HandleFunc("GET /api/contacts/{jid}/tags", func(w http.ResponseWriter, r *http.Request) {
+		jid, err := parseRecipientJID(r.PathValue("jid"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tags, err := messageStore.getContactTags(jid.String())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting contact tags: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, ContactTagsResponse{JID: jid.String(), Tags: tags})
+	})
+
+	// Replace the tags of a contact; an empty list removes them all
+	http.HandleFunc("PUT /api/contacts/{jid}/tags", func(w http.ResponseWriter, r *http.Request) {
+		jid, err := parseRecipientJID(r.PathValue("jid"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var req ContactTagsRequest
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		for i, tag := range req.Tags {
+			if req.Tags[i] = strings.TrimSpace(tag); req.Tags[i] == "" {
+				http.Error(w, "Tags can't be empty", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if err = messageStore.setContactTags(jid.String(), req.Tags); err != nil {
+			http.Error(w, fmt.Sprintf("Error storing contact tags: %v", err), http.StatusInternalServerError)
+			return
+		}
+		tags, err := messageStore.getContactTags(jid.String())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting contact tags: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, ContactTagsResponse{JID: jid.String(), Tags: tags})
+	})
+}
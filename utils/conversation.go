@@ -0,0 +1,271 @@
+package utils
+
+import (
+	"database/sql"
+	"math"
+	"time"
+
+	"go.mau.fi/whatsmeow/proto/waHistorySync"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// Columns added to the chats table for the conversation state synced from the phone
+const conversationMetadataColumns = `
+	ALTER TABLE chats ADD COLUMN unread_count INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE chats ADD COLUMN marked_unread BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE chats ADD COLUMN archived BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE chats ADD COLUMN pinned_at TIMESTAMP;
+	ALTER TABLE chats ADD COLUMN muted BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE chats ADD COLUMN muted_until TIMESTAMP;
+	ALTER TABLE chats ADD COLUMN ephemeral_expiration INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE chats ADD COLUMN read_only BOOLEAN NOT NULL DEFAULT FALSE;
+`
+
+// ChatMetadata represents the state of a conversation as reported by the phone
+type ChatMetadata struct {
+	Name string
+	// Whether the unread, archive, pin and mute state below is included. Only initial and
+	// full history syncs carry it, other chunks have defaults or values older than the app state
+	IncludesState bool
+	UnreadCount   int
+	MarkedUnread  bool
+	Archived      bool
+	// Nil when the chat isn't pinned
+	PinnedAt *time.Time
+	Muted    bool
+	// Nil when the chat isn't muted or is muted forever
+	MutedUntil *time.Time
+	// Disappearing messages timer in seconds, 0 when off
+	EphemeralExpiration int
+	ReadOnly            bool
+	// Only filled in for groups
+	Participants []ChatParticipant
+}
+
+// ChatParticipant represents a member of a group conversation in a history sync
+type ChatParticipant struct {
+	JID  types.JID
+	Role string
+}
+
+// Build the metadata of a conversation received in a history sync of the given type
+func newChatMetadata(name string, conversation *waHistorySync.Conversation, syncType waHistorySync.HistorySync_HistorySyncType) ChatMetadata {
+	metadata := ChatMetadata{
+		Name:                name,
+		IncludesState:       syncType == waHistorySync.HistorySync_INITIAL_BOOTSTRAP || syncType == waHistorySync.HistorySync_FULL,
+		UnreadCount:         int(conversation.GetUnreadCount()),
+		MarkedUnread:        conversation.GetMarkedAsUnread(),
+		Archived:            conversation.GetArchived(),
+		EphemeralExpiration: int(conversation.GetEphemeralExpiration()),
+		ReadOnly:            conversation.GetReadOnly(),
+	}
+	// The pin field holds the time the chat was pinned
+	if pinned := conversation.GetPinned(); pinned > 0 {
+		pinnedAt := time.Unix(int64(pinned), 0)
+		metadata.PinnedAt = &pinnedAt
+	}
+	// Chats muted forever have an end time too far away to be a real date
+	if muteEndTime := conversation.GetMuteEndTime(); muteEndTime > 0 {
+		metadata.Muted = true
+		if muteEndTime < math.MaxInt32 {
+			mutedUntil := time.Unix(int64(muteEndTime), 0)
+			metadata.MutedUntil = &mutedUntil
+		}
+	}
+	for _, participant := range conversation.GetParticipant() {
+		jid, err := types.ParseJID(participant.GetUserJID())
+		if err != nil || jid.User == "" {
+			continue
+		}
+		metadata.Participants = append(metadata.Participants, ChatParticipant{
+			JID:  jid,
+			Role: historyParticipantRole(participant.GetRank()),
+		})
+	}
+	return metadata
+}
+
+// historyParticipantRole maps history sync participant ranks onto the roles used by participantRole
+func historyParticipantRole(rank waHistorySync.GroupParticipant_Rank) string {
+	switch rank {
+	case waHistorySync.GroupParticipant_SUPERADMIN:
+		return "superadmin"
+	case waHistorySync.GroupParticipant_ADMIN:
+		return "admin"
+	default:
+		return "member"
+	}
+}
+
+// Store the metadata of a conversation, creating the chat if needed. An empty name keeps
+// the stored one, and the unread, archive, pin and mute state is only replaced when included.
+// Participants that aren't known yet are added to group_participants, and known ones are
+// left as they are, as history syncs can be older than the group info
+func (store *MessageStore) storeChatMetadata(jid string, metadata ChatMetadata) error {
+	tx, err := store.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var state string
+	if metadata.IncludesState {
+		state = `
+			unread_count = EXCLUDED.unread_count,
+			marked_unread = EXCLUDED.marked_unread,
+			archived = EXCLUDED.archived,
+			pinned_at = EXCLUDED.pinned_at,
+			muted = EXCLUDED.muted,
+			muted_until = EXCLUDED.muted_until,`
+	}
+	_, err = tx.Exec(
+		`INSERT INTO chats (jid, name, unread_count, marked_unread, archived, pinned_at, muted, muted_until, ephemeral_expiration, read_only)
+		VALUES ($1, NULLIF($2, ''), $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (jid) DO UPDATE SET
+			name = COALESCE(EXCLUDED.name, chats.name),`+state+`
+			ephemeral_expiration = EXCLUDED.ephemeral_expiration,
+			read_only = EXCLUDED.read_only`,
+		jid, metadata.Name, metadata.UnreadCount, metadata.MarkedUnread, metadata.Archived, metadata.PinnedAt,
+		metadata.Muted, metadata.MutedUntil, metadata.EphemeralExpiration, metadata.ReadOnly,
+	)
+	if err != nil {
+		return err
+	}
+
+	if len(metadata.Participants) > 0 {
+		// group_participants references the group, which may not have been fetched yet
+		_, err = tx.Exec(
+			"INSERT INTO groups (jid, name) VALUES ($1, NULLIF($2, '')) ON CONFLICT (jid) DO NOTHING",
+			jid, metadata.Name,
+		)
+		if err != nil {
+			return err
+		}
+		for _, participant := range metadata.Participants {
+			if err = insertHistoryGroupParticipant(tx, jid, participant); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Add a group participant from a history sync. Participants that are already known are left
+// alone, so a stale history sync doesn't re-activate members who have since left. History
+// syncs don't say when participants joined, so joined_at is left empty
+func insertHistoryGroupParticipant(tx *sql.Tx, groupJID string, participant ChatParticipant) error {
+	_, err := tx.Exec(
+		`INSERT INTO group_participants (group_jid, participant_jid, role)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (group_jid, participant_jid) DO NOTHING`,
+		groupJID, participant.JID.String(), participant.Role,
+	)
+	return err
+}
+
+// Set whether a chat is archived, creating the chat if needed
+func (store *MessageStore) setChatArchived(jid string, archived bool) error {
+	_, err := store.Db.Exec(
+		`INSERT INTO chats (jid, archived) VALUES ($1, $2)
+		ON CONFLICT (jid) DO UPDATE SET archived = EXCLUDED.archived`,
+		jid, archived,
+	)
+	return err
+}
+
+// Set when a chat was pinned, or nil to unpin it, creating the chat if needed
+func (store *MessageStore) setChatPinned(jid string, pinnedAt *time.Time) error {
+	_, err := store.Db.Exec(
+		`INSERT INTO chats (jid, pinned_at) VALUES ($1, $2)
+		ON CONFLICT (jid) DO UPDATE SET pinned_at = EXCLUDED.pinned_at`,
+		jid, pinnedAt,
+	)
+	return err
+}
+
+// Set the mute state of a chat, creating the chat if needed
+func (store *MessageStore) setChatMuted(jid string, muted bool, mutedUntil *time.Time) error {
+	_, err := store.Db.Exec(
+		`INSERT INTO chats (jid, muted, muted_until) VALUES ($1, $2, $3)
+		ON CONFLICT (jid) DO UPDATE SET muted = EXCLUDED.muted, muted_until = EXCLUDED.muted_until`,
+		jid, muted, mutedUntil,
+	)
+	return err
+}
+
+// Mark a chat as read, which clears its unread count, or as unread, creating the chat if needed
+func (store *MessageStore) setChatRead(jid string, read bool) error {
+	if read {
+		_, err := store.Db.Exec(
+			`INSERT INTO chats (jid, unread_count, marked_unread) VALUES ($1, 0, FALSE)
+			ON CONFLICT (jid) DO UPDATE SET unread_count = 0, marked_unread = FALSE`,
+			jid,
+		)
+		return err
+	}
+	_, err := store.Db.Exec(
+		`INSERT INTO chats (jid, marked_unread) VALUES ($1, TRUE)
+		ON CONFLICT (jid) DO UPDATE SET marked_unread = TRUE`,
+		jid,
+	)
+	return err
+}
+
+// Handle chats being archived or unarchived on another device
+func HandleArchive(messageStore MessageRepository, evt *events.Archive, logger waLog.Logger) {
+	if evt.Action == nil {
+		return
+	}
+	if err := messageStore.setChatArchived(evt.JID.String(), evt.Action.GetArchived()); err != nil {
+		logger.Warnf("Failed to store archive state for %s: %v", evt.JID, err)
+	}
+}
+
+// Handle chats being pinned or unpinned on another device
+func HandlePin(messageStore MessageRepository, evt *events.Pin, logger waLog.Logger) {
+	if evt.Action == nil {
+		return
+	}
+
+	var pinnedAt *time.Time
+	if evt.Action.GetPinned() {
+		timestamp := evt.Timestamp
+		if timestamp.IsZero() {
+			timestamp = time.Now()
+		}
+		pinnedAt = &timestamp
+	}
+	if err := messageStore.setChatPinned(evt.JID.String(), pinnedAt); err != nil {
+		logger.Warnf("Failed to store pin state for %s: %v", evt.JID, err)
+	}
+}
+
+// Handle chats being muted or unmuted on another device
+func HandleMute(messageStore MessageRepository, evt *events.Mute, logger waLog.Logger) {
+	if evt.Action == nil {
+		return
+	}
+
+	// The end time is in milliseconds, and -1 when the chat is muted forever
+	var mutedUntil *time.Time
+	if evt.Action.GetMuted() && evt.Action.GetMuteEndTimestamp() > 0 {
+		endTime := time.UnixMilli(evt.Action.GetMuteEndTimestamp())
+		mutedUntil = &endTime
+	}
+	if err := messageStore.setChatMuted(evt.JID.String(), evt.Action.GetMuted(), mutedUntil); err != nil {
+		logger.Warnf("Failed to store mute state for %s: %v", evt.JID, err)
+	}
+}
+
+// Handle chats being marked as read or unread on another device
+func HandleMarkChatAsRead(messageStore MessageRepository, evt *events.MarkChatAsRead, logger waLog.Logger) {
+	if evt.Action == nil {
+		return
+	}
+	if err := messageStore.setChatRead(evt.JID.String(), evt.Action.GetRead()); err != nil {
+		logger.Warnf("Failed to store read state for %s: %v", evt.JID, err)
+	}
+}
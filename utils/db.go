@@ -5,6 +5,8 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"go.mau.fi/whatsmeow/store"
@@ -12,9 +14,26 @@ import (
 	waLog "go.mau.fi/whatsmeow/util/log"
 )
 
+// SQL dialect of the configured database
+type databaseDialect string
+
+const (
+	dialectPostgres databaseDialect = "postgres"
+	dialectSQLite   databaseDialect = "sqlite"
+)
+
 // Database handler for storing message history
 type MessageStore struct {
-	Db *sql.DB
+	Db      *sql.DB
+	dialect databaseDialect
+}
+
+// Connection settings for the session and message databases
+type databaseConfig struct {
+	dialect databaseDialect
+	// Name of the database/sql driver
+	driver string
+	dsn    string
 }
 
 // function to create postgres database string
@@ -27,13 +46,51 @@ func createPostgresConnectionString() string {
 	return "postgres://" + username + ":" + password + "@" + host + ":" + port + "/" + database
 }
 
+// Create the SQLite connection string for a database file. Foreign keys are required by
+// whatsmeow, WAL and the busy timeout let the session and message stores share the file,
+// and immediate transactions keep concurrent writers from deadlocking
+func createSQLiteConnectionString(path, params string) string {
+	dsn := "file:" + path + "?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(10000)" +
+		"&_time_format=sqlite&_txlock=immediate"
+	if params != "" {
+		dsn += "&" + params
+	}
+	return dsn
+}
+
+// Get the database settings from DATABASE_URL, which is either postgres://... or
+// sqlite://path/to/file.db. Falls back to the RDS_* variables when it isn't set
+func getDatabaseConfig() (databaseConfig, error) {
+	databaseURL := strings.TrimSpace(os.Getenv("DATABASE_URL"))
+	switch {
+	case databaseURL == "":
+		return databaseConfig{dialect: dialectPostgres, driver: "pgx", dsn: createPostgresConnectionString()}, nil
+	case strings.HasPrefix(databaseURL, "postgres://"), strings.HasPrefix(databaseURL, "postgresql://"):
+		return databaseConfig{dialect: dialectPostgres, driver: "pgx", dsn: databaseURL}, nil
+	case strings.HasPrefix(databaseURL, "sqlite://"):
+		path, params, _ := strings.Cut(strings.TrimPrefix(databaseURL, "sqlite://"), "?")
+		if path == "" {
+			return databaseConfig{}, fmt.Errorf("DATABASE_URL %q has no database file path", databaseURL)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			return databaseConfig{}, fmt.Errorf("failed to create database directory: %v", err)
+		}
+		return databaseConfig{dialect: dialectSQLite, driver: "sqlite", dsn: createSQLiteConnectionString(path, params)}, nil
+	default:
+		return databaseConfig{}, fmt.Errorf("unsupported DATABASE_URL scheme, expected postgres:// or sqlite://")
+	}
+}
+
 // Create the database connection string
 func InitDB() (*sqlstore.Container, error) {
 	// Create database connection for storing session data
 	dbLog := waLog.Stdout("Database", "INFO", true)
 
-	connectionString := createPostgresConnectionString()
-	container, err := sqlstore.New(context.Background(), "pgx", connectionString, dbLog)
+	dbConfig, err := getDatabaseConfig()
+	if err != nil {
+		return nil, err
+	}
+	container, err := sqlstore.New(context.Background(), dbConfig.driver, dbConfig.dsn, dbLog)
 	if err != nil {
 		return nil, err
 	}
@@ -59,60 +116,41 @@ func InitDeviceStore(container *sqlstore.Container, logger waLog.Logger) (*store
 
 // Initialize message store
 func InitMessageStore() (*MessageStore, error) {
-	dbConnectionString := createPostgresConnectionString()
+	dbConfig, err := getDatabaseConfig()
+	if err != nil {
+		return nil, err
+	}
 
-	// Open SQLite database for messages
-	db, err := sql.Open("pgx", dbConnectionString)
+	// Open the Postgres or SQLite database for messages
+	db, err := sql.Open(dbConfig.driver, dbConfig.dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open message database: %v", err)
 	}
 
-	// Create tables if they don't exist
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS chats (
-			jid TEXT PRIMARY KEY,
-			name TEXT,
-			last_message_time TIMESTAMP
-		);
-		
-		CREATE TABLE IF NOT EXISTS messages (
-			id TEXT,
-			chat_jid TEXT,
-			sender TEXT,
-			content TEXT,
-			timestamp TIMESTAMP,
-			is_from_me BOOLEAN,
-			media_type TEXT,
-			filename TEXT,
-			url TEXT,
-			media_key BYTEA,
-			file_sha256 BYTEA,
-			file_enc_sha256 BYTEA,
-			file_length INTEGER,
-			PRIMARY KEY (id, chat_jid),
-			FOREIGN KEY (chat_jid) REFERENCES chats(jid)
-		);
-	`)
+	// Bring the schema up to date
+	err = runMigrations(context.Background(), db, dbConfig.dialect)
 	if err != nil {
 		db.Close()
-		return nil, fmt.Errorf("failed to create tables: %v", err)
+		return nil, fmt.Errorf("failed to migrate message database: %v", err)
 	}
 
-	return &MessageStore{Db: db}, nil
+	return &MessageStore{Db: db, dialect: dbConfig.dialect}, nil
 }
 
 // Get media info from the database
-func (store *MessageStore) getMediaInfo(id, chatJID string) (string, string, string, []byte, []byte, []byte, uint64, error) {
-	var mediaType, filename, url string
-	var mediaKey, fileSHA256, fileEncSHA256 []byte
-	var fileLength uint64
-
+func (store *MessageStore) getMediaInfo(id, chatJID string) (MediaInfo, error) {
+	var media MediaInfo
 	err := store.Db.QueryRow(
-		"SELECT media_type, filename, url, media_key, file_sha256, file_enc_sha256, file_length FROM messages WHERE id = $1 AND chat_jid = $2",
+		`SELECT COALESCE(media_type, ''), COALESCE(filename, ''), COALESCE(url, ''), COALESCE(direct_path, ''),
+			media_key, file_sha256, file_enc_sha256, COALESCE(file_length, 0), COALESCE(mimetype, ''), COALESCE(caption, ''),
+			COALESCE(width, 0), COALESCE(height, 0), COALESCE(seconds, 0), jpeg_thumbnail,
+			COALESCE(ptt, FALSE), COALESCE(is_animated, FALSE)
+		FROM messages WHERE id = $1 AND chat_jid = $2`,
 		id, chatJID,
-	).Scan(&mediaType, &filename, &url, &mediaKey, &fileSHA256, &fileEncSHA256, &fileLength)
-
-	return mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength, err
+	).Scan(&media.MediaType, &media.Filename, &media.URL, &media.DirectPath, &media.MediaKey, &media.FileSHA256,
+		&media.FileEncSHA256, &media.FileLength, &media.MimeType, &media.Caption, &media.Width, &media.Height,
+		&media.Seconds, &media.JPEGThumbnail, &media.PTT, &media.IsAnimated)
+	return media, err
 }
 
 // Close the database connection
@@ -134,40 +172,51 @@ func (store *MessageStore) storeChat(jid, name string, lastMessageTime time.Time
 	return err
 }
 
-// Store a message in the database
-func (store *MessageStore) storeMessage(id, chatJID, sender, content string, timestamp time.Time, isFromMe bool,
-	mediaType, filename, url string, mediaKey, fileSHA256, fileEncSHA256 []byte, fileLength uint64) error {
-	// Only store if there's actual content or media
-	if content == "" && mediaType == "" {
-		return nil
+// Record a message in a chat, creating the chat if it isn't stored yet but keeping its name
+func (store *MessageStore) touchChat(jid string, lastMessageTime time.Time) error {
+	_, err := store.Db.Exec(
+		`INSERT INTO chats (jid, last_message_time)
+		VALUES ($1, $2)
+		ON CONFLICT (jid)
+		DO UPDATE SET last_message_time = EXCLUDED.last_message_time;`,
+		jid, lastMessageTime,
+	)
+	return err
+}
+
+// Store a chat like storeChat, but only ever move its last message time forward, for
+// messages and events that can be older than the ones already stored
+func (store *MessageStore) advanceChat(jid, name string, lastMessageTime time.Time) error {
+	latest := "GREATEST(chats.last_message_time, EXCLUDED.last_message_time)"
+	if store.dialect == dialectSQLite {
+		latest = `CASE WHEN chats.last_message_time IS NULL
+			OR julianday(chats.last_message_time) < julianday(EXCLUDED.last_message_time)
+			THEN EXCLUDED.last_message_time ELSE chats.last_message_time END`
 	}
+	_, err := store.Db.Exec(
+		`INSERT INTO chats (jid, name, last_message_time)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (jid)
+		DO UPDATE SET
+		name = EXCLUDED.name,
+		last_message_time = `+latest,
+		jid, name, lastMessageTime,
+	)
+	return err
+}
 
+// Store a message in the database
+func (store *MessageStore) storeMessage(msg StoredMessage) error {
+	return store.storeMessages([]StoredMessage{msg})
+}
+
+// Store a system event (group changes etc.) as a row in the message timeline
+func (store *MessageStore) storeSystemEvent(id, chatJID, sender, content string, timestamp time.Time) error {
 	_, err := store.Db.Exec(
-		`INSERT INTO messages (
-			id, chat_jid, sender, content, timestamp, is_from_me, 
-			media_type, filename, url, media_key, file_sha256,
-			file_enc_sha256, file_length
-		) VALUES (
-			$1, $2, $3, $4, $5, $6,
-			$7, $8, $9, $10, $11,
-			$12, $13
-		)
-		ON CONFLICT (id, chat_jid) DO UPDATE SET
-			sender = EXCLUDED.sender,
-			content = EXCLUDED.content,
-			timestamp = EXCLUDED.timestamp,
-			is_from_me = EXCLUDED.is_from_me,
-			media_type = EXCLUDED.media_type,
-			filename = EXCLUDED.filename,
-			url = EXCLUDED.url,
-			media_key = EXCLUDED.media_key,
-			file_sha256 = EXCLUDED.file_sha256,
-			file_enc_sha256 = EXCLUDED.file_enc_sha256,
-			file_length = EXCLUDED.file_length
-		`,
-		id, chatJID, sender, content, timestamp, isFromMe,
-		mediaType, filename, url, mediaKey, fileSHA256,
-		fileEncSHA256, fileLength,
+		`INSERT INTO messages (id, chat_jid, sender, content, timestamp, is_from_me, is_system)
+		VALUES ($1, $2, $3, $4, $5, FALSE, TRUE)
+		ON CONFLICT (id, chat_jid) DO NOTHING`,
+		id, chatJID, sender, content, timestamp,
 	)
 	return err
-}
\ No newline at end of file
+}
@@ -0,0 +1,181 @@
+package utils
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// How long after sending a message it can still be deleted for everyone. WhatsApp allows
+// about two days; edits are limited to whatsmeow.EditWindow
+const revokeWindow = 48 * time.Hour
+
+// When messages were deleted for everyone or last edited
+const messageChangeColumns = `
+	ALTER TABLE messages ADD COLUMN revoked_at TIMESTAMP;
+	ALTER TABLE messages ADD COLUMN edited_at TIMESTAMP;
+`
+
+// Which messages were sent through the API. Their media is already ours, so the S3 backfill
+// skips them instead of archiving every copy of a broadcast or reply
+const sentMessageColumns = `
+	ALTER TABLE messages ADD COLUMN sent_via_api BOOLEAN NOT NULL DEFAULT FALSE;
+`
+
+// EditMessageRequest represents the request body for the edit message API
+type EditMessageRequest struct {
+	Message string `json:"message"`
+}
+
+// MessageChangeResponse represents the response for the revoke and edit message APIs
+type MessageChangeResponse struct {
+	ID        string    `json:"id"`
+	ChatJID   string    `json:"chat_jid"`
+	Content   string    `json:"content,omitempty"`
+	Revoked   bool      `json:"revoked,omitempty"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// Record that a message was deleted for everyone. Its text and media are cleared, as they were
+// for the recipients, so the media can't be reused by forwards or archived by the S3 backfill
+func (store *MessageStore) markMessageRevoked(id, chatJID string, revokedAt time.Time) error {
+	_, err := store.Db.Exec(
+		`UPDATE messages SET
+			content = NULL, caption = NULL, media_type = NULL, filename = NULL, url = NULL, direct_path = NULL,
+			media_key = NULL, file_sha256 = NULL, file_enc_sha256 = NULL, file_length = NULL, mimetype = NULL,
+			width = NULL, height = NULL, seconds = NULL, jpeg_thumbnail = NULL, ptt = FALSE, is_animated = FALSE,
+			revoked_at = $3
+		WHERE id = $1 AND chat_jid = $2`,
+		id, chatJID, revokedAt,
+	)
+	return err
+}
+
+// Record the new text of an edited message
+func (store *MessageStore) markMessageEdited(id, chatJID, content string, editedAt time.Time) error {
+	_, err := store.Db.Exec(
+		"UPDATE messages SET content = $3, edited_at = $4 WHERE id = $1 AND chat_jid = $2",
+		id, chatJID, content, editedAt,
+	)
+	return err
+}
+
+// Record that a message was sent through the API. It's kept out of storedMessageColumns,
+// so storing the message again, e.g. from a history sync, doesn't clear it
+func (store *MessageStore) markMessageSentViaAPI(id, chatJID string) error {
+	_, err := store.Db.Exec("UPDATE messages SET sent_via_api = TRUE WHERE id = $1 AND chat_jid = $2", id, chatJID)
+	return err
+}
+
+// Whether a message was deleted for everyone
+func (store *MessageStore) isMessageRevoked(id, chatJID string) (bool, error) {
+	var revoked bool
+	err := store.Db.QueryRow(
+		"SELECT revoked_at IS NOT NULL FROM messages WHERE id = $1 AND chat_jid = $2",
+		id, chatJID,
+	).Scan(&revoked)
+	return revoked, err
+}
+
+func registerMessageChangeRoutes(client *whatsmeow.Client, messageStore *MessageStore) {
+	// Get a message sent by us that can still be changed within window, answering with an error if it can't
+	changeableMessage := func(w http.ResponseWriter, r *http.Request, window time.Duration) (types.JID, StoredMessage, bool) {
+		if !client.IsConnected() || client.Store.ID == nil {
+			http.Error(w, "Not connected to WhatsApp", http.StatusServiceUnavailable)
+			return types.JID{}, StoredMessage{}, false
+		}
+
+		chatJID, err := parseRecipientJID(r.PathValue("chat"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return types.JID{}, StoredMessage{}, false
+		}
+		id := r.PathValue("id")
+		msg, err := messageStore.getStoredMessage(id, chatJID.String())
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return types.JID{}, StoredMessage{}, false
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting message: %v", err), http.StatusInternalServerError)
+			return types.JID{}, StoredMessage{}, false
+		}
+
+		if !msg.IsFromMe || msg.IsSystem {
+			http.Error(w, "Only messages sent by us can be changed", http.StatusForbidden)
+			return types.JID{}, StoredMessage{}, false
+		}
+		if revoked, err := messageStore.isMessageRevoked(id, chatJID.String()); err != nil {
+			http.Error(w, fmt.Sprintf("Error getting message: %v", err), http.StatusInternalServerError)
+			return types.JID{}, StoredMessage{}, false
+		} else if revoked {
+			http.Error(w, "Message was already deleted", http.StatusConflict)
+			return types.JID{}, StoredMessage{}, false
+		}
+		if time.Since(msg.Timestamp) > window {
+			http.Error(w, fmt.Sprintf("Messages can only be changed for %s after they're sent", window), http.StatusConflict)
+			return types.JID{}, StoredMessage{}, false
+		}
+		return chatJID, msg, true
+	}
+
+	// Delete a message we sent for everyone in the chat
+	http.HandleFunc("DELETE /api/messages/{chat}/{id}", func(w http.ResponseWriter, r *http.Request) {
+		chatJID, msg, ok := changeableMessage(w, r, revokeWindow)
+		if !ok {
+			return
+		}
+
+		resp, err := client.SendMessage(r.Context(), chatJID, client.BuildRevoke(chatJID, types.EmptyJID, msg.ID))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error deleting message: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if err = messageStore.markMessageRevoked(msg.ID, msg.ChatJID, resp.Timestamp); err != nil {
+			fmt.Printf("Failed to record deletion of message %s: %v\n", msg.ID, err)
+		}
+
+		writeJSON(w, http.StatusOK, MessageChangeResponse{ID: msg.ID, ChatJID: msg.ChatJID, Revoked: true, ChangedAt: resp.Timestamp})
+	})
+
+	// Replace the text of a message we sent. Only text messages can be edited
+	http.HandleFunc("PATCH /api/messages/{chat}/{id}", func(w http.ResponseWriter, r *http.Request) {
+		var req EditMessageRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		if req.Message == "" {
+			http.Error(w, "Message is required", http.StatusBadRequest)
+			return
+		}
+
+		chatJID, msg, ok := changeableMessage(w, r, whatsmeow.EditWindow)
+		if !ok {
+			return
+		}
+		if msg.MediaType != "" {
+			http.Error(w, "Only text messages can be edited", http.StatusBadRequest)
+			return
+		}
+
+		edit := client.BuildEdit(chatJID, msg.ID, &waProto.Message{Conversation: proto.String(req.Message)})
+		resp, err := client.SendMessage(r.Context(), chatJID, edit)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error editing message: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if err = messageStore.markMessageEdited(msg.ID, msg.ChatJID, req.Message, resp.Timestamp); err != nil {
+			fmt.Printf("Failed to record edit of message %s: %v\n", msg.ID, err)
+		}
+
+		writeJSON(w, http.StatusOK, MessageChangeResponse{ID: msg.ID, ChatJID: msg.ChatJID, Content: req.Message, ChangedAt: resp.Timestamp})
+	})
+}
@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/proto/waE2E"
+)
+
+const (
+	// Version of the MessageEnvelope schema, bumped on incompatible changes
+	messageEnvelopeVersion = 1
+	// Key of archived objects when S3_KEY_TEMPLATE is not set
+	defaultS3KeyTemplate = "input/{chat}/{id}.{ext}"
+)
+
+// MessageEnvelope is the JSON object archived to S3 for every message, next to its raw
+// text or media, so processors get the message details without querying the database
+type MessageEnvelope struct {
+	SchemaVersion int    `json:"schema_version"`
+	ID            string `json:"id"`
+	ChatJID       string `json:"chat_jid"`
+	Sender        string `json:"sender"`
+	PushName      string `json:"push_name,omitempty"`
+	IsFromMe      bool   `json:"is_from_me"`
+	// When the message was sent, and when it was archived
+	Timestamp  time.Time `json:"timestamp"`
+	ArchivedAt time.Time `json:"archived_at"`
+	// Text of the message, or the caption of its media
+	Content string `json:"content,omitempty"`
+	// Key of the raw text or media object archived with the envelope
+	ObjectKey string           `json:"object_key"`
+	Media     *EnvelopeMedia   `json:"media,omitempty"`
+	Context   *EnvelopeContext `json:"context,omitempty"`
+}
+
+// EnvelopeMedia describes the media of a message in a MessageEnvelope
+type EnvelopeMedia struct {
+	Type       string `json:"type"`
+	Filename   string `json:"filename,omitempty"`
+	MimeType   string `json:"mimetype,omitempty"`
+	FileLength uint64 `json:"file_length"`
+	FileSHA256 string `json:"file_sha256,omitempty"`
+	Width      uint32 `json:"width,omitempty"`
+	Height     uint32 `json:"height,omitempty"`
+	Seconds    uint32 `json:"seconds,omitempty"`
+}
+
+// EnvelopeContext describes what a message replies to, mentions or was forwarded from
+type EnvelopeContext struct {
+	QuotedMessageID string   `json:"quoted_message_id,omitempty"`
+	QuotedSender    string   `json:"quoted_sender,omitempty"`
+	MentionedJIDs   []string `json:"mentioned_jids,omitempty"`
+	IsForwarded     bool     `json:"is_forwarded,omitempty"`
+	ForwardingScore uint32   `json:"forwarding_score,omitempty"`
+}
+
+// Get the template of archived object keys. Templates must contain {id} and {ext} so every
+// message and its envelope get keys of their own; invalid ones fall back to the default
+func s3KeyTemplate() string {
+	template := os.Getenv("S3_KEY_TEMPLATE")
+	if !strings.Contains(template, "{id}") || !strings.Contains(template, "{ext}") {
+		return defaultS3KeyTemplate
+	}
+	return template
+}
+
+// Build the S3 key of an archived message object from a template. Placeholders are {chat},
+// {sender}, {id}, {ext}, and {yyyy}, {mm} and {dd} for the UTC date the message was sent.
+// The key only depends on the message, so archiving it again reuses the same key
+func renderS3Key(template string, msg StoredMessage, ext string) string {
+	timestamp := msg.Timestamp.UTC()
+	return strings.NewReplacer(
+		"{chat}", msg.ChatJID,
+		"{sender}", msg.Sender,
+		"{id}", msg.ID,
+		"{ext}", ext,
+		"{yyyy}", timestamp.Format("2006"),
+		"{mm}", timestamp.Format("01"),
+		"{dd}", timestamp.Format("02"),
+	).Replace(template)
+}
+
+// Get the file extension of the raw object of a message, without the dot
+func messageObjectExtension(msg StoredMessage) string {
+	if msg.MediaType == "" {
+		return "txt"
+	}
+	if ext := strings.TrimPrefix(filepath.Ext(msg.Filename), "."); ext != "" {
+		return ext
+	}
+	return "bin"
+}
+
+// Build the envelope of a message whose raw object was archived to objectKey. The push
+// name and context info are only known for live messages and may be empty
+func newMessageEnvelope(msg StoredMessage, objectKey string, pushName string, contextInfo *waProto.ContextInfo) MessageEnvelope {
+	envelope := MessageEnvelope{
+		SchemaVersion: messageEnvelopeVersion,
+		ID:            msg.ID,
+		ChatJID:       msg.ChatJID,
+		Sender:        msg.Sender,
+		PushName:      pushName,
+		IsFromMe:      msg.IsFromMe,
+		Timestamp:     msg.Timestamp,
+		ArchivedAt:    time.Now(),
+		Content:       msg.Content,
+		ObjectKey:     objectKey,
+		Context:       newEnvelopeContext(contextInfo),
+	}
+	if msg.MediaType != "" {
+		envelope.Media = &EnvelopeMedia{
+			Type:       msg.MediaType,
+			Filename:   msg.Filename,
+			MimeType:   msg.MimeType,
+			FileLength: msg.FileLength,
+			FileSHA256: hex.EncodeToString(msg.FileSHA256),
+			Width:      msg.Width,
+			Height:     msg.Height,
+			Seconds:    msg.Seconds,
+		}
+	}
+	return envelope
+}
+
+// Build the envelope context of a message, or nil if it has none worth keeping
+func newEnvelopeContext(contextInfo *waProto.ContextInfo) *EnvelopeContext {
+	if contextInfo == nil {
+		return nil
+	}
+	envelopeContext := &EnvelopeContext{
+		QuotedMessageID: contextInfo.GetStanzaID(),
+		QuotedSender:    contextInfo.GetParticipant(),
+		MentionedJIDs:   contextInfo.GetMentionedJID(),
+		IsForwarded:     contextInfo.GetIsForwarded(),
+		ForwardingScore: contextInfo.GetForwardingScore(),
+	}
+	if envelopeContext.QuotedMessageID == "" && len(envelopeContext.MentionedJIDs) == 0 && !envelopeContext.IsForwarded {
+		return nil
+	}
+	return envelopeContext
+}
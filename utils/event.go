@@ -13,10 +13,13 @@ import (
 )
 
 // Handle history sync events
-func HandleHistorySync(client *whatsmeow.Client, messageStore *MessageStore, historySync *events.HistorySync, logger waLog.Logger) {
+func HandleHistorySync(client *whatsmeow.Client, messageStore MessageRepository, historySync *events.HistorySync, logger waLog.Logger) {
 	fmt.Printf("Received history sync event with %d conversations\n", len(historySync.Data.Conversations))
 
-	syncedCount := 0
+	// Store push names so contacts can be resolved by name
+	storeHistoryPushNames(messageStore, historySync.Data.GetPushnames(), logger)
+
+	var batch []StoredMessage
 	for _, conversation := range historySync.Data.Conversations {
 		// Parse JID from the conversation
 		if conversation.ID == nil {
@@ -35,6 +38,11 @@ func HandleHistorySync(client *whatsmeow.Client, messageStore *MessageStore, his
 		// Get appropriate chat name by passing the history sync conversation directly
 		name := getChatName(client, messageStore, jid, chatJID, conversation, "", logger)
 
+		// Store unread count, archive, pin and mute state, and group participants
+		if err := messageStore.storeChatMetadata(chatJID, newChatMetadata(name, conversation, historySync.Data.GetSyncType())); err != nil {
+			logger.Warnf("Failed to store metadata for chat %s: %v", chatJID, err)
+		}
+
 		// Process messages
 		messages := conversation.Messages
 		if len(messages) > 0 {
@@ -51,7 +59,8 @@ func HandleHistorySync(client *whatsmeow.Client, messageStore *MessageStore, his
 			}
 			timestamp := time.Unix(int64(ts), 0)
 
-			messageStore.storeChat(chatJID, name, timestamp)
+			// Older messages loaded on demand mustn't move the last message time back
+			messageStore.advanceChat(chatJID, name, timestamp)
 
 			// Store messages
 			for _, msg := range messages {
@@ -59,30 +68,20 @@ func HandleHistorySync(client *whatsmeow.Client, messageStore *MessageStore, his
 					continue
 				}
 
-				// Extract text content
-				var content string
-				if msg.Message.Message != nil {
-					if conv := msg.Message.Message.GetConversation(); conv != "" {
-						content = conv
-					} else if ext := msg.Message.Message.GetExtendedTextMessage(); ext != nil {
-						content = ext.GetText()
-					}
-				}
+				// Extract text content, including media captions
+				content := extractTextContent(msg.Message.Message)
 
 				// Extract media info
-				var mediaType, filename, url string
-				var mediaKey, fileSHA256, fileEncSHA256 []byte
-				var fileLength uint64
-
+				var media MediaInfo
 				if msg.Message.Message != nil {
-					mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength = extractMediaInfo(msg.Message.Message)
+					media = extractMediaInfo(msg.Message.Message)
 				}
 
 				// Log the message content for debugging
-				logger.Infof("Message content: %v, Media Type: %v", content, mediaType)
+				logger.Infof("Message content: %v, Media Type: %v", content, media.MediaType)
 
 				// Skip messages with no content and no media
-				if content == "" && mediaType == "" {
+				if content == "" && media.MediaType == "" {
 					continue
 				}
 
@@ -117,39 +116,41 @@ func HandleHistorySync(client *whatsmeow.Client, messageStore *MessageStore, his
 				}
 				timestamp := time.Unix(int64(ts), 0)
 
-				err = messageStore.storeMessage(
-					msgID,
-					chatJID,
-					sender,
-					content,
-					timestamp,
-					isFromMe,
-					mediaType,
-					filename,
-					url,
-					mediaKey,
-					fileSHA256,
-					fileEncSHA256,
-					fileLength,
-				)
-				if err != nil {
-					logger.Warnf("Failed to store history message: %v", err)
-				} else {
-					syncedCount++
-					// Log successful message storage
-					if mediaType != "" {
-						logger.Infof("Stored message: [%s] %s -> %s: [%s: %s] %s",
-							timestamp.Format("2006-01-02 15:04:05"), sender, chatJID, mediaType, filename, content)
-					} else {
-						logger.Infof("Stored message: [%s] %s -> %s: %s",
-							timestamp.Format("2006-01-02 15:04:05"), sender, chatJID, content)
-					}
-				}
+				batch = append(batch, StoredMessage{
+					ID:        msgID,
+					ChatJID:   chatJID,
+					Sender:    sender,
+					Content:   content,
+					Timestamp: timestamp,
+					IsFromMe:  isFromMe,
+					MediaInfo: media,
+				})
 			}
 		}
 	}
 
-	fmt.Printf("History sync complete. Stored %d messages.\n", syncedCount)
+	// Store all messages of the sync in one transaction
+	err := messageStore.storeMessages(batch)
+	if err != nil {
+		logger.Warnf("Failed to store %d history messages: %v", len(batch), err)
+		return
+	}
+
+	// Track the progress of the sync, which arrives in several chunks
+	chunk := HistorySyncChunk{
+		SyncType:      historySync.Data.GetSyncType().String(),
+		ChunkOrder:    int(historySync.Data.GetChunkOrder()),
+		Progress:      int(historySync.Data.GetProgress()),
+		Conversations: len(historySync.Data.Conversations),
+		Messages:      len(batch),
+		ReceivedAt:    time.Now(),
+	}
+	if err = messageStore.recordHistorySyncChunk(chunk); err != nil {
+		logger.Warnf("Failed to record history sync progress: %v", err)
+	}
+
+	fmt.Printf("History sync chunk %d (%s, %d%%) complete. Stored %d messages.\n",
+		chunk.ChunkOrder, chunk.SyncType, chunk.Progress, len(batch))
 }
 
 // Handle regular incoming messages with media support
@@ -158,17 +159,33 @@ func HandleMessage(client *whatsmeow.Client, messageStore *MessageStore, s3Clien
 	chatJID := msg.Info.Chat.String()
 	sender := msg.Info.Sender.User
 	
+	// Polls and votes are tracked in their own tables
+	if handlePollMessage(client, messageStore, msg, logger) {
+		return
+	}
+
 	// Extract text content
-	content, mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength := extractMessageContent(msg.Message)
+	content, media := extractMessageContent(msg.Message)
 	
-	// SKip if no text content and mediaType is not "audio"
-	if content == "" && mediaType != "audio" {
-		logger.Infof("Ignoring non-audio media type: %s", mediaType)
+	// SKip if no text content (or caption) and mediaType is not "audio" or "sticker"
+	if content == "" && media.MediaType != "audio" && media.MediaType != "sticker" {
+		// Uncaptioned images, videos and documents aren't stored, but rules can still match them
+		if media.MediaType != "" {
+			applyRules(messageStore, msg, StoredMessage{
+				ID:        messageID,
+				ChatJID:   chatJID,
+				Sender:    sender,
+				Timestamp: msg.Info.Timestamp,
+				IsFromMe:  msg.Info.IsFromMe,
+				MediaInfo: media,
+			}, logger)
+		}
+		logger.Infof("Ignoring unsupported media type: %s", media.MediaType)
 		return
 	}
 	
 	// Skip if there's no content and no media
-	if content == "" && mediaType == "" {
+	if content == "" && media.MediaType == "" {
 		logger.Infof("No text or media content found in message from %s", chatJID)
 		return
 	}
@@ -185,21 +202,16 @@ func HandleMessage(client *whatsmeow.Client, messageStore *MessageStore, s3Clien
 	}
 
 	// Store message in database
-	err = messageStore.storeMessage(
-		messageID,
-		chatJID,
-		sender,
-		content,
-		msg.Info.Timestamp,
-		msg.Info.IsFromMe,
-		mediaType,
-		filename,
-		url,
-		mediaKey,
-		fileSHA256,
-		fileEncSHA256,
-		fileLength,
-	)
+	stored := StoredMessage{
+		ID:        messageID,
+		ChatJID:   chatJID,
+		Sender:    sender,
+		Content:   content,
+		Timestamp: msg.Info.Timestamp,
+		IsFromMe:  msg.Info.IsFromMe,
+		MediaInfo: media,
+	}
+	err = messageStore.storeMessage(stored)
 
 	if err != nil {
 		logger.Warnf("Failed to store message: %v", err)
@@ -207,16 +219,26 @@ func HandleMessage(client *whatsmeow.Client, messageStore *MessageStore, s3Clien
 	} else {
 		logger.Infof("Stored message %s from %s in chat %s", messageID, sender, chatJID)
 	}
+
+	// Run the auto-responder rules the message matches
+	applyRules(messageStore, msg, stored, logger)
 	
-	// Upload message to S3
-	filePath, err := uploadMessageToS3(client, s3Client, os.Getenv("AWS_S3_BUCKET_NAME"), content, messageID, chatJID, mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength)
+	// Upload message to S3. The phone's answer to a media retry is delivered by this same event
+	// handler, so it can't be waited for here; the S3 backfill archives the message once it arrives
+	bucketName := os.Getenv("AWS_S3_BUCKET_NAME")
+	objectKey, err := uploadMessageToS3(client, messageStore, s3Client, bucketName, stored, msg.Info.PushName, extractContextInfo(msg.Message), false)
 	if err != nil {
 		logger.Warnf("Failed to upload message to S3: %v", err)
 		return
 	} else {
-		logger.Infof("Uploaded message %s to S3 %s", messageID, filePath)
+		logger.Infof("Uploaded message %s to S3 %s/%s", messageID, bucketName, objectKey)
+	}
+
+	// Record the object so the S3 backfill skips this message
+	if err = messageStore.setMessageS3Key(messageID, chatJID, objectKey); err != nil {
+		logger.Warnf("Failed to record S3 object of message %s: %v", messageID, err)
 	}
 
 	// Log message reception
-	logMessageReception(msg, sender, mediaType, filename, content)
+	logMessageReception(msg, sender, media.MediaType, media.Filename, content)
 }
@@ -0,0 +1,298 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// Most chats a message can be forwarded to at once, the same limit as the WhatsApp apps
+	maxForwardRecipients = 5
+	// Media whose CDN link expires sooner than this is uploaded again rather than reused,
+	// so recipients have time to download it
+	forwardMediaExpiryMargin = 10 * time.Minute
+)
+
+var errNothingToForward = errors.New("message has no text or media to forward")
+
+// ForwardRequest represents the request body for the forward message API
+type ForwardRequest struct {
+	Recipients []string `json:"recipients"`
+	// Check that phone number recipients are on WhatsApp before sending.
+	// Defaults to the VERIFY_RECIPIENTS setting
+	Verify *bool `json:"verify,omitempty"`
+}
+
+// ForwardResult is the outcome of forwarding a message to one recipient
+type ForwardResult struct {
+	Recipient string `json:"recipient"`
+	ChatJID   string `json:"chat_jid,omitempty"`
+	Success   bool   `json:"success"`
+	MessageID string `json:"message_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ForwardResponse represents the response for the forward message API
+type ForwardResponse struct {
+	ID      string `json:"id"`
+	ChatJID string `json:"chat_jid"`
+	// Whether the media was uploaded to WhatsApp again because its CDN link had expired
+	Reuploaded bool            `json:"reuploaded"`
+	Results    []ForwardResult `json:"results"`
+}
+
+// Get the S3 object a message was archived to, or "" if it wasn't
+func (store *MessageStore) getMessageS3Key(id, chatJID string) (string, error) {
+	var objectKey string
+	err := store.Db.QueryRow(
+		"SELECT COALESCE(s3_key, '') FROM messages WHERE id = $1 AND chat_jid = $2",
+		id, chatJID,
+	).Scan(&objectKey)
+	return objectKey, err
+}
+
+// Get when the CDN link of a media direct path expires, from its "oe" parameter,
+// which holds the expiry as a hexadecimal Unix timestamp
+func mediaPathExpiry(directPath string) (time.Time, bool) {
+	parsed, err := url.Parse(directPath)
+	if err != nil {
+		return time.Time{}, false
+	}
+	expiry, err := strconv.ParseInt(parsed.Query().Get("oe"), 16, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(expiry, 0), true
+}
+
+// Whether the stored media references of a message can still be sent as they are.
+// Links without a known expiry are treated as expired
+func mediaReferencesValid(media MediaInfo) bool {
+	if media.DirectPath == "" || len(media.MediaKey) == 0 || len(media.FileEncSHA256) == 0 {
+		return false
+	}
+	expiry, ok := mediaPathExpiry(media.DirectPath)
+	return ok && time.Until(expiry) > forwardMediaExpiryMargin
+}
+
+// Get the type media of a stored message is uploaded as
+func storedMediaUploadType(mediaType string) (whatsmeow.MediaType, error) {
+	switch mediaType {
+	case "image", "sticker":
+		return whatsmeow.MediaImage, nil
+	case "video":
+		return whatsmeow.MediaVideo, nil
+	case "audio":
+		return whatsmeow.MediaAudio, nil
+	case "document":
+		return whatsmeow.MediaDocument, nil
+	}
+	return "", fmt.Errorf("unsupported media type %q", mediaType)
+}
+
+// Upload the media of a stored message to WhatsApp again, reading it from its S3 archive
+// or, if it wasn't archived, from WhatsApp, asking the phone for it if it has expired
+func reuploadStoredMedia(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, s3Client *s3.Client, msg StoredMessage) (MediaInfo, error) {
+	mediaType, err := storedMediaUploadType(msg.MediaType)
+	if err != nil {
+		return MediaInfo{}, err
+	}
+
+	var mediaData []byte
+	objectKey, err := messageStore.getMessageS3Key(msg.ID, msg.ChatJID)
+	if err != nil {
+		return MediaInfo{}, err
+	}
+	if objectKey != "" && s3Client != nil {
+		mediaData, err = downloadS3Object(ctx, s3Client, os.Getenv("AWS_S3_BUCKET_NAME"), objectKey)
+		if err != nil {
+			fmt.Printf("Failed to read archived media of message %s, downloading it from WhatsApp: %v\n", msg.ID, err)
+		}
+	}
+	if mediaData == nil {
+		mediaData, err = downloadWhatsAppMediaWithRetry(client, messageStore, msg.ID, msg.ChatJID, msg.MediaInfo)
+		if err != nil {
+			return MediaInfo{}, fmt.Errorf("failed to download media: %w", err)
+		}
+	}
+
+	uploaded, err := client.Upload(ctx, mediaData, mediaType)
+	if err != nil {
+		return MediaInfo{}, fmt.Errorf("failed to upload media: %v", err)
+	}
+	media := msg.MediaInfo
+	media.URL, media.DirectPath, media.MediaKey = uploaded.URL, uploaded.DirectPath, uploaded.MediaKey
+	media.FileSHA256, media.FileEncSHA256, media.FileLength = uploaded.FileSHA256, uploaded.FileEncSHA256, uploaded.FileLength
+	return media, nil
+}
+
+// Rebuild the protobuf of a stored message from its text and media references
+func buildStoredMessage(msg StoredMessage, media MediaInfo) (*waProto.Message, error) {
+	switch media.MediaType {
+	case "":
+		if msg.Content == "" {
+			return nil, errNothingToForward
+		}
+		return &waProto.Message{Conversation: proto.String(msg.Content)}, nil
+	case "image":
+		return &waProto.Message{ImageMessage: &waProto.ImageMessage{
+			URL: optionalString(media.URL), DirectPath: proto.String(media.DirectPath), MediaKey: media.MediaKey,
+			FileSHA256: media.FileSHA256, FileEncSHA256: media.FileEncSHA256, FileLength: proto.Uint64(media.FileLength),
+			Mimetype: proto.String(media.MimeType), Caption: optionalString(media.Caption),
+			Width: proto.Uint32(media.Width), Height: proto.Uint32(media.Height), JPEGThumbnail: media.JPEGThumbnail,
+		}}, nil
+	case "video":
+		return &waProto.Message{VideoMessage: &waProto.VideoMessage{
+			URL: optionalString(media.URL), DirectPath: proto.String(media.DirectPath), MediaKey: media.MediaKey,
+			FileSHA256: media.FileSHA256, FileEncSHA256: media.FileEncSHA256, FileLength: proto.Uint64(media.FileLength),
+			Mimetype: proto.String(media.MimeType), Caption: optionalString(media.Caption),
+			Width: proto.Uint32(media.Width), Height: proto.Uint32(media.Height), Seconds: proto.Uint32(media.Seconds),
+			JPEGThumbnail: media.JPEGThumbnail,
+		}}, nil
+	case "audio":
+		return &waProto.Message{AudioMessage: &waProto.AudioMessage{
+			URL: optionalString(media.URL), DirectPath: proto.String(media.DirectPath), MediaKey: media.MediaKey,
+			FileSHA256: media.FileSHA256, FileEncSHA256: media.FileEncSHA256, FileLength: proto.Uint64(media.FileLength),
+			Mimetype: proto.String(media.MimeType), Seconds: proto.Uint32(media.Seconds),
+			PTT: proto.Bool(media.PTT),
+		}}, nil
+	case "sticker":
+		return &waProto.Message{StickerMessage: &waProto.StickerMessage{
+			URL: optionalString(media.URL), DirectPath: proto.String(media.DirectPath), MediaKey: media.MediaKey,
+			FileSHA256: media.FileSHA256, FileEncSHA256: media.FileEncSHA256, FileLength: proto.Uint64(media.FileLength),
+			Mimetype: proto.String(media.MimeType), Width: proto.Uint32(media.Width), Height: proto.Uint32(media.Height),
+			IsAnimated: proto.Bool(media.IsAnimated),
+		}}, nil
+	case "document":
+		return &waProto.Message{DocumentMessage: &waProto.DocumentMessage{
+			URL: optionalString(media.URL), DirectPath: proto.String(media.DirectPath), MediaKey: media.MediaKey,
+			FileSHA256: media.FileSHA256, FileEncSHA256: media.FileEncSHA256, FileLength: proto.Uint64(media.FileLength),
+			Mimetype: proto.String(media.MimeType), Caption: optionalString(media.Caption),
+			FileName: proto.String(media.Filename), JPEGThumbnail: media.JPEGThumbnail,
+		}}, nil
+	}
+	return nil, fmt.Errorf("unsupported media type %q", media.MediaType)
+}
+
+// Get a pointer to a string, or nil if it's empty so it's left out of the message
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return proto.String(s)
+}
+
+// Build the message forwarding a stored message. Its media references are reused while
+// its CDN link is valid, otherwise the media is uploaded again
+func buildStoredForwardMessage(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, s3Client *s3.Client, msg StoredMessage) (forward *waProto.Message, reuploaded bool, err error) {
+	if msg.IsSystem {
+		return nil, false, errNothingToForward
+	}
+
+	media := msg.MediaInfo
+	if media.MediaType != "" && !mediaReferencesValid(media) {
+		if media, err = reuploadStoredMedia(ctx, client, messageStore, s3Client, msg); err != nil {
+			return nil, false, err
+		}
+		reuploaded = true
+	}
+
+	stored, err := buildStoredMessage(msg, media)
+	if err != nil {
+		return nil, false, err
+	}
+	return buildForwardMessage(stored), reuploaded, nil
+}
+
+func registerForwardRoutes(client *whatsmeow.Client, messageStore *MessageStore, s3Client *s3.Client) {
+	// Forward a stored message to one or more chats, e.g. to relay a voice note to a group
+	http.HandleFunc("POST /api/messages/{chat}/{id}/forward", func(w http.ResponseWriter, r *http.Request) {
+		if !client.IsConnected() || client.Store.ID == nil {
+			http.Error(w, "Not connected to WhatsApp", http.StatusServiceUnavailable)
+			return
+		}
+
+		chatJID, err := parseRecipientJID(r.PathValue("chat"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var req ForwardRequest
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		if len(req.Recipients) == 0 || len(req.Recipients) > maxForwardRecipients {
+			http.Error(w, fmt.Sprintf("Between 1 and %d recipients are required", maxForwardRecipients), http.StatusBadRequest)
+			return
+		}
+
+		id := r.PathValue("id")
+		msg, err := messageStore.getStoredMessage(id, chatJID.String())
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting message: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if revoked, err := messageStore.isMessageRevoked(id, chatJID.String()); err != nil {
+			http.Error(w, fmt.Sprintf("Error getting message: %v", err), http.StatusInternalServerError)
+			return
+		} else if revoked {
+			http.Error(w, "Message was deleted", http.StatusGone)
+			return
+		}
+
+		forward, reuploaded, err := buildStoredForwardMessage(r.Context(), client, messageStore, s3Client, msg)
+		switch {
+		case errors.Is(err, errNothingToForward):
+			http.Error(w, "Message has no text or media to forward", http.StatusBadRequest)
+			return
+		case errors.Is(err, whatsmeow.ErrMediaNotAvailableOnPhone):
+			http.Error(w, "Media is no longer available on the phone", http.StatusGone)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("Error preparing message: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		// Recipients are sent to one at a time, so one failing doesn't stop the others
+		resp := ForwardResponse{ID: id, ChatJID: chatJID.String(), Reuploaded: reuploaded}
+		for _, recipient := range req.Recipients {
+			result := ForwardResult{Recipient: recipient}
+			recipientJID, err := resolveRecipient(r.Context(), client, messageStore, recipient, shouldVerifyRecipient(req.Verify))
+			if err == nil && recipientJID.Server == types.NewsletterServer {
+				err = fmt.Errorf("%w: messages can't be forwarded to newsletters", errInvalidRecipient)
+			}
+			if err == nil {
+				result.ChatJID = recipientJID.String()
+				var sent whatsmeow.SendResponse
+				if sent, err = client.SendMessage(r.Context(), recipientJID, forward); err == nil {
+					result.Success, result.MessageID = true, sent.ID
+					recordSentMessage(client, messageStore, recipientJID, sent, forward)
+				}
+			}
+			if err != nil {
+				result.Error = err.Error()
+			}
+			resp.Results = append(resp.Results, result)
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	})
+}
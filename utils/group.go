@@ -0,0 +1,878 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// CreateGroupRequest represents the request body for the create group API
+type CreateGroupRequest struct {
+	Name         string   `json:"name"`
+	Participants []string `json:"participants"`
+}
+
+// UpdateParticipantsRequest represents the request body for the group participants API
+type UpdateParticipantsRequest struct {
+	Action       string   `json:"action"`
+	Participants []string `json:"participants"`
+}
+
+// SetGroupSubjectRequest represents the request body for the group subject API
+type SetGroupSubjectRequest struct {
+	Subject string `json:"subject"`
+}
+
+// SetGroupDescriptionRequest represents the request body for the group description API
+type SetGroupDescriptionRequest struct {
+	Description string `json:"description"`
+}
+
+// SetGroupPhotoRequest represents the request body for the group photo API.
+// The photo is read from S3 and must be a JPEG image
+type SetGroupPhotoRequest struct {
+	BucketName string `json:"bucket_name"`
+	ObjectKey  string `json:"object_key"`
+}
+
+// JoinGroupRequest represents the request body for the join group API
+type JoinGroupRequest struct {
+	Code string `json:"code"`
+}
+
+// GroupParticipantResponse represents a single group participant in API responses
+type GroupParticipantResponse struct {
+	JID         string `json:"jid"`
+	PhoneNumber string `json:"phone_number,omitempty"`
+	Role        string `json:"role"`
+	Error       int    `json:"error,omitempty"`
+}
+
+// GroupResponse represents group metadata in API responses
+type GroupResponse struct {
+	JID               string                     `json:"jid"`
+	Name              string                     `json:"name"`
+	Topic             string                     `json:"topic,omitempty"`
+	OwnerJID          string                     `json:"owner_jid,omitempty"`
+	IsLocked          bool                       `json:"is_locked"`
+	IsAnnounce        bool                       `json:"is_announce"`
+	IsEphemeral       bool                       `json:"is_ephemeral"`
+	DisappearingTimer uint32                     `json:"disappearing_timer,omitempty"`
+	CreatedAt         time.Time                  `json:"created_at"`
+	Participants      []GroupParticipantResponse `json:"participants,omitempty"`
+}
+
+// InviteLinkResponse represents the response for the group invite link API
+type InviteLinkResponse struct {
+	Link string `json:"link"`
+}
+
+// participantRole maps whatsmeow's admin flags onto the role stored in group_participants
+func participantRole(participant types.GroupParticipant) string {
+	if participant.IsSuperAdmin {
+		return "superadmin"
+	} else if participant.IsAdmin {
+		return "admin"
+	}
+	return "member"
+}
+
+func newGroupParticipantResponse(participant types.GroupParticipant) GroupParticipantResponse {
+	resp := GroupParticipantResponse{
+		JID:   participant.JID.String(),
+		Role:  participantRole(participant),
+		Error: participant.Error,
+	}
+	if !participant.PhoneNumber.IsEmpty() {
+		resp.PhoneNumber = participant.PhoneNumber.String()
+	}
+	return resp
+}
+
+func newGroupResponse(info *types.GroupInfo, withParticipants bool) GroupResponse {
+	resp := GroupResponse{
+		JID:               info.JID.String(),
+		Name:              info.Name,
+		Topic:             info.Topic,
+		IsLocked:          info.IsLocked,
+		IsAnnounce:        info.IsAnnounce,
+		IsEphemeral:       info.IsEphemeral,
+		DisappearingTimer: info.DisappearingTimer,
+		CreatedAt:         info.GroupCreated,
+	}
+	if !info.OwnerJID.IsEmpty() {
+		resp.OwnerJID = info.OwnerJID.String()
+	}
+	if withParticipants {
+		resp.Participants = make([]GroupParticipantResponse, len(info.Participants))
+		for i, participant := range info.Participants {
+			resp.Participants[i] = newGroupParticipantResponse(participant)
+		}
+	}
+	return resp
+}
+
+// Store a group and its current participant list in the database
+func (store *MessageStore) storeGroup(info *types.GroupInfo) error {
+	tx, err := store.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	groupJID := info.JID.String()
+	_, err = tx.Exec(
+		`INSERT INTO groups (
+			jid, name, topic, owner_jid, is_locked, is_announce,
+			is_ephemeral, disappearing_timer, created_at, updated_at
+		) VALUES (
+			$1, $2, $3, $4, $5, $6,
+			$7, $8, $9, $10
+		)
+		ON CONFLICT (jid) DO UPDATE SET
+			name = EXCLUDED.name,
+			topic = EXCLUDED.topic,
+			owner_jid = EXCLUDED.owner_jid,
+			is_locked = EXCLUDED.is_locked,
+			is_announce = EXCLUDED.is_announce,
+			is_ephemeral = EXCLUDED.is_ephemeral,
+			disappearing_timer = EXCLUDED.disappearing_timer,
+			created_at = EXCLUDED.created_at,
+			updated_at = EXCLUDED.updated_at
+		`,
+		groupJID, info.Name, info.Topic, info.OwnerJID.String(), info.IsLocked, info.IsAnnounce,
+		info.IsEphemeral, info.DisappearingTimer, info.GroupCreated, time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	// Keep the chat name in sync with the group subject
+	if info.Name != "" {
+		_, err = tx.Exec("UPDATE chats SET name = $2 WHERE jid = $1", groupJID, info.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Mark participants that are no longer in the group as having left
+	rows, err := tx.Query("SELECT participant_jid FROM group_participants WHERE group_jid = $1 AND left_at IS NULL", groupJID)
+	if err != nil {
+		return err
+	}
+	var active []string
+	for rows.Next() {
+		var participantJID string
+		if err = rows.Scan(&participantJID); err != nil {
+			rows.Close()
+			return err
+		}
+		active = append(active, participantJID)
+	}
+	rows.Close()
+
+	now := time.Now()
+	current := make(map[string]bool, len(info.Participants))
+	for _, participant := range info.Participants {
+		current[participant.JID.String()] = true
+		err = upsertGroupParticipant(tx, groupJID, participant.JID, participant.PhoneNumber, participantRole(participant), now)
+		if err != nil {
+			return err
+		}
+	}
+	for _, participantJID := range active {
+		if !current[participantJID] {
+			_, err = tx.Exec(
+				"UPDATE group_participants SET left_at = $3 WHERE group_jid = $1 AND participant_jid = $2",
+				groupJID, participantJID, now,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Insert or re-activate a group participant. The join time of a participant that is
+// already active is kept, so re-reading the group doesn't reset membership history
+func upsertGroupParticipant(tx *sql.Tx, groupJID string, jid, phoneNumber types.JID, role string, joinedAt time.Time) error {
+	var pn string
+	if !phoneNumber.IsEmpty() {
+		pn = phoneNumber.String()
+	}
+	_, err := tx.Exec(
+		`INSERT INTO group_participants (group_jid, participant_jid, phone_number, role, joined_at, left_at)
+		VALUES ($1, $2, $3, $4, $5, NULL)
+		ON CONFLICT (group_jid, participant_jid) DO UPDATE SET
+			phone_number = COALESCE(NULLIF(EXCLUDED.phone_number, ''), group_participants.phone_number),
+			role = EXCLUDED.role,
+			joined_at = CASE
+				WHEN group_participants.left_at IS NULL AND group_participants.joined_at IS NOT NULL
+				THEN group_participants.joined_at
+				ELSE EXCLUDED.joined_at
+			END,
+			left_at = NULL
+		`,
+		groupJID, jid.String(), pn, role, joinedAt,
+	)
+	return err
+}
+
+// Fetch the latest group info from WhatsApp and reflect it in the database
+func refreshGroup(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, jid types.JID) (*types.GroupInfo, error) {
+	info, err := client.GetGroupInfo(ctx, jid)
+	if err != nil {
+		return nil, err
+	}
+	err = messageStore.storeGroup(info)
+	if err != nil {
+		fmt.Printf("Failed to store group %s: %v\n", jid, err)
+	}
+	return info, nil
+}
+
+// groupErrorStatus maps whatsmeow group errors onto HTTP status codes
+func groupErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, whatsmeow.ErrGroupNotFound), errors.Is(err, whatsmeow.ErrIQNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, whatsmeow.ErrNotInGroup), errors.Is(err, whatsmeow.ErrIQForbidden),
+		errors.Is(err, whatsmeow.ErrGroupInviteLinkUnauthorized), errors.Is(err, whatsmeow.ErrIQNotAuthorized):
+		return http.StatusForbidden
+	case errors.Is(err, whatsmeow.ErrInvalidImageFormat), errors.Is(err, whatsmeow.ErrInviteLinkInvalid),
+		errors.Is(err, whatsmeow.ErrIQBadRequest), errors.Is(err, whatsmeow.ErrIQNotAcceptable):
+		return http.StatusBadRequest
+	case errors.Is(err, whatsmeow.ErrInviteLinkRevoked):
+		return http.StatusGone
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Parse the {jid} path value of a group request, rejecting non-group JIDs
+func parseGroupJID(r *http.Request) (types.JID, error) {
+	jid, err := types.ParseJID(r.PathValue("jid"))
+	if err != nil {
+		return types.JID{}, err
+	}
+	if jid.Server != types.GroupServer {
+		return types.JID{}, fmt.Errorf("%s is not a group JID", jid)
+	}
+	return jid, nil
+}
+
+// Parse a list of participant phone numbers or JIDs
+func parseParticipantJIDs(participants []string) ([]types.JID, error) {
+	jids := make([]types.JID, 0, len(participants))
+	for _, participant := range participants {
+		jid, err := parseRecipientJID(participant)
+		if err != nil {
+			return nil, fmt.Errorf("invalid participant %s: %v", participant, err)
+		}
+		jids = append(jids, jid)
+	}
+	return jids, nil
+}
+
+func registerGroupRoutes(client *whatsmeow.Client, messageStore *MessageStore, s3Client *s3.Client) {
+	// Wrap group handlers so they're only run while connected to WhatsApp
+	connected := func(handler http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !client.IsConnected() {
+				http.Error(w, "Not connected to WhatsApp", http.StatusServiceUnavailable)
+				return
+			}
+			handler(w, r)
+		}
+	}
+
+	// Create a new group
+	http.HandleFunc("POST /api/groups", connected(func(w http.ResponseWriter, r *http.Request) {
+		var req CreateGroupRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		if req.Name == "" {
+			http.Error(w, "Name is required", http.StatusBadRequest)
+			return
+		}
+		participants, err := parseParticipantJIDs(req.Participants)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		info, err := client.CreateGroup(r.Context(), whatsmeow.ReqCreateGroup{
+			Name:         req.Name,
+			Participants: participants,
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error creating group: %v", err), groupErrorStatus(err))
+			return
+		}
+		if err = messageStore.storeGroup(info); err != nil {
+			fmt.Printf("Failed to store group %s: %v\n", info.JID, err)
+		}
+
+		writeJSON(w, http.StatusCreated, newGroupResponse(info, true))
+	}))
+
+	// List all groups we're participating in
+	http.HandleFunc("GET /api/groups", connected(func(w http.ResponseWriter, r *http.Request) {
+		groups, err := client.GetJoinedGroups(r.Context())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting joined groups: %v", err), groupErrorStatus(err))
+			return
+		}
+
+		resp := make([]GroupResponse, len(groups))
+		for i, info := range groups {
+			if err = messageStore.storeGroup(info); err != nil {
+				fmt.Printf("Failed to store group %s: %v\n", info.JID, err)
+			}
+			resp[i] = newGroupResponse(info, false)
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}))
+
+	// Get group metadata including participants
+	http.HandleFunc("GET /api/groups/{jid}", connected(func(w http.ResponseWriter, r *http.Request) {
+		jid, err := parseGroupJID(r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid group JID: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		info, err := refreshGroup(r.Context(), client, messageStore, jid)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting group info: %v", err), groupErrorStatus(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, newGroupResponse(info, true))
+	}))
+
+	// Get only the participants of a group
+	http.HandleFunc("GET /api/groups/{jid}/participants", connected(func(w http.ResponseWriter, r *http.Request) {
+		jid, err := parseGroupJID(r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid group JID: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		info, err := refreshGroup(r.Context(), client, messageStore, jid)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting group info: %v", err), groupErrorStatus(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, newGroupResponse(info, true).Participants)
+	}))
+
+	// Add, remove, promote or demote participants
+	http.HandleFunc("POST /api/groups/{jid}/participants", connected(func(w http.ResponseWriter, r *http.Request) {
+		jid, err := parseGroupJID(r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid group JID: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		var req UpdateParticipantsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+
+		action := whatsmeow.ParticipantChange(strings.ToLower(req.Action))
+		switch action {
+		case whatsmeow.ParticipantChangeAdd, whatsmeow.ParticipantChangeRemove,
+			whatsmeow.ParticipantChangePromote, whatsmeow.ParticipantChangeDemote:
+		default:
+			http.Error(w, "Action must be one of add, remove, promote or demote", http.StatusBadRequest)
+			return
+		}
+		if len(req.Participants) == 0 {
+			http.Error(w, "Participants are required", http.StatusBadRequest)
+			return
+		}
+		participants, err := parseParticipantJIDs(req.Participants)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		changed, err := client.UpdateGroupParticipants(r.Context(), jid, participants, action)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error updating participants: %v", err), groupErrorStatus(err))
+			return
+		}
+
+		// Re-read the group so the stored participant list matches the server's view
+		if _, err = refreshGroup(r.Context(), client, messageStore, jid); err != nil {
+			fmt.Printf("Failed to refresh group %s after participant update: %v\n", jid, err)
+		}
+
+		resp := make([]GroupParticipantResponse, len(changed))
+		for i, participant := range changed {
+			resp[i] = newGroupParticipantResponse(participant)
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}))
+
+	// Change the group subject (name)
+	http.HandleFunc("PUT /api/groups/{jid}/subject", connected(func(w http.ResponseWriter, r *http.Request) {
+		jid, err := parseGroupJID(r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid group JID: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		var req SetGroupSubjectRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		if req.Subject == "" {
+			http.Error(w, "Subject is required", http.StatusBadRequest)
+			return
+		}
+
+		if err = client.SetGroupName(r.Context(), jid, req.Subject); err != nil {
+			http.Error(w, fmt.Sprintf("Error setting group subject: %v", err), groupErrorStatus(err))
+			return
+		}
+
+		info, err := refreshGroup(r.Context(), client, messageStore, jid)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting group info: %v", err), groupErrorStatus(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, newGroupResponse(info, false))
+	}))
+
+	// Change the group description (topic). An empty description removes it
+	http.HandleFunc("PUT /api/groups/{jid}/description", connected(func(w http.ResponseWriter, r *http.Request) {
+		jid, err := parseGroupJID(r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid group JID: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		var req SetGroupDescriptionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+
+		if err = client.SetGroupTopic(r.Context(), jid, "", "", req.Description); err != nil {
+			http.Error(w, fmt.Sprintf("Error setting group description: %v", err), groupErrorStatus(err))
+			return
+		}
+
+		info, err := refreshGroup(r.Context(), client, messageStore, jid)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting group info: %v", err), groupErrorStatus(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, newGroupResponse(info, false))
+	}))
+
+	// Change the group photo using a JPEG stored in S3
+	http.HandleFunc("PUT /api/groups/{jid}/photo", connected(func(w http.ResponseWriter, r *http.Request) {
+		jid, err := parseGroupJID(r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid group JID: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		var req SetGroupPhotoRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		if req.BucketName == "" || req.ObjectKey == "" {
+			http.Error(w, "Bucket name and object key are required", http.StatusBadRequest)
+			return
+		}
+
+		photo, err := downloadS3Object(r.Context(), s3Client, req.BucketName, req.ObjectKey)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error reading photo: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		pictureID, err := client.SetGroupPhoto(r.Context(), jid, photo)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error setting group photo: %v", err), groupErrorStatus(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, SendMessageResponse{
+			Success: true,
+			Message: fmt.Sprintf("Group photo updated (%s)", pictureID),
+		})
+	}))
+
+	// Get the current invite link of a group
+	http.HandleFunc("GET /api/groups/{jid}/invite-link", connected(func(w http.ResponseWriter, r *http.Request) {
+		jid, err := parseGroupJID(r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid group JID: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		link, err := client.GetGroupInviteLink(r.Context(), jid, false)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting invite link: %v", err), groupErrorStatus(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, InviteLinkResponse{Link: link})
+	}))
+
+	// Reset the invite link, revoking the old one
+	http.HandleFunc("POST /api/groups/{jid}/invite-link/reset", connected(func(w http.ResponseWriter, r *http.Request) {
+		jid, err := parseGroupJID(r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid group JID: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		link, err := client.GetGroupInviteLink(r.Context(), jid, true)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error resetting invite link: %v", err), groupErrorStatus(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, InviteLinkResponse{Link: link})
+	}))
+
+	// Join a group with an invite code or chat.whatsapp.com link
+	http.HandleFunc("POST /api/groups/join", connected(func(w http.ResponseWriter, r *http.Request) {
+		var req JoinGroupRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		if req.Code == "" {
+			http.Error(w, "Invite code is required", http.StatusBadRequest)
+			return
+		}
+
+		jid, err := client.JoinGroupWithLink(r.Context(), strings.TrimSpace(req.Code))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error joining group: %v", err), groupErrorStatus(err))
+			return
+		}
+
+		// Joining may be pending admin approval, in which case group info isn't available yet
+		info, err := refreshGroup(r.Context(), client, messageStore, jid)
+		if err != nil {
+			writeJSON(w, http.StatusAccepted, GroupResponse{JID: jid.String()})
+			return
+		}
+		writeJSON(w, http.StatusOK, newGroupResponse(info, true))
+	}))
+}
+
+// Apply an incremental group change event to the groups and group_participants tables
+func (store *MessageStore) applyGroupChanges(evt *events.GroupInfo, timestamp time.Time) error {
+	tx, err := store.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	groupJID := evt.JID.String()
+	setColumn := func(column string, value interface{}) error {
+		_, err := tx.Exec(
+			fmt.Sprintf("UPDATE groups SET %s = $2, updated_at = $3 WHERE jid = $1", column),
+			groupJID, value, timestamp,
+		)
+		return err
+	}
+	if evt.Name != nil {
+		if err = setColumn("name", evt.Name.Name); err != nil {
+			return err
+		}
+	}
+	if evt.Topic != nil {
+		if err = setColumn("topic", evt.Topic.Topic); err != nil {
+			return err
+		}
+	}
+	if evt.Locked != nil {
+		if err = setColumn("is_locked", evt.Locked.IsLocked); err != nil {
+			return err
+		}
+	}
+	if evt.Announce != nil {
+		if err = setColumn("is_announce", evt.Announce.IsAnnounce); err != nil {
+			return err
+		}
+	}
+	if evt.Ephemeral != nil {
+		if err = setColumn("is_ephemeral", evt.Ephemeral.IsEphemeral); err != nil {
+			return err
+		}
+		if err = setColumn("disappearing_timer", evt.Ephemeral.DisappearingTimer); err != nil {
+			return err
+		}
+	}
+
+	for _, jid := range evt.Join {
+		if err = upsertGroupParticipant(tx, groupJID, jid, types.EmptyJID, "member", timestamp); err != nil {
+			return err
+		}
+	}
+	for _, jid := range evt.Leave {
+		_, err = tx.Exec(
+			"UPDATE group_participants SET left_at = $3 WHERE group_jid = $1 AND participant_jid = $2",
+			groupJID, jid.String(), timestamp,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	for _, jid := range evt.Promote {
+		_, err = tx.Exec(
+			"UPDATE group_participants SET role = 'admin' WHERE group_jid = $1 AND participant_jid = $2",
+			groupJID, jid.String(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	for _, jid := range evt.Demote {
+		_, err = tx.Exec(
+			"UPDATE group_participants SET role = 'member' WHERE group_jid = $1 AND participant_jid = $2",
+			groupJID, jid.String(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Check whether the info of a group has been stored before. Groups only known from the
+// participants in a history sync have no updated_at
+func (store *MessageStore) groupExists(jid string) (bool, error) {
+	var exists bool
+	err := store.Db.QueryRow("SELECT EXISTS (SELECT 1 FROM groups WHERE jid = $1 AND updated_at IS NOT NULL)", jid).Scan(&exists)
+	return exists, err
+}
+
+// Join the user parts of a list of JIDs for display
+func joinJIDUsers(jids []types.JID) string {
+	users := make([]string, len(jids))
+	for i, jid := range jids {
+		users[i] = jid.User
+	}
+	return strings.Join(users, ", ")
+}
+
+// Check whether the given JID is in the list
+func containsJID(jids []types.JID, jid types.JID) bool {
+	for _, other := range jids {
+		if other.User == jid.User {
+			return true
+		}
+	}
+	return false
+}
+
+// Build human readable descriptions of the changes in a group info event
+func describeGroupChanges(evt *events.GroupInfo) []string {
+	actor := "Someone"
+	var actorJID types.JID
+	if evt.Sender != nil {
+		actorJID = *evt.Sender
+		actor = actorJID.User
+	}
+
+	var descriptions []string
+	if len(evt.Join) > 0 {
+		if evt.Sender != nil && !containsJID(evt.Join, actorJID) {
+			descriptions = append(descriptions, fmt.Sprintf("%s added %s", actor, joinJIDUsers(evt.Join)))
+		} else if evt.JoinReason == "invite" {
+			descriptions = append(descriptions, fmt.Sprintf("%s joined using an invite link", joinJIDUsers(evt.Join)))
+		} else {
+			descriptions = append(descriptions, fmt.Sprintf("%s joined", joinJIDUsers(evt.Join)))
+		}
+	}
+	if len(evt.Leave) > 0 {
+		if evt.Sender != nil && !containsJID(evt.Leave, actorJID) {
+			descriptions = append(descriptions, fmt.Sprintf("%s removed %s", actor, joinJIDUsers(evt.Leave)))
+		} else {
+			descriptions = append(descriptions, fmt.Sprintf("%s left", joinJIDUsers(evt.Leave)))
+		}
+	}
+	if len(evt.Promote) > 0 {
+		descriptions = append(descriptions, fmt.Sprintf("%s made %s an admin", actor, joinJIDUsers(evt.Promote)))
+	}
+	if len(evt.Demote) > 0 {
+		descriptions = append(descriptions, fmt.Sprintf("%s dismissed %s as admin", actor, joinJIDUsers(evt.Demote)))
+	}
+	if evt.Name != nil {
+		descriptions = append(descriptions, fmt.Sprintf("%s changed the subject to %q", actor, evt.Name.Name))
+	}
+	if evt.Topic != nil {
+		if evt.Topic.TopicDeleted {
+			descriptions = append(descriptions, fmt.Sprintf("%s deleted the group description", actor))
+		} else {
+			descriptions = append(descriptions, fmt.Sprintf("%s changed the group description", actor))
+		}
+	}
+	if evt.Locked != nil {
+		if evt.Locked.IsLocked {
+			descriptions = append(descriptions, fmt.Sprintf("%s allowed only admins to edit group info", actor))
+		} else {
+			descriptions = append(descriptions, fmt.Sprintf("%s allowed all participants to edit group info", actor))
+		}
+	}
+	if evt.Announce != nil {
+		if evt.Announce.IsAnnounce {
+			descriptions = append(descriptions, fmt.Sprintf("%s allowed only admins to send messages", actor))
+		} else {
+			descriptions = append(descriptions, fmt.Sprintf("%s allowed all participants to send messages", actor))
+		}
+	}
+	if evt.Ephemeral != nil {
+		if evt.Ephemeral.IsEphemeral {
+			timer := time.Duration(evt.Ephemeral.DisappearingTimer) * time.Second
+			descriptions = append(descriptions, fmt.Sprintf("%s turned on disappearing messages (%s)", actor, timer))
+		} else {
+			descriptions = append(descriptions, fmt.Sprintf("%s turned off disappearing messages", actor))
+		}
+	}
+	if evt.Delete != nil && evt.Delete.Deleted {
+		descriptions = append(descriptions, fmt.Sprintf("%s deleted the group", actor))
+	}
+	return descriptions
+}
+
+// Build the ID of a system event from everything that describes it, so events in the same
+// second get different IDs while the same event delivered twice is only stored once. The
+// event key holds the data identifying the event, and never the time it was received
+func systemEventID(chatJID, sender, eventKey, description string) string {
+	hash := sha256.Sum256([]byte(strings.Join([]string{chatJID, sender, eventKey, description}, "\x00")))
+	return "system-" + hex.EncodeToString(hash[:16])
+}
+
+// Store system events in the message timeline of a group, making sure the chat exists first
+func storeGroupSystemEvents(client *whatsmeow.Client, messageStore MessageRepository, jid types.JID, name, sender, eventKey string, timestamp time.Time, descriptions []string, logger waLog.Logger) {
+	chatJID := jid.String()
+	if name == "" {
+		name = getChatName(client, messageStore, jid, chatJID, nil, "", logger)
+	}
+	// Group creation times and late notifications can be older than the last message
+	if err := messageStore.advanceChat(chatJID, name, timestamp); err != nil {
+		logger.Warnf("Failed to store chat %s: %v", chatJID, err)
+		return
+	}
+
+	for _, description := range descriptions {
+		id := systemEventID(chatJID, sender, eventKey, description)
+		if err := messageStore.storeSystemEvent(id, chatJID, sender, description, timestamp); err != nil {
+			logger.Warnf("Failed to store system event for %s: %v", chatJID, err)
+		} else {
+			logger.Infof("Stored system event in %s: %s", chatJID, description)
+		}
+	}
+}
+
+// Handle group metadata and membership change events
+func HandleGroupInfo(client *whatsmeow.Client, messageStore *MessageStore, evt *events.GroupInfo, logger waLog.Logger) {
+	groupJID := evt.JID.String()
+	timestamp := evt.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	// If we've never seen this group, fetch the full state first so incremental changes have a base
+	exists, err := messageStore.groupExists(groupJID)
+	if err != nil {
+		logger.Warnf("Failed to check group %s: %v", groupJID, err)
+	} else if !exists {
+		if _, err = refreshGroup(context.Background(), client, messageStore, evt.JID); err != nil {
+			logger.Warnf("Failed to fetch group info for %s: %v", groupJID, err)
+		}
+	}
+
+	err = messageStore.applyGroupChanges(evt, timestamp)
+	if err != nil {
+		logger.Warnf("Failed to apply group changes for %s: %v", groupJID, err)
+	}
+
+	var name, sender string
+	if evt.Name != nil {
+		name = evt.Name.Name
+	}
+	if evt.Sender != nil {
+		sender = evt.Sender.User
+	}
+
+	descriptions := describeGroupChanges(evt)
+	if len(descriptions) == 0 && name == "" {
+		return
+	}
+	eventKey := evt.Notify
+	if !evt.Timestamp.IsZero() {
+		eventKey += "/" + strconv.FormatInt(evt.Timestamp.Unix(), 10)
+	}
+	storeGroupSystemEvents(client, messageStore, evt.JID, name, sender, eventKey, timestamp, descriptions, logger)
+}
+
+// Handle being added to a group or creating one
+func HandleJoinedGroup(client *whatsmeow.Client, messageStore *MessageStore, evt *events.JoinedGroup, logger waLog.Logger) {
+	err := messageStore.storeGroup(&evt.GroupInfo)
+	if err != nil {
+		logger.Warnf("Failed to store joined group %s: %v", evt.JID, err)
+	}
+
+	var sender string
+	if evt.Sender != nil {
+		sender = evt.Sender.User
+	}
+
+	description := "You joined the group"
+	if evt.Type == "new" {
+		if sender != "" {
+			description = fmt.Sprintf("%s created group %q", sender, evt.Name)
+		} else {
+			description = fmt.Sprintf("Group %q was created", evt.Name)
+		}
+	} else if evt.Reason == "invite" {
+		description = "You joined using an invite link"
+	} else if sender != "" {
+		description = fmt.Sprintf("%s added you", sender)
+	}
+
+	timestamp := evt.GroupCreated
+	if evt.Type != "new" || timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	// Joins carry no time of their own, but the participant list version changes with every join
+	eventKey := strings.Join([]string{evt.Type, evt.Reason, evt.CreateKey, evt.ParticipantVersionID, strconv.FormatInt(evt.GroupCreated.Unix(), 10)}, "/")
+	storeGroupSystemEvents(client, messageStore, evt.JID, evt.Name, sender, eventKey, timestamp, []string{description}, logger)
+}
@@ -0,0 +1,325 @@
+package utils
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waHistorySync"
+	"go.mau.fi/whatsmeow/types"
+)
+
+const (
+	// Number of messages requested by a backfill when not specified, as recommended by whatsmeow
+	defaultBackfillCount = 50
+	maxBackfillCount     = 500
+	// Number of sync sessions returned by the status API
+	historySyncStatusLimit = 50
+)
+
+// HistorySyncChunk describes a single history sync event received from the phone
+type HistorySyncChunk struct {
+	SyncType      string
+	ChunkOrder    int
+	Progress      int
+	Conversations int
+	Messages      int
+	ReceivedAt    time.Time
+}
+
+// HistorySyncSession represents the progress of a history sync of one type, which is
+// delivered in one or more chunks
+type HistorySyncSession struct {
+	ID             string     `json:"id"`
+	SyncType       string     `json:"sync_type"`
+	Progress       int        `json:"progress"`
+	ChunksReceived int        `json:"chunks_received"`
+	LastChunkOrder int        `json:"last_chunk_order"`
+	MissingChunks  []int      `json:"missing_chunks"`
+	MessagesStored int        `json:"messages_stored"`
+	StartedAt      time.Time  `json:"started_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+	CompletedAt    *time.Time `json:"completed_at,omitempty"`
+}
+
+// HistorySyncStatusResponse represents the response for the history sync status API
+type HistorySyncStatusResponse struct {
+	InitialSyncComplete bool                 `json:"initial_sync_complete"`
+	Sessions            []HistorySyncSession `json:"sessions"`
+}
+
+// BackfillRequest represents the optional request body for the chat backfill API
+type BackfillRequest struct {
+	Count int `json:"count"`
+}
+
+// BackfillResponse represents the response for the chat backfill API
+type BackfillResponse struct {
+	ChatJID         string    `json:"chat_jid"`
+	Count           int       `json:"count"`
+	OldestMessageID string    `json:"oldest_message_id"`
+	OldestTimestamp time.Time `json:"oldest_timestamp"`
+}
+
+// Whether a chunk finishes its sync session. On-demand syncs answer a single backfill
+// request in one chunk, other syncs are done once the phone reports 100% progress
+func (chunk HistorySyncChunk) completesSession() bool {
+	return chunk.SyncType == waHistorySync.HistorySync_ON_DEMAND.String() || chunk.Progress >= 100
+}
+
+// Get the chunk orders missing from a session, given the chunk orders received in ascending order
+func missingHistorySyncChunks(received []int) []int {
+	missing := []int{}
+	next := 1
+	for _, order := range received {
+		for ; next < order; next++ {
+			missing = append(missing, next)
+		}
+		next = max(next, order+1)
+	}
+	return missing
+}
+
+// Record a history sync chunk in its session. A chunk starts a new session when there's
+// no unfinished session of its type, or when the unfinished one already has a chunk with
+// the same order, which means the phone restarted the sync
+func (store *MessageStore) recordHistorySyncChunk(chunk HistorySyncChunk) error {
+	tx, err := store.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var sessionID string
+	err = tx.QueryRow(
+		`SELECT id FROM history_sync_sessions
+		WHERE sync_type = $1 AND completed_at IS NULL
+		ORDER BY started_at DESC LIMIT 1`,
+		chunk.SyncType,
+	).Scan(&sessionID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if sessionID != "" {
+		var duplicate bool
+		err = tx.QueryRow(
+			"SELECT EXISTS (SELECT 1 FROM history_sync_chunks WHERE session_id = $1 AND chunk_order = $2)",
+			sessionID, chunk.ChunkOrder,
+		).Scan(&duplicate)
+		if err != nil {
+			return err
+		}
+		if duplicate {
+			sessionID = ""
+		}
+	}
+	if sessionID == "" {
+		sessionID = fmt.Sprintf("%s-%d", chunk.SyncType, chunk.ReceivedAt.UnixNano())
+		_, err = tx.Exec(
+			`INSERT INTO history_sync_sessions (id, sync_type, progress, chunks_received, last_chunk_order, messages_stored, started_at, updated_at)
+			VALUES ($1, $2, 0, 0, 0, 0, $3, $3)`,
+			sessionID, chunk.SyncType, chunk.ReceivedAt,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO history_sync_chunks (session_id, chunk_order, progress, conversations, messages, received_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		sessionID, chunk.ChunkOrder, chunk.Progress, chunk.Conversations, chunk.Messages, chunk.ReceivedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	var completedAt *time.Time
+	if chunk.completesSession() {
+		completedAt = &chunk.ReceivedAt
+	}
+	_, err = tx.Exec(
+		`UPDATE history_sync_sessions SET
+			progress = $2,
+			chunks_received = chunks_received + 1,
+			last_chunk_order = $3,
+			messages_stored = messages_stored + $4,
+			updated_at = $5,
+			completed_at = $6
+		WHERE id = $1`,
+		sessionID, chunk.Progress, chunk.ChunkOrder, chunk.Messages, chunk.ReceivedAt, completedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Get the most recent history sync sessions, newest first
+func (store *MessageStore) getHistorySyncSessions(limit int) ([]HistorySyncSession, error) {
+	rows, err := store.Db.Query(
+		`SELECT id, sync_type, progress, chunks_received, last_chunk_order, messages_stored, started_at, updated_at, completed_at
+		FROM history_sync_sessions
+		ORDER BY started_at DESC LIMIT $1`,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []HistorySyncSession{}
+	for rows.Next() {
+		var session HistorySyncSession
+		var completedAt sql.NullTime
+		err = rows.Scan(&session.ID, &session.SyncType, &session.Progress, &session.ChunksReceived, &session.LastChunkOrder,
+			&session.MessagesStored, &session.StartedAt, &session.UpdatedAt, &completedAt)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if completedAt.Valid {
+			session.CompletedAt = &completedAt.Time
+		}
+		sessions = append(sessions, session)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range sessions {
+		received, err := store.getHistorySyncChunkOrders(sessions[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		sessions[i].MissingChunks = missingHistorySyncChunks(received)
+	}
+	return sessions, nil
+}
+
+// Get the chunk orders received for a session, in ascending order
+func (store *MessageStore) getHistorySyncChunkOrders(sessionID string) ([]int, error) {
+	rows, err := store.Db.Query(
+		"SELECT chunk_order FROM history_sync_chunks WHERE session_id = $1 ORDER BY chunk_order",
+		sessionID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []int
+	for rows.Next() {
+		var order int
+		if err = rows.Scan(&order); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, rows.Err()
+}
+
+// Get the oldest message stored for a chat, ignoring system events.
+// Returns sql.ErrNoRows if the chat has no messages
+func (store *MessageStore) getOldestMessage(chatJID string) (StoredMessage, error) {
+	msg := StoredMessage{ChatJID: chatJID}
+	err := store.Db.QueryRow(
+		`SELECT id, timestamp, COALESCE(is_from_me, FALSE) FROM messages
+		WHERE chat_jid = $1 AND is_system = FALSE
+		ORDER BY timestamp ASC LIMIT 1`,
+		chatJID,
+	).Scan(&msg.ID, &msg.Timestamp, &msg.IsFromMe)
+	return msg, err
+}
+
+// Build the history sync status from the stored sessions
+func getHistorySyncStatus(messageStore MessageRepository) (*HistorySyncStatusResponse, error) {
+	sessions, err := messageStore.getHistorySyncSessions(historySyncStatusLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &HistorySyncStatusResponse{Sessions: sessions}
+	for _, session := range sessions {
+		if session.SyncType == waHistorySync.HistorySync_INITIAL_BOOTSTRAP.String() && session.CompletedAt != nil {
+			status.InitialSyncComplete = true
+			break
+		}
+	}
+	return status, nil
+}
+
+func registerHistorySyncRoutes(client *whatsmeow.Client, messageStore MessageRepository) {
+	// Get the progress of the history syncs received from the phone
+	http.HandleFunc("GET /api/history-sync/status", func(w http.ResponseWriter, r *http.Request) {
+		status, err := getHistorySyncStatus(messageStore)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting history sync status: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, status)
+	})
+
+	// Ask the phone for messages older than the oldest one stored for a chat.
+	// The messages arrive later as an on-demand history sync
+	http.HandleFunc("POST /api/chats/{jid}/backfill", func(w http.ResponseWriter, r *http.Request) {
+		if !client.IsConnected() || client.Store.ID == nil {
+			http.Error(w, "Not connected to WhatsApp", http.StatusServiceUnavailable)
+			return
+		}
+
+		chatJID, err := parseRecipientJID(r.PathValue("jid"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		req := BackfillRequest{Count: defaultBackfillCount}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request format", http.StatusBadRequest)
+				return
+			}
+			if req.Count == 0 {
+				req.Count = defaultBackfillCount
+			}
+		}
+		if req.Count < 1 || req.Count > maxBackfillCount {
+			http.Error(w, fmt.Sprintf("Count must be between 1 and %d", maxBackfillCount), http.StatusBadRequest)
+			return
+		}
+
+		oldest, err := messageStore.getOldestMessage(chatJID.String())
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "No stored messages in this chat to backfill from", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting oldest message: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		request := client.BuildHistorySyncRequest(&types.MessageInfo{
+			MessageSource: types.MessageSource{Chat: chatJID, IsFromMe: oldest.IsFromMe},
+			ID:            oldest.ID,
+			Timestamp:     oldest.Timestamp,
+		}, req.Count)
+		_, err = client.SendMessage(r.Context(), client.Store.ID.ToNonAD(), request, whatsmeow.SendRequestExtra{Peer: true})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error requesting history: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusAccepted, BackfillResponse{
+			ChatJID:         chatJID.String(),
+			Count:           req.Count,
+			OldestMessageID: oldest.ID,
+			OldestTimestamp: oldest.Timestamp,
+		})
+	})
+}
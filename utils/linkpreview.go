@@ -0,0 +1,245 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	// Timeout for fetching the page and image of a link preview
+	linkPreviewTimeout = 10 * time.Second
+	// Maximum number of bytes read from the page or image of a link preview
+	linkPreviewMaxBytes = 2 << 20
+	// WhatsApp shows link preview thumbnails small, so there's no point in sending large ones
+	linkPreviewThumbnailSize = 256
+	// Largest image decoded for a thumbnail. A small file can declare huge dimensions, and
+	// decoding allocates memory for every pixel
+	linkPreviewMaxPixels = 16 << 20
+)
+
+// Matches the first http(s) URL in a message
+var urlPattern = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// LinkPreview contains the OpenGraph metadata used to render a link preview
+type LinkPreview struct {
+	URL         string
+	Title       string
+	Description string
+	Thumbnail   []byte
+}
+
+// Client for link preview requests. URLs come from message text, so it only connects to
+// public addresses, including after redirects, and never to this server's own network
+var linkPreviewClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: linkPreviewTimeout,
+			Control: refuseNonPublicAddress,
+		}).DialContext,
+		TLSHandshakeTimeout: linkPreviewTimeout,
+	},
+}
+
+// Refuse connections to loopback, private, link-local and other non-public addresses. It runs
+// on the resolved address of every connection, so hostnames resolving to them are refused too
+func refuseNonPublicAddress(network, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() || ip.IsInterfaceLocalMulticast() {
+		return fmt.Errorf("refusing to connect to non-public address %s", host)
+	}
+	return nil
+}
+
+// Find the first URL in a text message
+func findFirstURL(text string) string {
+	return strings.TrimRight(urlPattern.FindString(text), ".,;:!?)")
+}
+
+// Fetch a URL with the link preview timeout and size limit
+func fetchLinkPreviewResource(ctx context.Context, resourceURL string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, resourceURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	// Some sites only serve OpenGraph tags to known crawlers
+	req.Header.Set("User-Agent", "WhatsApp/2.0 (link preview)")
+
+	resp, err := linkPreviewClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, "", fmt.Errorf("unexpected status %s fetching %s", resp.Status, resourceURL)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, linkPreviewMaxBytes))
+	if err != nil {
+		return nil, "", err
+	}
+	return body, resp.Header.Get("Content-Type"), nil
+}
+
+// Extract OpenGraph (falling back to standard HTML) metadata from a page
+func parseOpenGraph(page []byte) (title, description, imageURL string) {
+	var htmlTitle, metaDescription string
+	tokenizer := html.NewTokenizer(bytes.NewReader(page))
+	inTitle := false
+
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			if title == "" {
+				title = htmlTitle
+			}
+			if description == "" {
+				description = metaDescription
+			}
+			return strings.TrimSpace(title), strings.TrimSpace(description), strings.TrimSpace(imageURL)
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.Data {
+			case "title":
+				inTitle = true
+			case "meta":
+				var key, content string
+				for _, attr := range token.Attr {
+					switch attr.Key {
+					case "property", "name":
+						key = strings.ToLower(attr.Val)
+					case "content":
+						content = attr.Val
+					}
+				}
+				switch key {
+				case "og:title":
+					title = content
+				case "og:description":
+					description = content
+				case "og:image", "og:image:url", "og:image:secure_url":
+					if imageURL == "" {
+						imageURL = content
+					}
+				case "description":
+					metaDescription = content
+				}
+			}
+		case html.TextToken:
+			if inTitle && htmlTitle == "" {
+				htmlTitle = string(tokenizer.Text())
+			}
+		case html.EndTagToken:
+			if tokenizer.Token().Data == "title" {
+				inTitle = false
+			}
+		}
+	}
+}
+
+// Scale an image down so it fits in a square of the given size, using nearest neighbour sampling
+func scaleImage(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= size && height <= size {
+		return src
+	}
+
+	scale := float64(size) / float64(max(width, height))
+	dstWidth := max(1, int(float64(width)*scale))
+	dstHeight := max(1, int(float64(height)*scale))
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		for x := 0; x < dstWidth; x++ {
+			srcX := bounds.Min.X + int(float64(x)/scale)
+			srcY := bounds.Min.Y + int(float64(y)/scale)
+			dst.Set(x, y, src.At(srcX, srcY))
+		}
+	}
+	return dst
+}
+
+// Build a small JPEG thumbnail from image data. Images over linkPreviewMaxPixels are refused
+// before they're decoded
+func makeJPEGThumbnail(data []byte, size int) ([]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %v", err)
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > linkPreviewMaxPixels {
+		return nil, fmt.Errorf("image is too large (%dx%d)", config.Width, config.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, scaleImage(img, size), &jpeg.Options{Quality: 75})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Generate a link preview for a URL from its OpenGraph tags.
+// A missing or broken image doesn't fail the preview, it's just sent without a thumbnail
+func generateLinkPreview(ctx context.Context, pageURL string) (*LinkPreview, error) {
+	ctx, cancel := context.WithTimeout(ctx, linkPreviewTimeout)
+	defer cancel()
+
+	page, contentType, err := fetchLinkPreviewResource(ctx, pageURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %v", pageURL, err)
+	}
+	if contentType != "" && !strings.Contains(contentType, "html") {
+		return nil, fmt.Errorf("%s is not an HTML page (%s)", pageURL, contentType)
+	}
+
+	preview := &LinkPreview{URL: pageURL}
+	var imageURL string
+	preview.Title, preview.Description, imageURL = parseOpenGraph(page)
+	if preview.Title == "" {
+		preview.Title = pageURL
+	}
+
+	if imageURL != "" {
+		// og:image may be relative to the page
+		if base, err := url.Parse(pageURL); err == nil {
+			if ref, err := url.Parse(imageURL); err == nil {
+				imageURL = base.ResolveReference(ref).String()
+			}
+		}
+
+		imageData, _, err := fetchLinkPreviewResource(ctx, imageURL)
+		if err != nil {
+			fmt.Printf("Failed to fetch link preview image %s: %v\n", imageURL, err)
+		} else if preview.Thumbnail, err = makeJPEGThumbnail(imageData, linkPreviewThumbnailSize); err != nil {
+			fmt.Printf("Failed to create link preview thumbnail for %s: %v\n", imageURL, err)
+		}
+	}
+
+	return preview, nil
+}
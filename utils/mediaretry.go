@@ -0,0 +1,345 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waMmsRetry"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+const (
+	// How long to wait for the phone to upload media again after a media retry receipt
+	mediaRetryTimeout = 30 * time.Second
+	// Host serving the media re-uploaded by the phone after a media retry receipt
+	mediaRetryHost = "https://mmg.whatsapp.net"
+)
+
+var (
+	errNoMedia           = errors.New("message has no media")
+	errMediaRetryTimeout = errors.New("timed out waiting for the phone to upload the media again")
+)
+
+// MediaRefreshResponse represents the response for the media refresh API
+type MediaRefreshResponse struct {
+	ID         string `json:"id"`
+	ChatJID    string `json:"chat_jid"`
+	URL        string `json:"url"`
+	DirectPath string `json:"direct_path"`
+}
+
+// Outcome of a media retry, delivered to whoever is waiting for it
+type mediaRetryResult struct {
+	directPath string
+	err        error
+}
+
+type mediaRetryKey struct {
+	id      string
+	chatJID string
+}
+
+// mediaRetryWaiters hands the outcome of media retries to the requests waiting for them
+type mediaRetryWaiters struct {
+	mu      sync.Mutex
+	waiters map[mediaRetryKey][]chan mediaRetryResult
+}
+
+var mediaRetries = &mediaRetryWaiters{waiters: make(map[mediaRetryKey][]chan mediaRetryResult)}
+
+// Start waiting for the outcome of a media retry. The channel must be passed to remove once done
+func (w *mediaRetryWaiters) add(key mediaRetryKey) chan mediaRetryResult {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ch := make(chan mediaRetryResult, 1)
+	w.waiters[key] = append(w.waiters[key], ch)
+	return ch
+}
+
+// Stop waiting for the outcome of a media retry
+func (w *mediaRetryWaiters) remove(key mediaRetryKey, ch chan mediaRetryResult) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	waiters := w.waiters[key]
+	for i, waiter := range waiters {
+		if waiter == ch {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(w.waiters, key)
+	} else {
+		w.waiters[key] = waiters
+	}
+}
+
+// Deliver the outcome of a media retry to everyone waiting for it
+func (w *mediaRetryWaiters) resolve(key mediaRetryKey, result mediaRetryResult) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, ch := range w.waiters[key] {
+		ch <- result
+	}
+	delete(w.waiters, key)
+}
+
+// Get a stored message with everything needed to request its media again
+func (store *MessageStore) getStoredMessage(id, chatJID string) (StoredMessage, error) {
+	return scanStoredMessage(store.Db.QueryRow(
+		"SELECT "+storedMessageSelect+" FROM messages WHERE id = $1 AND chat_jid = $2",
+		id, chatJID,
+	))
+}
+
+// Get the chats that have a message with the given ID
+func (store *MessageStore) getMessageChatJIDs(id string) ([]string, error) {
+	rows, err := store.Db.Query("SELECT chat_jid FROM messages WHERE id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chatJIDs []string
+	for rows.Next() {
+		var chatJID string
+		if err = rows.Scan(&chatJID); err != nil {
+			return nil, err
+		}
+		chatJIDs = append(chatJIDs, chatJID)
+	}
+	return chatJIDs, rows.Err()
+}
+
+// Record that the phone was asked to re-upload the media of a message
+func (store *MessageStore) markMediaRetryRequested(id, chatJID string) error {
+	_, err := store.Db.Exec(
+		"UPDATE messages SET media_retry_requested_at = $3 WHERE id = $1 AND chat_jid = $2",
+		id, chatJID, time.Now(),
+	)
+	return err
+}
+
+// Replace the media location of a message after the phone re-uploaded it, and make it
+// eligible for the S3 backfill again right away
+func (store *MessageStore) updateMediaPath(id, chatJID, directPath string) error {
+	_, err := store.Db.Exec(
+		"UPDATE messages SET direct_path = $3, url = $4, s3_backfill_attempted_at = NULL WHERE id = $1 AND chat_jid = $2",
+		id, chatJID, directPath, mediaRetryHost+directPath,
+	)
+	return err
+}
+
+// Whether a media download failed because the file is no longer on the WhatsApp CDN
+func isMediaExpired(err error) bool {
+	return errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith403) ||
+		errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith404) ||
+		errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith410)
+}
+
+// Get the JID of a stored sender. Senders are stored as a full JID or, for live
+// messages, just the user part of one
+func storedSenderJID(sender string) (types.JID, error) {
+	if strings.Contains(sender, "@") {
+		return types.ParseJID(sender)
+	}
+	return types.NewJID(sender, types.DefaultUserServer), nil
+}
+
+// Ask the phone to upload the media of a message again. The new location arrives
+// later as an events.MediaRetry, see HandleMediaRetry
+func requestMediaRetry(client *whatsmeow.Client, messageStore *MessageStore, msg StoredMessage) error {
+	chatJID, err := types.ParseJID(msg.ChatJID)
+	if err != nil {
+		return err
+	}
+
+	info := &types.MessageInfo{
+		MessageSource: types.MessageSource{
+			Chat:     chatJID,
+			IsFromMe: msg.IsFromMe,
+			IsGroup:  chatJID.Server == types.GroupServer,
+		},
+		ID: msg.ID,
+	}
+	if info.IsGroup {
+		if msg.IsFromMe {
+			info.Sender = client.Store.ID.ToNonAD()
+		} else if info.Sender, err = storedSenderJID(msg.Sender); err != nil {
+			return err
+		}
+	}
+
+	if err = client.SendMediaRetryReceipt(context.Background(), info, msg.MediaKey); err != nil {
+		return err
+	}
+	return messageStore.markMediaRetryRequested(msg.ID, msg.ChatJID)
+}
+
+// Ask the phone to upload the media of a stored message again and wait for its new direct
+// path, which is also stored on the message
+func refreshMediaPath(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, id, chatJID string) (string, error) {
+	msg, err := messageStore.getStoredMessage(id, chatJID)
+	if err != nil {
+		return "", err
+	}
+	if msg.MediaType == "" || len(msg.MediaKey) == 0 {
+		return "", errNoMedia
+	}
+
+	key := mediaRetryKey{id, chatJID}
+	ch := mediaRetries.add(key)
+	defer mediaRetries.remove(key, ch)
+
+	if err = requestMediaRetry(client, messageStore, msg); err != nil {
+		return "", fmt.Errorf("failed to send media retry receipt: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, mediaRetryTimeout)
+	defer cancel()
+	select {
+	case result := <-ch:
+		return result.directPath, result.err
+	case <-ctx.Done():
+		return "", errMediaRetryTimeout
+	}
+}
+
+// Download the media of a stored message. If it's no longer on the CDN, the phone is
+// asked to upload it again and the download is retried from the new URL
+func downloadWhatsAppMediaWithRetry(client *whatsmeow.Client, messageStore *MessageStore, messageID string, chatJID string, media MediaInfo) ([]byte, error) {
+	mediaData, err := downloadWhatsAppMedia(client, messageID, chatJID, media)
+	if !isMediaExpired(err) {
+		return mediaData, err
+	}
+
+	fmt.Printf("Media of message %s has expired, asking the phone to upload it again...\n", messageID)
+	directPath, retryErr := refreshMediaPath(context.Background(), client, messageStore, messageID, chatJID)
+	if retryErr != nil {
+		return nil, fmt.Errorf("%w (media retry failed: %v)", err, retryErr)
+	}
+	media.DirectPath, media.URL = directPath, mediaRetryHost+directPath
+	return downloadWhatsAppMedia(client, messageID, chatJID, media)
+}
+
+// Download the media of a stored message without waiting for a media retry. If it's no
+// longer on the CDN, the phone is asked to upload it again and HandleMediaRetry stores the
+// new location later. For event handlers, which would block the events.MediaRetry otherwise
+func downloadWhatsAppMediaOrRequestRetry(client *whatsmeow.Client, messageStore *MessageStore, msg StoredMessage) ([]byte, error) {
+	mediaData, err := downloadWhatsAppMedia(client, msg.ID, msg.ChatJID, msg.MediaInfo)
+	if !isMediaExpired(err) {
+		return mediaData, err
+	}
+
+	if retryErr := requestMediaRetry(client, messageStore, msg); retryErr != nil {
+		return nil, fmt.Errorf("%w (media retry failed: %v)", err, retryErr)
+	}
+	return nil, fmt.Errorf("%w (asked the phone to upload it again)", err)
+}
+
+// Decrypt the phone's answer to a media retry receipt and store the new direct path
+func applyMediaRetry(messageStore *MessageStore, evt *events.MediaRetry, mediaKey []byte) (string, error) {
+	notification, err := whatsmeow.DecryptMediaRetryNotification(evt, mediaKey)
+	if err != nil {
+		return "", err
+	}
+	if notification.GetResult() != waMmsRetry.MediaRetryNotification_SUCCESS || notification.GetDirectPath() == "" {
+		return "", fmt.Errorf("media retry failed with result %s", notification.GetResult())
+	}
+
+	directPath := notification.GetDirectPath()
+	if err = messageStore.updateMediaPath(evt.MessageID, evt.ChatID.String(), directPath); err != nil {
+		return "", fmt.Errorf("failed to store new media path: %v", err)
+	}
+	return directPath, nil
+}
+
+// Handle the phone's answer to a media retry receipt by storing the new media location
+// and passing it on to anyone waiting for it
+func HandleMediaRetry(messageStore *MessageStore, evt *events.MediaRetry, logger waLog.Logger) {
+	chatJID := evt.ChatID.String()
+	media, err := messageStore.getMediaInfo(evt.MessageID, chatJID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return
+	} else if err != nil {
+		logger.Warnf("Failed to get media info for retried message %s: %v", evt.MessageID, err)
+		return
+	}
+
+	directPath, err := applyMediaRetry(messageStore, evt, media.MediaKey)
+	mediaRetries.resolve(mediaRetryKey{evt.MessageID, chatJID}, mediaRetryResult{directPath: directPath, err: err})
+	if err != nil {
+		logger.Warnf("Media retry for message %s failed: %v", evt.MessageID, err)
+		return
+	}
+	logger.Infof("Media of message %s was re-uploaded by the phone", evt.MessageID)
+}
+
+func registerMediaRoutes(client *whatsmeow.Client, messageStore *MessageStore) {
+	// Ask the phone to upload expired media again and store the new URL, e.g.
+	// /api/messages/{id}/media/refresh?chat=...; the chat is only needed if the ID exists in several chats
+	http.HandleFunc("POST /api/messages/{id}/media/refresh", func(w http.ResponseWriter, r *http.Request) {
+		if !client.IsConnected() || client.Store.ID == nil {
+			http.Error(w, "Not connected to WhatsApp", http.StatusServiceUnavailable)
+			return
+		}
+
+		id := r.PathValue("id")
+		chatJID := r.URL.Query().Get("chat")
+		if chatJID != "" {
+			jid, err := parseRecipientJID(chatJID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			chatJID = jid.String()
+		} else {
+			chatJIDs, err := messageStore.getMessageChatJIDs(id)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error getting message: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if len(chatJIDs) > 1 {
+				http.Error(w, "Message ID exists in several chats, specify the chat", http.StatusConflict)
+				return
+			} else if len(chatJIDs) == 1 {
+				chatJID = chatJIDs[0]
+			}
+		}
+
+		directPath, err := refreshMediaPath(r.Context(), client, messageStore, id, chatJID)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return
+		case errors.Is(err, errNoMedia):
+			http.Error(w, "Message has no media", http.StatusBadRequest)
+			return
+		case errors.Is(err, whatsmeow.ErrMediaNotAvailableOnPhone):
+			http.Error(w, "Media is no longer available on the phone", http.StatusGone)
+			return
+		case errors.Is(err, errMediaRetryTimeout):
+			http.Error(w, "Timed out waiting for the phone to upload the media", http.StatusGatewayTimeout)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("Error refreshing media: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, MediaRefreshResponse{
+			ID:         id,
+			ChatJID:    chatJID,
+			URL:        mediaRetryHost + directPath,
+			DirectPath: directPath,
+		})
+	})
+}
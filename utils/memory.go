@@ -0,0 +1,492 @@
+package utils
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// MemoryMessageStore is a MessageRepository that keeps everything in memory.
+// Nothing survives a restart, so it's meant for tests and throwaway local runs
+type MemoryMessageStore struct {
+	mu       sync.RWMutex
+	chats    map[string]memoryChat
+	messages map[memoryMessageKey]StoredMessage
+	contacts map[string]ContactResponse
+	// Sorted tags of each contact
+	contactTags     map[string][]string
+	recipientChecks map[string]memoryRecipientCheck
+	// Sync sessions in the order they started, with the chunk orders received for each
+	historySyncs      []HistorySyncSession
+	historySyncChunks map[string][]int
+}
+
+type memoryChat struct {
+	name            string
+	lastMessageTime time.Time
+	metadata        ChatMetadata
+}
+
+type memoryMessageKey struct {
+	id      string
+	chatJID string
+}
+
+type memoryRecipientCheck struct {
+	jid          string
+	isOnWhatsApp bool
+	checkedAt    time.Time
+}
+
+var _ MessageRepository = (*MemoryMessageStore)(nil)
+
+// Create an empty in-memory message store
+func NewMemoryMessageStore() *MemoryMessageStore {
+	return &MemoryMessageStore{
+		chats:    make(map[string]memoryChat),
+		messages: make(map[memoryMessageKey]StoredMessage),
+		contacts: make(map[string]ContactResponse),
+
+		contactTags:     make(map[string][]string),
+		recipientChecks: make(map[string]memoryRecipientCheck),
+
+		historySyncChunks: make(map[string][]int),
+	}
+}
+
+// Store a chat
+func (store *MemoryMessageStore) storeChat(jid, name string, lastMessageTime time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	chat := store.chats[jid]
+	chat.name, chat.lastMessageTime = name, lastMessageTime
+	store.chats[jid] = chat
+	return nil
+}
+
+// Store a chat, only moving its last message time forward
+func (store *MemoryMessageStore) advanceChat(jid, name string, lastMessageTime time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	chat := store.chats[jid]
+	chat.name = name
+	if lastMessageTime.After(chat.lastMessageTime) {
+		chat.lastMessageTime = lastMessageTime
+	}
+	store.chats[jid] = chat
+	return nil
+}
+
+// Get the name stored for a chat, or an empty string if the chat isn't known
+func (store *MemoryMessageStore) getStoredChatName(jid string) (string, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return store.chats[jid].name, nil
+}
+
+// Update the metadata of a chat, creating the chat if needed
+func (store *MemoryMessageStore) updateChatMetadata(jid string, update func(metadata *ChatMetadata)) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	chat := store.chats[jid]
+	update(&chat.metadata)
+	store.chats[jid] = chat
+}
+
+// Store the metadata of a conversation, see MessageStore.storeChatMetadata
+func (store *MemoryMessageStore) storeChatMetadata(jid string, metadata ChatMetadata) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	chat := store.chats[jid]
+	if metadata.Name != "" {
+		chat.name = metadata.Name
+	}
+	if !metadata.IncludesState {
+		metadata.UnreadCount, metadata.MarkedUnread = chat.metadata.UnreadCount, chat.metadata.MarkedUnread
+		metadata.Archived, metadata.PinnedAt = chat.metadata.Archived, chat.metadata.PinnedAt
+		metadata.Muted, metadata.MutedUntil = chat.metadata.Muted, chat.metadata.MutedUntil
+	}
+	if len(metadata.Participants) == 0 {
+		metadata.Participants = chat.metadata.Participants
+	}
+	metadata.Participants = slices.Clone(metadata.Participants)
+	chat.metadata = metadata
+	store.chats[jid] = chat
+	return nil
+}
+
+// Set whether a chat is archived
+func (store *MemoryMessageStore) setChatArchived(jid string, archived bool) error {
+	store.updateChatMetadata(jid, func(metadata *ChatMetadata) {
+		metadata.Archived = archived
+	})
+	return nil
+}
+
+// Set when a chat was pinned, or nil to unpin it
+func (store *MemoryMessageStore) setChatPinned(jid string, pinnedAt *time.Time) error {
+	store.updateChatMetadata(jid, func(metadata *ChatMetadata) {
+		metadata.PinnedAt = pinnedAt
+	})
+	return nil
+}
+
+// Set the mute state of a chat
+func (store *MemoryMessageStore) setChatMuted(jid string, muted bool, mutedUntil *time.Time) error {
+	store.updateChatMetadata(jid, func(metadata *ChatMetadata) {
+		metadata.Muted, metadata.MutedUntil = muted, mutedUntil
+	})
+	return nil
+}
+
+// Mark a chat as read, which clears its unread count, or as unread
+func (store *MemoryMessageStore) setChatRead(jid string, read bool) error {
+	store.updateChatMetadata(jid, func(metadata *ChatMetadata) {
+		if read {
+			metadata.UnreadCount, metadata.MarkedUnread = 0, false
+		} else {
+			metadata.MarkedUnread = true
+		}
+	})
+	return nil
+}
+
+// Store a message
+func (store *MemoryMessageStore) storeMessage(msg StoredMessage) error {
+	return store.storeMessages([]StoredMessage{msg})
+}
+
+// Store many messages at once
+func (store *MemoryMessageStore) storeMessages(messages []StoredMessage) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for _, msg := range uniqueStorableMessages(messages) {
+		store.messages[memoryMessageKey{msg.ID, msg.ChatJID}] = msg
+	}
+	return nil
+}
+
+// Store a system event, unless a message with the same ID already exists
+func (store *MemoryMessageStore) storeSystemEvent(id, chatJID, sender, content string, timestamp time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	key := memoryMessageKey{id, chatJID}
+	if _, ok := store.messages[key]; !ok {
+		store.messages[key] = StoredMessage{ID: id, ChatJID: chatJID, Sender: sender, Content: content, Timestamp: timestamp, IsSystem: true}
+	}
+	return nil
+}
+
+// Get a stored message
+func (store *MemoryMessageStore) getStoredMessage(id, chatJID string) (StoredMessage, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	msg, ok := store.messages[memoryMessageKey{id, chatJID}]
+	if !ok {
+		return StoredMessage{}, sql.ErrNoRows
+	}
+	return msg, nil
+}
+
+// Get the oldest message stored for a chat, ignoring system events
+func (store *MemoryMessageStore) getOldestMessage(chatJID string) (StoredMessage, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	var oldest *StoredMessage
+	for _, msg := range store.messages {
+		if msg.ChatJID != chatJID || msg.IsSystem {
+			continue
+		}
+		if oldest == nil || msg.Timestamp.Before(oldest.Timestamp) {
+			oldest = &msg
+		}
+	}
+	if oldest == nil {
+		return StoredMessage{}, sql.ErrNoRows
+	}
+	return *oldest, nil
+}
+
+// Search message content for all the words of the query, newest first. Matches aren't
+// ranked or highlighted, the snippet is the whole content
+func (store *MemoryMessageStore) searchMessages(req SearchMessagesRequest) (*SearchResponse, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	// Whether a sorts before b in the newest first order of the results
+	before := func(a, b searchCursor) bool {
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.After(b.Timestamp)
+		}
+		if a.ChatJID != b.ChatJID {
+			return a.ChatJID > b.ChatJID
+		}
+		return a.ID > b.ID
+	}
+
+	words := strings.Fields(strings.ToLower(req.Query))
+	var matches []StoredMessage
+	for _, msg := range store.messages {
+		content := strings.ToLower(msg.Content)
+		matched := len(words) > 0
+		for _, word := range words {
+			if !strings.Contains(content, word) {
+				matched = false
+				break
+			}
+		}
+		switch {
+		case !matched,
+			req.ChatJID != "" && msg.ChatJID != req.ChatJID,
+			req.Sender != "" && msg.Sender != req.Sender,
+			req.MediaType != "" && msg.MediaType != req.MediaType,
+			!req.From.IsZero() && msg.Timestamp.Before(req.From),
+			!req.To.IsZero() && !msg.Timestamp.Before(req.To),
+			req.Cursor != nil && !before(*req.Cursor, searchCursor{msg.Timestamp, msg.ChatJID, msg.ID}):
+			continue
+		}
+		matches = append(matches, msg)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return before(
+			searchCursor{matches[i].Timestamp, matches[i].ChatJID, matches[i].ID},
+			searchCursor{matches[j].Timestamp, matches[j].ChatJID, matches[j].ID},
+		)
+	})
+
+	response := &SearchResponse{Results: []SearchResult{}}
+	for _, msg := range matches[:min(req.Limit, len(matches))] {
+		response.Results = append(response.Results, SearchResult{
+			ID: msg.ID, ChatJID: msg.ChatJID, ChatName: store.chats[msg.ChatJID].name, Sender: msg.Sender,
+			Content: msg.Content, Snippet: msg.Content, Timestamp: msg.Timestamp, IsFromMe: msg.IsFromMe,
+			MediaType: msg.MediaType,
+		})
+	}
+	if len(matches) > req.Limit {
+		last := response.Results[len(response.Results)-1]
+		response.NextCursor = searchCursor{Timestamp: last.Timestamp, ChatJID: last.ChatJID, ID: last.ID}.encode()
+	}
+	return response, nil
+}
+
+// Get media info of a message
+func (store *MemoryMessageStore) getMediaInfo(id, chatJID string) (MediaInfo, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	msg, ok := store.messages[memoryMessageKey{id, chatJID}]
+	if !ok {
+		return MediaInfo{}, sql.ErrNoRows
+	}
+	return msg.MediaInfo, nil
+}
+
+// Update a contact, creating it if needed. Phone numbers are only ever filled in, never cleared
+func (store *MemoryMessageStore) updateContact(jid types.JID, update func(contact *ContactResponse)) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	contact, ok := store.contacts[jid.String()]
+	if !ok {
+		contact = ContactResponse{JID: jid.String()}
+	}
+	if phoneNumber := jidPhoneNumber(jid); phoneNumber != "" {
+		contact.PhoneNumber = phoneNumber
+	}
+	update(&contact)
+	contact.UpdatedAt = time.Now()
+	store.contacts[jid.String()] = contact
+}
+
+// Store the push name of a contact
+func (store *MemoryMessageStore) storeContactPushName(jid types.JID, pushName string) error {
+	store.updateContact(jid, func(contact *ContactResponse) {
+		contact.PushName = pushName
+	})
+	return nil
+}
+
+// Store the verified business name of a contact
+func (store *MemoryMessageStore) storeContactBusinessName(jid types.JID, businessName string) error {
+	store.updateContact(jid, func(contact *ContactResponse) {
+		contact.BusinessName = businessName
+	})
+	return nil
+}
+
+// Store the address book details of a contact
+func (store *MemoryMessageStore) storeContactDetails(jid types.JID, phoneNumber, lid, fullName, firstName string, timestamp time.Time) error {
+	store.updateContact(jid, func(contact *ContactResponse) {
+		if phoneNumber != "" {
+			contact.PhoneNumber = phoneNumber
+		}
+		if lid != "" {
+			contact.LID = lid
+		}
+		contact.FullName = fullName
+		contact.FirstName = firstName
+	})
+	return nil
+}
+
+// Get the best known name for a contact, or an empty string if there is none
+func (store *MemoryMessageStore) getContactName(jid string) string {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	contact := store.contacts[jid]
+	for _, name := range []string{contact.FullName, contact.BusinessName, contact.PushName} {
+		if name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// Search contacts by JID or any of their names
+func (store *MemoryMessageStore) searchContacts(query string, limit, offset int) ([]ContactResponse, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	query = strings.ToLower(query)
+	sortName := func(contact ContactResponse) string {
+		for _, name := range []string{contact.FullName, contact.PushName} {
+			if name != "" {
+				return name
+			}
+		}
+		return contact.JID
+	}
+
+	contacts := []ContactResponse{}
+	for _, contact := range store.contacts {
+		for _, field := range []string{contact.JID, contact.FullName, contact.FirstName, contact.PushName, contact.BusinessName} {
+			if strings.Contains(strings.ToLower(field), query) {
+				contacts = append(contacts, contact)
+				break
+			}
+		}
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		return sortName(contacts[i]) < sortName(contacts[j])
+	})
+
+	if offset >= len(contacts) {
+		return []ContactResponse{}, nil
+	}
+	return contacts[offset:min(offset+limit, len(contacts))], nil
+}
+
+// Replace the tags of a contact
+func (store *MemoryMessageStore) setContactTags(jid string, tags []string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	tags = slices.Clone(tags)
+	slices.Sort(tags)
+	if tags = slices.Compact(tags); len(tags) == 0 {
+		delete(store.contactTags, jid)
+	} else {
+		store.contactTags[jid] = tags
+	}
+	return nil
+}
+
+// Get the tags of a contact, sorted
+func (store *MemoryMessageStore) getContactTags(jid string) ([]string, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return append([]string{}, store.contactTags[jid]...), nil
+}
+
+// Get the JIDs of the contacts with a tag, sorted
+func (store *MemoryMessageStore) getTaggedContacts(tag string) ([]string, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	jids := []string{}
+	for jid, tags := range store.contactTags {
+		if slices.Contains(tags, tag) {
+			jids = append(jids, jid)
+		}
+	}
+	slices.Sort(jids)
+	return jids, nil
+}
+
+// Get a cached IsOnWhatsApp result for a phone number, if it's still fresh
+func (store *MemoryMessageStore) getRecipientCheck(phoneNumber string, maxAge time.Duration) (string, bool, bool, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	check, ok := store.recipientChecks[phoneNumber]
+	if !ok || time.Since(check.checkedAt) > maxAge {
+		return "", false, false, nil
+	}
+	return check.jid, check.isOnWhatsApp, true, nil
+}
+
+// Store an IsOnWhatsApp result for a phone number
+func (store *MemoryMessageStore) storeRecipientCheck(phoneNumber, jid string, isOnWhatsApp bool) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.recipientChecks[phoneNumber] = memoryRecipientCheck{jid: jid, isOnWhatsApp: isOnWhatsApp, checkedAt: time.Now()}
+	return nil
+}
+
+// Record a history sync chunk in its session, see MessageStore.recordHistorySyncChunk
+func (store *MemoryMessageStore) recordHistorySyncChunk(chunk HistorySyncChunk) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var session *HistorySyncSession
+	for i := len(store.historySyncs) - 1; i >= 0; i-- {
+		if store.historySyncs[i].SyncType == chunk.SyncType && store.historySyncs[i].CompletedAt == nil {
+			if !slices.Contains(store.historySyncChunks[store.historySyncs[i].ID], chunk.ChunkOrder) {
+				session = &store.historySyncs[i]
+			}
+			break
+		}
+	}
+	if session == nil {
+		store.historySyncs = append(store.historySyncs, HistorySyncSession{
+			ID:        fmt.Sprintf("%s-%d", chunk.SyncType, chunk.ReceivedAt.UnixNano()),
+			SyncType:  chunk.SyncType,
+			StartedAt: chunk.ReceivedAt,
+		})
+		session = &store.historySyncs[len(store.historySyncs)-1]
+	}
+
+	session.Progress = chunk.Progress
+	session.ChunksReceived++
+	session.LastChunkOrder = chunk.ChunkOrder
+	session.MessagesStored += chunk.Messages
+	session.UpdatedAt = chunk.ReceivedAt
+	if chunk.completesSession() {
+		completedAt := chunk.ReceivedAt
+		session.CompletedAt = &completedAt
+	}
+	store.historySyncChunks[session.ID] = append(store.historySyncChunks[session.ID], chunk.ChunkOrder)
+	return nil
+}
+
+// Get the most recent history sync sessions, newest first
+func (store *MemoryMessageStore) getHistorySyncSessions(limit int) ([]HistorySyncSession, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	sessions := []HistorySyncSession{}
+	for i := len(store.historySyncs) - 1; i >= 0 && len(sessions) < limit; i-- {
+		session := store.historySyncs[i]
+		received := slices.Clone(store.historySyncChunks[session.ID])
+		slices.Sort(received)
+		session.MissingChunks = missingHistorySyncChunks(received)
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// Close the store. There's nothing to release
+func (store *MemoryMessageStore) Close() error {
+	return nil
+}
@@ -2,32 +2,47 @@ package utils
 
 import (
 	"fmt"
-	"strings"
+	"net/url"
 	"time"
 
 	"go.mau.fi/whatsmeow"
 	waProto "go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
 	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
 )
 
-// Extract direct path from a WhatsApp media URL
-func extractDirectPathFromURL(url string) string {
-	// The direct path is typically in the URL, we need to extract it
+// Extract the direct path from a WhatsApp media URL. Only used for messages stored
+// before direct paths were kept, as the path of the URL is the direct path on the CDN
+func extractDirectPathFromURL(mediaURL string) string {
 	// Example URL: https://mmg.whatsapp.net/v/t62.7118-24/13812002_698058036224062_3424455886509161511_n.enc?ccb=11-4&oh=...
-
-	// Find the path part after the domain
-	parts := strings.SplitN(url, ".net/", 2)
-	if len(parts) < 2 {
-		return url // Return original URL if parsing fails
+	parsed, err := url.Parse(mediaURL)
+	if err != nil || parsed.Path == "" {
+		return mediaURL // Return original URL if parsing fails
 	}
+	return parsed.EscapedPath()
+}
 
-	pathPart := parts[1]
-
-	// Remove query parameters
-	pathPart = strings.SplitN(pathPart, "?", 2)[0]
-
-	// Create proper direct path format
-	return "/" + pathPart
+// MediaInfo describes the media attached to a message
+type MediaInfo struct {
+	MediaType     string
+	Filename      string
+	URL           string
+	DirectPath    string
+	MediaKey      []byte
+	FileSHA256    []byte
+	FileEncSHA256 []byte
+	FileLength    uint64
+	MimeType      string
+	Caption       string
+	Width         uint32
+	Height        uint32
+	// Duration of audio and video, in seconds
+	Seconds       uint32
+	JPEGThumbnail []byte
+	// Whether audio is a voice note and a sticker is animated
+	PTT        bool
+	IsAnimated bool
 }
 
 // MediaDownloader implements the whatsmeow.DownloadableMessage interface
@@ -77,27 +92,56 @@ func (d *MediaDownloader) GetMediaType() whatsmeow.MediaType {
 }
 
 // Extract media info from a message
-func extractMediaInfo(msg *waProto.Message) (mediaType string, filename string, url string, mediaKey []byte, fileSHA256 []byte, fileEncSHA256 []byte, fileLength uint64) {
+func extractMediaInfo(msg *waProto.Message) MediaInfo {
 	if msg == nil {
-		return "", "", "", nil, nil, nil, 0
+		return MediaInfo{}
 	}
 
 	// Check for image message
 	if img := msg.GetImageMessage(); img != nil {
-		return "image", time.Now().Format("20060102_150405") + ".jpg",
-			img.GetURL(), img.GetMediaKey(), img.GetFileSHA256(), img.GetFileEncSHA256(), img.GetFileLength()
+		return MediaInfo{
+			MediaType: "image", Filename: time.Now().Format("20060102_150405") + ".jpg",
+			URL: img.GetURL(), DirectPath: img.GetDirectPath(), MediaKey: img.GetMediaKey(),
+			FileSHA256: img.GetFileSHA256(), FileEncSHA256: img.GetFileEncSHA256(), FileLength: img.GetFileLength(),
+			MimeType: img.GetMimetype(), Caption: img.GetCaption(), Width: img.GetWidth(), Height: img.GetHeight(),
+			JPEGThumbnail: img.GetJPEGThumbnail(),
+		}
 	}
 
 	// Check for video message
 	if vid := msg.GetVideoMessage(); vid != nil {
-		return "video", time.Now().Format("20060102_150405") + ".mp4",
-			vid.GetURL(), vid.GetMediaKey(), vid.GetFileSHA256(), vid.GetFileEncSHA256(), vid.GetFileLength()
+		return MediaInfo{
+			MediaType: "video", Filename: time.Now().Format("20060102_150405") + ".mp4",
+			URL: vid.GetURL(), DirectPath: vid.GetDirectPath(), MediaKey: vid.GetMediaKey(),
+			FileSHA256: vid.GetFileSHA256(), FileEncSHA256: vid.GetFileEncSHA256(), FileLength: vid.GetFileLength(),
+			MimeType: vid.GetMimetype(), Caption: vid.GetCaption(), Width: vid.GetWidth(), Height: vid.GetHeight(),
+			Seconds: vid.GetSeconds(), JPEGThumbnail: vid.GetJPEGThumbnail(),
+		}
 	}
 
 	// Check for audio message
 	if aud := msg.GetAudioMessage(); aud != nil {
-		return "audio", time.Now().Format("20060102_150405") + ".ogg",
-			aud.GetURL(), aud.GetMediaKey(), aud.GetFileSHA256(), aud.GetFileEncSHA256(), aud.GetFileLength()
+		return MediaInfo{
+			MediaType: "audio", Filename: time.Now().Format("20060102_150405") + ".ogg",
+			URL: aud.GetURL(), DirectPath: aud.GetDirectPath(), MediaKey: aud.GetMediaKey(),
+			FileSHA256: aud.GetFileSHA256(), FileEncSHA256: aud.GetFileEncSHA256(), FileLength: aud.GetFileLength(),
+			MimeType: aud.GetMimetype(), Seconds: aud.GetSeconds(), PTT: aud.GetPTT(),
+		}
+	}
+
+	// Check for sticker message, animated stickers are WebP files too
+	if sticker := msg.GetStickerMessage(); sticker != nil {
+		suffix := ".webp"
+		if sticker.GetIsAnimated() {
+			suffix = "_animated.webp"
+		}
+		return MediaInfo{
+			MediaType: "sticker", Filename: time.Now().Format("20060102_150405") + suffix,
+			URL: sticker.GetURL(), DirectPath: sticker.GetDirectPath(), MediaKey: sticker.GetMediaKey(),
+			FileSHA256: sticker.GetFileSHA256(), FileEncSHA256: sticker.GetFileEncSHA256(), FileLength: sticker.GetFileLength(),
+			MimeType: sticker.GetMimetype(), Width: sticker.GetWidth(), Height: sticker.GetHeight(),
+			IsAnimated: sticker.GetIsAnimated(),
+		}
 	}
 
 	// Check for document message
@@ -106,11 +150,15 @@ func extractMediaInfo(msg *waProto.Message) (mediaType string, filename string,
 		if filename == "" {
 			filename = time.Now().Format("20060102_150405")
 		}
-		return "document", filename,
-			doc.GetURL(), doc.GetMediaKey(), doc.GetFileSHA256(), doc.GetFileEncSHA256(), doc.GetFileLength()
+		return MediaInfo{
+			MediaType: "document", Filename: filename,
+			URL: doc.GetURL(), DirectPath: doc.GetDirectPath(), MediaKey: doc.GetMediaKey(),
+			FileSHA256: doc.GetFileSHA256(), FileEncSHA256: doc.GetFileEncSHA256(), FileLength: doc.GetFileLength(),
+			MimeType: doc.GetMimetype(), Caption: doc.GetCaption(), JPEGThumbnail: doc.GetJPEGThumbnail(),
+		}
 	}
 
-	return "", "", "", nil, nil, nil, 0
+	return MediaInfo{}
 }
 
 // Extract text content from a message
@@ -126,23 +174,109 @@ func extractTextContent(msg *waProto.Message) (content string) {
 		return extendedText.GetText()
 	}
 
-	// For now, we're ignoring non-text messages
-	return ""
+	// The text of image, video and document messages is their caption
+	return extractMediaInfo(msg).Caption
+}
+
+// Extract the context info of a message, which holds what it replies to, mentions and
+// whether it was forwarded
+func extractContextInfo(msg *waProto.Message) *waProto.ContextInfo {
+	if msg == nil {
+		return nil
+	}
+
+	switch {
+	case msg.GetExtendedTextMessage() != nil:
+		return msg.GetExtendedTextMessage().GetContextInfo()
+	case msg.GetImageMessage() != nil:
+		return msg.GetImageMessage().GetContextInfo()
+	case msg.GetVideoMessage() != nil:
+		return msg.GetVideoMessage().GetContextInfo()
+	case msg.GetAudioMessage() != nil:
+		return msg.GetAudioMessage().GetContextInfo()
+	case msg.GetDocumentMessage() != nil:
+		return msg.GetDocumentMessage().GetContextInfo()
+	case msg.GetStickerMessage() != nil:
+		return msg.GetStickerMessage().GetContextInfo()
+	}
+	return nil
+}
+
+// Attach context info, such as a quoted message, to an outgoing message. Plain text is
+// turned into extended text, the text message that can carry it
+func setMessageContextInfo(msg *waProto.Message, contextInfo *waProto.ContextInfo) {
+	switch {
+	case msg.Conversation != nil:
+		msg.ExtendedTextMessage = &waProto.ExtendedTextMessage{Text: msg.Conversation, ContextInfo: contextInfo}
+		msg.Conversation = nil
+	case msg.ExtendedTextMessage != nil:
+		msg.ExtendedTextMessage.ContextInfo = contextInfo
+	case msg.ImageMessage != nil:
+		msg.ImageMessage.ContextInfo = contextInfo
+	case msg.VideoMessage != nil:
+		msg.VideoMessage.ContextInfo = contextInfo
+	case msg.AudioMessage != nil:
+		msg.AudioMessage.ContextInfo = contextInfo
+	case msg.DocumentMessage != nil:
+		msg.DocumentMessage.ContextInfo = contextInfo
+	case msg.StickerMessage != nil:
+		msg.StickerMessage.ContextInfo = contextInfo
+	case msg.LocationMessage != nil:
+		msg.LocationMessage.ContextInfo = contextInfo
+	case msg.ContactMessage != nil:
+		msg.ContactMessage.ContextInfo = contextInfo
+	case msg.ContactsArrayMessage != nil:
+		msg.ContactsArrayMessage.ContextInfo = contextInfo
+	}
+}
+
+// Build a copy of a message to forward it to another chat. The copy is marked as forwarded
+// and keeps the media references of the original, so media isn't uploaded again
+func buildForwardMessage(msg *waProto.Message) *waProto.Message {
+	forward := proto.Clone(msg).(*waProto.Message)
+	forward.MessageContextInfo = nil
+	setMessageContextInfo(forward, &waProto.ContextInfo{
+		IsForwarded:     proto.Bool(true),
+		ForwardingScore: proto.Uint32(extractContextInfo(msg).GetForwardingScore() + 1),
+	})
+	return forward
+}
+
+// Build the context info quoting a message of a chat. Messages that aren't stored are
+// still quoted by ID, but without their sender and text
+func buildReplyContext(client *whatsmeow.Client, messageStore *MessageStore, chatJID types.JID, messageID string) *waProto.ContextInfo {
+	contextInfo := &waProto.ContextInfo{StanzaID: proto.String(messageID)}
+	quoted, err := messageStore.getStoredMessage(messageID, chatJID.String())
+	if err != nil {
+		return contextInfo
+	}
+
+	participant := client.Store.ID.ToNonAD()
+	if !quoted.IsFromMe {
+		if participant, err = storedSenderJID(quoted.Sender); err != nil {
+			return contextInfo
+		}
+	}
+	contextInfo.Participant = proto.String(participant.String())
+	if quoted.Content != "" {
+		contextInfo.QuotedMessage = &waProto.Message{Conversation: proto.String(quoted.Content)}
+	}
+	return contextInfo
 }
 
-func extractMessageContent(msg *waProto.Message) (content string, mediaType string, filename string, url string, mediaKey []byte, fileSHA256 []byte, fileEncSHA256 []byte, fileLength uint64) {
+func extractMessageContent(msg *waProto.Message) (content string, media MediaInfo) {
 	// Extract text content
 	content = extractTextContent(msg)
 
 	// Extract media info
-	mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength = extractMediaInfo(msg)
+	media = extractMediaInfo(msg)
 
 	// Generate a default filename for text messages
-	if filename == "" && content != "" {
-		filename = time.Now().Format("20060102_150405") + ".txt"
+	if media.Filename == "" && content != "" {
+		media.Filename = time.Now().Format("20060102_150405") + ".txt"
 	}
 
-	return content, mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength
+	return content, media
 }
 
 // Log message reception details
@@ -0,0 +1,400 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Key of the Postgres advisory lock held while migrating, so that instances starting
+// at the same time don't apply the same migration twice
+const migrationLockKey = 727165417
+
+// Tables created by the first migration. Columns added to them after their first release
+// are added by ALTER statements, so databases created back then get them too
+const initialTables = `
+		CREATE TABLE IF NOT EXISTS chats (
+			jid TEXT PRIMARY KEY,
+			name TEXT,
+			last_message_time TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS messages (
+			id TEXT,
+			chat_jid TEXT,
+			sender TEXT,
+			content TEXT,
+			timestamp TIMESTAMP,
+			is_from_me BOOLEAN,
+			media_type TEXT,
+			filename TEXT,
+			url TEXT,
+			media_key BYTEA,
+			file_sha256 BYTEA,
+			file_enc_sha256 BYTEA,
+			file_length INTEGER,
+			PRIMARY KEY (id, chat_jid),
+			FOREIGN KEY (chat_jid) REFERENCES chats(jid)
+		);
+
+		CREATE TABLE IF NOT EXISTS groups (
+			jid TEXT PRIMARY KEY,
+			name TEXT,
+			topic TEXT,
+			owner_jid TEXT,
+			is_locked BOOLEAN,
+			is_announce BOOLEAN,
+			is_ephemeral BOOLEAN,
+			disappearing_timer INTEGER,
+			created_at TIMESTAMP,
+			updated_at TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS group_participants (
+			group_jid TEXT,
+			participant_jid TEXT,
+			phone_number TEXT,
+			role TEXT,
+			PRIMARY KEY (group_jid, participant_jid),
+			FOREIGN KEY (group_jid) REFERENCES groups(jid)
+		);
+
+		CREATE TABLE IF NOT EXISTS contacts (
+			jid TEXT PRIMARY KEY,
+			phone_number TEXT,
+			lid TEXT,
+			full_name TEXT,
+			first_name TEXT,
+			push_name TEXT,
+			business_name TEXT,
+			updated_at TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS recipient_checks (
+			phone_number TEXT PRIMARY KEY,
+			jid TEXT,
+			is_on_whatsapp BOOLEAN,
+			checked_at TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS polls (
+			id TEXT,
+			chat_jid TEXT,
+			creator TEXT,
+			name TEXT,
+			selectable_count INTEGER,
+			message_secret BYTEA,
+			created_at TIMESTAMP,
+			PRIMARY KEY (id, chat_jid)
+		);
+
+		CREATE TABLE IF NOT EXISTS poll_options (
+			poll_id TEXT,
+			chat_jid TEXT,
+			option_index INTEGER,
+			option_name TEXT,
+			option_hash BYTEA,
+			PRIMARY KEY (poll_id, chat_jid, option_index),
+			FOREIGN KEY (poll_id, chat_jid) REFERENCES polls(id, chat_jid)
+		);
+
+		CREATE TABLE IF NOT EXISTS poll_votes (
+			poll_id TEXT,
+			chat_jid TEXT,
+			voter_jid TEXT,
+			option_hash BYTEA,
+			voted_at TIMESTAMP,
+			PRIMARY KEY (poll_id, chat_jid, voter_jid, option_hash)
+		);
+`
+
+// Indexes for the chat timeline, sender and date range lookups
+const timelineIndexes = `
+	CREATE INDEX IF NOT EXISTS messages_chat_timestamp_idx ON messages (chat_jid, timestamp);
+	CREATE INDEX IF NOT EXISTS messages_timestamp_idx ON messages (timestamp);
+	CREATE INDEX IF NOT EXISTS messages_sender_idx ON messages (sender);
+	CREATE INDEX IF NOT EXISTS chats_last_message_time_idx ON chats (last_message_time);
+`
+
+// Media details kept so downloads don't depend on parsing URLs, and for showing captions and thumbnails
+const mediaMetadataColumns = `
+	ALTER TABLE messages ADD COLUMN direct_path TEXT;
+	ALTER TABLE messages ADD COLUMN mimetype TEXT;
+	ALTER TABLE messages ADD COLUMN caption TEXT;
+	ALTER TABLE messages ADD COLUMN width INTEGER;
+	ALTER TABLE messages ADD COLUMN height INTEGER;
+	ALTER TABLE messages ADD COLUMN seconds INTEGER;
+	ALTER TABLE messages ADD COLUMN jpeg_thumbnail BYTEA;
+`
+
+// Whether audio messages are voice notes and stickers are animated, needed to send them again as they were
+const mediaFlagColumns = `
+	ALTER TABLE messages ADD COLUMN ptt BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE messages ADD COLUMN is_animated BOOLEAN NOT NULL DEFAULT FALSE;
+`
+
+// Sessions and chunks of the history syncs received from the phone
+const historySyncTables = `
+	CREATE TABLE IF NOT EXISTS history_sync_sessions (
+		id TEXT PRIMARY KEY,
+		sync_type TEXT,
+		progress INTEGER,
+		chunks_received INTEGER,
+		last_chunk_order INTEGER,
+		messages_stored INTEGER,
+		started_at TIMESTAMP,
+		updated_at TIMESTAMP,
+		completed_at TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS history_sync_chunks (
+		session_id TEXT,
+		chunk_order INTEGER,
+		progress INTEGER,
+		conversations INTEGER,
+		messages INTEGER,
+		received_at TIMESTAMP,
+		PRIMARY KEY (session_id, chunk_order),
+		FOREIGN KEY (session_id) REFERENCES history_sync_sessions(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS history_sync_sessions_type_idx ON history_sync_sessions (sync_type, started_at);
+`
+
+// A single versioned schema change. Migrations are applied in order, each in its own transaction.
+// An empty statement for a dialect means the change isn't needed there
+type migration struct {
+	version     int
+	description string
+	postgres    string
+	sqlite      string
+}
+
+// Get the statements of a migration for a dialect
+func (m migration) statements(dialect databaseDialect) string {
+	if dialect == dialectSQLite {
+		return m.sqlite
+	}
+	return m.postgres
+}
+
+// All schema migrations, in order. Never edit or reorder a migration that has been released,
+// add a new one instead
+func migrations() []migration {
+	return []migration{
+		{
+			version:     1,
+			description: "initial schema",
+			// Idempotent, so Postgres databases created before migrations were tracked adopt it as is.
+			// SQLite databases are always created by the migrations, so they don't need IF NOT EXISTS
+			postgres: initialTables + `
+				ALTER TABLE group_participants ADD COLUMN IF NOT EXISTS joined_at TIMESTAMP;
+				ALTER TABLE group_participants ADD COLUMN IF NOT EXISTS left_at TIMESTAMP;
+				ALTER TABLE messages ADD COLUMN IF NOT EXISTS is_system BOOLEAN NOT NULL DEFAULT FALSE;
+			`,
+			sqlite: initialTables + `
+				ALTER TABLE group_participants ADD COLUMN joined_at TIMESTAMP;
+				ALTER TABLE group_participants ADD COLUMN left_at TIMESTAMP;
+				ALTER TABLE messages ADD COLUMN is_system BOOLEAN NOT NULL DEFAULT FALSE;
+			`,
+		},
+		{
+			version:     2,
+			description: "full-text search over message content",
+			postgres:    searchSchema(),
+			sqlite:      sqliteSearchSchema,
+		},
+		{
+			version:     3,
+			description: "indexes for timeline, sender and media lookups",
+			postgres:    timelineIndexes,
+			sqlite:      timelineIndexes,
+		},
+		{
+			version:     4,
+			description: "allow media files over 2 GB",
+			postgres: `
+				ALTER TABLE messages ALTER COLUMN file_length TYPE BIGINT;
+			`,
+			// SQLite integers are always 64 bit
+			sqlite: "",
+		},
+		{
+			version:     5,
+			description: "history sync progress",
+			postgres:    historySyncTables,
+			sqlite:      historySyncTables,
+		},
+		{
+			version:     6,
+			description: "conversation metadata from history sync and app state",
+			postgres:    conversationMetadataColumns,
+			sqlite:      conversationMetadataColumns,
+		},
+		{
+			version:     7,
+			description: "S3 object keys and backfill progress of messages",
+			postgres:    s3BackfillColumns,
+			sqlite:      s3BackfillColumns,
+		},
+		{
+			version:     8,
+			description: "direct paths and media metadata",
+			postgres:    mediaMetadataColumns,
+			sqlite:      mediaMetadataColumns,
+		},
+		{
+			version:     9,
+			description: "auto-responder rules",
+			postgres:    fmt.Sprintf(rulesTable, "SERIAL PRIMARY KEY"),
+			sqlite:      fmt.Sprintf(rulesTable, "INTEGER PRIMARY KEY AUTOINCREMENT"),
+		},
+		{
+			version:     10,
+			description: "scheduled and recurring messages",
+			postgres:    fmt.Sprintf(scheduledMessagesTable, "SERIAL PRIMARY KEY"),
+			sqlite:      fmt.Sprintf(scheduledMessagesTable, "INTEGER PRIMARY KEY AUTOINCREMENT"),
+		},
+		{
+			version:     11,
+			description: "message templates",
+			postgres:    fmt.Sprintf(messageTemplatesTable, "SERIAL PRIMARY KEY"),
+			sqlite:      fmt.Sprintf(messageTemplatesTable, "INTEGER PRIMARY KEY AUTOINCREMENT"),
+		},
+		{
+			version:     12,
+			description: "broadcasts and contact tags",
+			postgres:    contactTagsTable + fmt.Sprintf(broadcastTables, "SERIAL PRIMARY KEY"),
+			sqlite:      contactTagsTable + fmt.Sprintf(broadcastTables, "INTEGER PRIMARY KEY AUTOINCREMENT"),
+		},
+		{
+			version:     13,
+			description: "revoked and edited messages",
+			postgres:    messageChangeColumns,
+			sqlite:      messageChangeColumns,
+		},
+		{
+			version:     14,
+			description: "voice note and animated sticker flags",
+			postgres:    mediaFlagColumns,
+			sqlite:      mediaFlagColumns,
+		},
+		{
+			version:     15,
+			description: "messages sent through the API",
+			postgres:    sentMessageColumns,
+			sqlite:      sentMessageColumns,
+		},
+		{
+			version:     16,
+			description: "uploaded media of broadcasts",
+			postgres:    broadcastMediaColumns,
+			sqlite:      broadcastMediaColumns,
+		},
+	}
+}
+
+// Apply all pending migrations to the message database
+func runMigrations(ctx context.Context, db *sql.DB, dialect databaseDialect) error {
+	// Advisory locks belong to a session, so lock, migrate and unlock on the same connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// SQLite has no advisory locks, but its write transactions are serialized (and started
+	// immediately, see createSQLiteConnectionString), so the check in applyMigration is enough
+	if dialect == dialectPostgres {
+		_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey)
+		if err != nil {
+			return fmt.Errorf("failed to acquire migration lock: %v", err)
+		}
+		defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockKey)
+	}
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			description TEXT,
+			applied_at TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %v", err)
+	}
+
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return fmt.Errorf("failed to read applied migrations: %v", err)
+	}
+
+	for _, m := range migrations() {
+		if applied[m.version] {
+			continue
+		}
+		ran, err := applyMigration(ctx, conn, dialect, m)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %v", m.version, m.description, err)
+		}
+		if ran {
+			fmt.Printf("Applied migration %d: %s\n", m.version, m.description)
+		}
+	}
+
+	return nil
+}
+
+// Get the versions of the migrations already applied
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]bool, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err = rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// Apply a migration and record it in the same transaction.
+// Returns false if another instance applied it in the meantime
+func applyMigration(ctx context.Context, conn *sql.Conn, dialect databaseDialect, m migration) (bool, error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var alreadyApplied bool
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)", m.version).Scan(&alreadyApplied)
+	if err != nil {
+		return false, err
+	}
+	if alreadyApplied {
+		return false, nil
+	}
+
+	if statements := m.statements(dialect); statements != "" {
+		if _, err = tx.ExecContext(ctx, statements); err != nil {
+			return false, err
+		}
+	}
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO schema_migrations (version, description, applied_at) VALUES ($1, $2, $3)",
+		m.version, m.description, time.Now(),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	waProto "go.mau.fi/whatsmeow/proto/waE2E"
+	"google.golang.org/protobuf/proto"
+)
+
+// LocationPayload represents a location to send as a WhatsApp location message
+type LocationPayload struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Name      string  `json:"name,omitempty"`
+	Address   string  `json:"address,omitempty"`
+}
+
+// ContactCardPayload represents a contact to send as a WhatsApp contact card (vCard)
+type ContactCardPayload struct {
+	Name         string   `json:"name"`
+	Phones       []string `json:"phones"`
+	Organization string   `json:"organization,omitempty"`
+	Email        string   `json:"email,omitempty"`
+	URL          string   `json:"url,omitempty"`
+}
+
+// Validate a location payload
+func (location *LocationPayload) validate() error {
+	if math.IsNaN(location.Latitude) || location.Latitude < -90 || location.Latitude > 90 {
+		return fmt.Errorf("latitude must be between -90 and 90")
+	}
+	if math.IsNaN(location.Longitude) || location.Longitude < -180 || location.Longitude > 180 {
+		return fmt.Errorf("longitude must be between -180 and 180")
+	}
+	return nil
+}
+
+// Validate a contact card payload
+func (contact *ContactCardPayload) validate() error {
+	if strings.TrimSpace(contact.Name) == "" {
+		return fmt.Errorf("contact name is required")
+	}
+	if len(contact.Phones) == 0 {
+		return fmt.Errorf("contact %s needs at least one phone number", contact.Name)
+	}
+	for _, phone := range contact.Phones {
+		if _, err := normalizePhoneNumber(phone); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Escape a vCard property value
+func escapeVCardValue(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\r\n", `\n`, "\n", `\n`)
+	return replacer.Replace(value)
+}
+
+// Generate a vCard 3.0 for a contact. Phone numbers include the waid parameter so
+// WhatsApp shows the "Message" button for contacts that are on WhatsApp
+func generateVCard(contact ContactCardPayload) string {
+	var vcard strings.Builder
+	vcard.WriteString("BEGIN:VCARD\n")
+	vcard.WriteString("VERSION:3.0\n")
+	vcard.WriteString("FN:" + escapeVCardValue(contact.Name) + "\n")
+	if contact.Organization != "" {
+		vcard.WriteString("ORG:" + escapeVCardValue(contact.Organization) + ";\n")
+	}
+	for _, phone := range contact.Phones {
+		number, err := normalizePhoneNumber(phone)
+		if err != nil {
+			continue
+		}
+		vcard.WriteString(fmt.Sprintf("TEL;type=CELL;type=VOICE;waid=%s:+%s\n", number, number))
+	}
+	if contact.Email != "" {
+		vcard.WriteString("EMAIL;type=INTERNET:" + escapeVCardValue(contact.Email) + "\n")
+	}
+	if contact.URL != "" {
+		vcard.WriteString("URL:" + escapeVCardValue(contact.URL) + "\n")
+	}
+	vcard.WriteString("END:VCARD")
+	return vcard.String()
+}
+
+// Build a location message
+func buildLocationMessage(location LocationPayload) *waProto.Message {
+	locationMessage := &waProto.LocationMessage{
+		DegreesLatitude:  proto.Float64(location.Latitude),
+		DegreesLongitude: proto.Float64(location.Longitude),
+	}
+	if location.Name != "" {
+		locationMessage.Name = proto.String(location.Name)
+	}
+	if location.Address != "" {
+		locationMessage.Address = proto.String(location.Address)
+	}
+	return &waProto.Message{LocationMessage: locationMessage}
+}
+
+// Build a contact message, or a contacts array message when sending several contacts
+func buildContactsMessage(contacts []ContactCardPayload) *waProto.Message {
+	contactMessages := make([]*waProto.ContactMessage, len(contacts))
+	for i, contact := range contacts {
+		contactMessages[i] = &waProto.ContactMessage{
+			DisplayName: proto.String(contact.Name),
+			Vcard:       proto.String(generateVCard(contact)),
+		}
+	}
+
+	if len(contactMessages) == 1 {
+		return &waProto.Message{ContactMessage: contactMessages[0]}
+	}
+	return &waProto.Message{
+		ContactsArrayMessage: &waProto.ContactsArrayMessage{
+			DisplayName: proto.String(fmt.Sprintf("%d contacts", len(contactMessages))),
+			Contacts:    contactMessages,
+		},
+	}
+}
+
+// Build a text message with a link preview for the first URL in the text.
+// Falls back to a plain text message if the preview can't be generated
+func buildLinkPreviewMessage(text string, preview *LinkPreview) *waProto.Message {
+	if preview == nil {
+		return &waProto.Message{Conversation: proto.String(text)}
+	}
+
+	extendedText := &waProto.ExtendedTextMessage{
+		Text:        proto.String(text),
+		MatchedText: proto.String(preview.URL),
+		Title:       proto.String(preview.Title),
+		PreviewType: waProto.ExtendedTextMessage_NONE.Enum(),
+	}
+	if preview.Description != "" {
+		extendedText.Description = proto.String(preview.Description)
+	}
+	if len(preview.Thumbnail) > 0 {
+		extendedText.JPEGThumbnail = preview.Thumbnail
+	}
+	return &waProto.Message{ExtendedTextMessage: extendedText}
+}
@@ -0,0 +1,331 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types/events"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// WhatsApp clients allow at most 12 options in a poll
+const maxPollOptions = 12
+
+// CreatePollRequest represents the request body for the create poll API
+type CreatePollRequest struct {
+	Recipient string   `json:"recipient"`
+	Name      string   `json:"name"`
+	Options   []string `json:"options"`
+	// Maximum number of options a voter can select, 0 means any number
+	SelectableCount int   `json:"selectable_count,omitempty"`
+	Verify          *bool `json:"verify,omitempty"`
+}
+
+// CreatePollResponse represents the response for the create poll API
+type CreatePollResponse struct {
+	ID      string `json:"id"`
+	ChatJID string `json:"chat_jid"`
+}
+
+// PollOptionResult represents the votes for a single poll option
+type PollOptionResult struct {
+	Name   string   `json:"name"`
+	Votes  int      `json:"votes"`
+	Voters []string `json:"voters"`
+}
+
+// PollResultsResponse represents the response for the poll results API
+type PollResultsResponse struct {
+	ID              string             `json:"id"`
+	ChatJID         string             `json:"chat_jid"`
+	Name            string             `json:"name"`
+	SelectableCount int                `json:"selectable_count"`
+	CreatedAt       time.Time          `json:"created_at"`
+	TotalVoters     int                `json:"total_voters"`
+	Options         []PollOptionResult `json:"options"`
+}
+
+// Get the poll creation message of any version from a message
+func getPollCreation(msg *waProto.Message) *waProto.PollCreationMessage {
+	if poll := msg.GetPollCreationMessage(); poll != nil {
+		return poll
+	} else if poll = msg.GetPollCreationMessageV2(); poll != nil {
+		return poll
+	} else if poll = msg.GetPollCreationMessageV3(); poll != nil {
+		return poll
+	}
+	return nil
+}
+
+// Store a poll with its options and message secret
+func (store *MessageStore) storePoll(id, chatJID, creator string, poll *waProto.PollCreationMessage, messageSecret []byte, createdAt time.Time) error {
+	tx, err := store.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`INSERT INTO polls (id, chat_jid, creator, name, selectable_count, message_secret, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (id, chat_jid) DO UPDATE SET
+			message_secret = COALESCE(EXCLUDED.message_secret, polls.message_secret)`,
+		id, chatJID, creator, poll.GetName(), poll.GetSelectableOptionsCount(), messageSecret, createdAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	optionNames := make([]string, len(poll.GetOptions()))
+	for i, option := range poll.GetOptions() {
+		optionNames[i] = option.GetOptionName()
+	}
+	for i, hash := range whatsmeow.HashPollOptions(optionNames) {
+		_, err = tx.Exec(
+			`INSERT INTO poll_options (poll_id, chat_jid, option_index, option_name, option_hash)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (poll_id, chat_jid, option_index) DO NOTHING`,
+			id, chatJID, i, optionNames[i], hash,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Replace a voter's selected options. Each vote contains the full selection, so an empty
+// selection means the voter retracted their vote
+func (store *MessageStore) storePollVote(pollID, chatJID, voter string, selectedHashes [][]byte, votedAt time.Time) error {
+	tx, err := store.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Ignore votes older than the one we already have, as they may arrive out of order
+	var lastVotedAt time.Time
+	err = tx.QueryRow(
+		`SELECT voted_at FROM poll_votes WHERE poll_id = $1 AND chat_jid = $2 AND voter_jid = $3
+		ORDER BY voted_at DESC LIMIT 1`,
+		pollID, chatJID, voter,
+	).Scan(&lastVotedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil && lastVotedAt.After(votedAt) {
+		return nil
+	}
+
+	_, err = tx.Exec(
+		"DELETE FROM poll_votes WHERE poll_id = $1 AND chat_jid = $2 AND voter_jid = $3",
+		pollID, chatJID, voter,
+	)
+	if err != nil {
+		return err
+	}
+	for _, hash := range selectedHashes {
+		_, err = tx.Exec(
+			`INSERT INTO poll_votes (poll_id, chat_jid, voter_jid, option_hash, voted_at)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (poll_id, chat_jid, voter_jid, option_hash) DO NOTHING`,
+			pollID, chatJID, voter, hash, votedAt,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Get a poll with per-option tallies. If chatJID is empty, the most recent poll with the ID is used
+func (store *MessageStore) getPollResults(pollID, chatJID string) (*PollResultsResponse, error) {
+	results := &PollResultsResponse{ID: pollID}
+	err := store.Db.QueryRow(
+		`SELECT chat_jid, name, selectable_count, created_at FROM polls
+		WHERE id = $1 AND ($2 = '' OR chat_jid = $2)
+		ORDER BY created_at DESC LIMIT 1`,
+		pollID, chatJID,
+	).Scan(&results.ChatJID, &results.Name, &results.SelectableCount, &results.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := store.Db.Query(
+		`SELECT option_name, option_hash FROM poll_options
+		WHERE poll_id = $1 AND chat_jid = $2 ORDER BY option_index`,
+		pollID, results.ChatJID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var optionHashes [][]byte
+	for rows.Next() {
+		var option PollOptionResult
+		var hash []byte
+		if err = rows.Scan(&option.Name, &hash); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		option.Voters = []string{}
+		results.Options = append(results.Options, option)
+		optionHashes = append(optionHashes, hash)
+	}
+	rows.Close()
+
+	rows, err = store.Db.Query(
+		"SELECT voter_jid, option_hash FROM poll_votes WHERE poll_id = $1 AND chat_jid = $2 ORDER BY voted_at",
+		pollID, results.ChatJID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	voters := make(map[string]bool)
+	for rows.Next() {
+		var voter string
+		var hash []byte
+		if err = rows.Scan(&voter, &hash); err != nil {
+			return nil, err
+		}
+		voters[voter] = true
+		for i, optionHash := range optionHashes {
+			if bytes.Equal(optionHash, hash) {
+				results.Options[i].Votes++
+				results.Options[i].Voters = append(results.Options[i].Voters, voter)
+				break
+			}
+		}
+	}
+	results.TotalVoters = len(voters)
+
+	return results, rows.Err()
+}
+
+// Handle poll creation and poll vote messages.
+// Returns true if the message was a poll message and needs no further processing
+func handlePollMessage(client *whatsmeow.Client, messageStore *MessageStore, msg *events.Message, logger waLog.Logger) bool {
+	chatJID := msg.Info.Chat.String()
+
+	if poll := getPollCreation(msg.Message); poll != nil {
+		err := messageStore.storePoll(msg.Info.ID, chatJID, msg.Info.Sender.ToNonAD().String(), poll,
+			msg.Message.GetMessageContextInfo().GetMessageSecret(), msg.Info.Timestamp)
+		if err != nil {
+			logger.Warnf("Failed to store poll %s: %v", msg.Info.ID, err)
+		} else {
+			logger.Infof("Stored poll %s in %s: %s", msg.Info.ID, chatJID, poll.GetName())
+		}
+		return true
+	}
+
+	if pollUpdate := msg.Message.GetPollUpdateMessage(); pollUpdate != nil {
+		pollID := pollUpdate.GetPollCreationMessageKey().GetID()
+		vote, err := client.DecryptPollVote(context.Background(), msg)
+		if err != nil {
+			logger.Warnf("Failed to decrypt vote on poll %s: %v", pollID, err)
+			return true
+		}
+
+		voter := msg.Info.Sender.ToNonAD().String()
+		err = messageStore.storePollVote(pollID, chatJID, voter, vote.GetSelectedOptions(), msg.Info.Timestamp)
+		if err != nil {
+			logger.Warnf("Failed to store vote on poll %s: %v", pollID, err)
+		} else {
+			logger.Infof("Stored vote from %s on poll %s (%d options)", voter, pollID, len(vote.GetSelectedOptions()))
+		}
+		return true
+	}
+
+	return false
+}
+
+func registerPollRoutes(client *whatsmeow.Client, messageStore *MessageStore) {
+	// Send a new poll
+	http.HandleFunc("POST /api/polls", func(w http.ResponseWriter, r *http.Request) {
+		if !client.IsConnected() {
+			http.Error(w, "Not connected to WhatsApp", http.StatusServiceUnavailable)
+			return
+		}
+
+		var req CreatePollRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		if req.Recipient == "" || req.Name == "" {
+			http.Error(w, "Recipient and name are required", http.StatusBadRequest)
+			return
+		}
+		if len(req.Options) < 2 || len(req.Options) > maxPollOptions {
+			http.Error(w, fmt.Sprintf("A poll needs between 2 and %d options", maxPollOptions), http.StatusBadRequest)
+			return
+		}
+		seen := make(map[string]bool, len(req.Options))
+		for _, option := range req.Options {
+			// Votes reference options by the hash of their name, so names must be unique
+			if option == "" || seen[option] {
+				http.Error(w, "Poll options must be unique and non-empty", http.StatusBadRequest)
+				return
+			}
+			seen[option] = true
+		}
+		if req.SelectableCount < 0 || req.SelectableCount > len(req.Options) {
+			http.Error(w, "Selectable count must be between 0 and the number of options", http.StatusBadRequest)
+			return
+		}
+
+		recipientJID, err := resolveRecipient(r.Context(), client, messageStore, req.Recipient, shouldVerifyRecipient(req.Verify))
+		if errors.Is(err, errInvalidRecipient) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		pollMessage := client.BuildPollCreation(req.Name, req.Options, req.SelectableCount)
+		resp, err := client.SendMessage(r.Context(), recipientJID, pollMessage)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error sending poll: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		chatJID := recipientJID.String()
+		var creator string
+		if client.Store.ID != nil {
+			creator = client.Store.ID.ToNonAD().String()
+		}
+		err = messageStore.storePoll(resp.ID, chatJID, creator, pollMessage.GetPollCreationMessage(),
+			pollMessage.GetMessageContextInfo().GetMessageSecret(), resp.Timestamp)
+		if err != nil {
+			fmt.Printf("Failed to store poll %s: %v\n", resp.ID, err)
+		}
+
+		writeJSON(w, http.StatusCreated, CreatePollResponse{ID: resp.ID, ChatJID: chatJID})
+	})
+
+	// Get the current tally of a poll, optionally scoped to a chat with ?chat=
+	http.HandleFunc("GET /api/polls/{id}/results", func(w http.ResponseWriter, r *http.Request) {
+		results, err := messageStore.getPollResults(r.PathValue("id"), r.URL.Query().Get("chat"))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Poll not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting poll results: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, results)
+	})
+}
@@ -0,0 +1,258 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// errInvalidRecipient is returned when a recipient can't be turned into a usable JID
+var errInvalidRecipient = errors.New("invalid recipient")
+
+// Default time a cached IsOnWhatsApp result is trusted for
+const defaultRecipientCheckTTL = 24 * time.Hour
+
+// E.164 allows at most 15 digits including the country code
+const (
+	minPhoneDigits = 8
+	maxPhoneDigits = 15
+	// National numbers without a trunk prefix are at most this long, anything longer
+	// without an international prefix is assumed to already include the country code
+	maxNationalDigits = 10
+)
+
+// Country codes are one to three digits
+const maxCountryCodeDigits = 3
+
+// Get the country code used for numbers given in national format, e.g. "351"
+func defaultCountryCode() (string, error) {
+	countryCode := strings.TrimPrefix(strings.TrimSpace(os.Getenv("DEFAULT_COUNTRY_CODE")), "+")
+	if countryCode == "" {
+		return "", nil
+	}
+	if len(countryCode) > maxCountryCodeDigits || !isDigits(countryCode) || strings.HasPrefix(countryCode, "0") {
+		return "", fmt.Errorf("DEFAULT_COUNTRY_CODE %q is not a valid country code", countryCode)
+	}
+	return countryCode, nil
+}
+
+// Whether s is non-empty and only made of the digits 0-9
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether recipients should be checked with IsOnWhatsApp before sending
+func verifyRecipientsEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("VERIFY_RECIPIENTS"))
+	return enabled
+}
+
+// Whether to verify a recipient, using the per-request override if given
+func shouldVerifyRecipient(override *bool) bool {
+	if override != nil {
+		return *override
+	}
+	return verifyRecipientsEnabled()
+}
+
+// Get how long a cached IsOnWhatsApp result is trusted for
+func recipientCheckTTL() time.Duration {
+	ttl, err := time.ParseDuration(os.Getenv("RECIPIENT_CHECK_TTL"))
+	if err != nil || ttl <= 0 {
+		return defaultRecipientCheckTTL
+	}
+	return ttl
+}
+
+// Normalize a phone number to E.164 digits (without the + prefix).
+//
+// Numbers starting with + or 00 are international. Numbers starting with a single 0
+// (trunk prefix) or short enough to be national numbers get the default country code
+// prepended. Anything else is assumed to already include the country code.
+//
+// When DEFAULT_COUNTRY_CODE is set, bare numbers of up to 10 digits that don't already
+// start with it are taken as national numbers, so international numbers that short
+// (e.g. "6591234567" for Singapore) must be given with a + or 00 prefix.
+func normalizePhoneNumber(phone string) (string, error) {
+	var digits strings.Builder
+	for i, r := range strings.TrimSpace(phone) {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == '+' && i == 0:
+			digits.WriteRune(r)
+		case r == ' ' || r == '-' || r == '.' || r == '(' || r == ')':
+			// Formatting characters
+		default:
+			return "", fmt.Errorf("%w: unexpected character %q in phone number %q", errInvalidRecipient, r, phone)
+		}
+	}
+
+	number := digits.String()
+	countryCode, err := defaultCountryCode()
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case strings.HasPrefix(number, "+"):
+		number = number[1:]
+	case strings.HasPrefix(number, "00"):
+		number = number[2:]
+	case strings.HasPrefix(number, "0"):
+		if countryCode == "" {
+			return "", fmt.Errorf("%w: phone number %q is in national format but DEFAULT_COUNTRY_CODE is not set", errInvalidRecipient, phone)
+		}
+		number = countryCode + number[1:]
+	case countryCode != "" && len(number) <= maxNationalDigits && !strings.HasPrefix(number, countryCode):
+		number = countryCode + number
+	}
+
+	if len(number) < minPhoneDigits || len(number) > maxPhoneDigits || strings.HasPrefix(number, "0") {
+		return "", fmt.Errorf("%w: %q is not a valid international phone number", errInvalidRecipient, phone)
+	}
+	return number, nil
+}
+
+// Parse a recipient given either as a full JID or as a phone number
+func parseRecipientJID(recipient string) (types.JID, error) {
+	recipient = strings.TrimSpace(recipient)
+	if recipient == "" {
+		return types.JID{}, fmt.Errorf("%w: recipient is empty", errInvalidRecipient)
+	}
+
+	// Check if recipient is a JID
+	if strings.Contains(recipient, "@") {
+		jid, err := types.ParseJID(recipient)
+		if err != nil {
+			return types.JID{}, fmt.Errorf("%w: %v", errInvalidRecipient, err)
+		}
+		switch jid.Server {
+		case types.DefaultUserServer, types.LegacyUserServer:
+			// The user part of a JID is already in international format, so it's only validated
+			if !isDigits(jid.User) || len(jid.User) < minPhoneDigits || len(jid.User) > maxPhoneDigits || strings.HasPrefix(jid.User, "0") {
+				return types.JID{}, fmt.Errorf("%w: %s is not a valid phone number JID", errInvalidRecipient, recipient)
+			}
+			return types.NewJID(jid.User, types.DefaultUserServer), nil
+		case types.GroupServer, types.HiddenUserServer, types.NewsletterServer:
+			if jid.User == "" {
+				return types.JID{}, fmt.Errorf("%w: %s has no user part", errInvalidRecipient, recipient)
+			}
+			return jid, nil
+		default:
+			return types.JID{}, fmt.Errorf("%w: unsupported JID server %q", errInvalidRecipient, jid.Server)
+		}
+	}
+
+	// Create JID from phone number
+	number, err := normalizePhoneNumber(recipient)
+	if err != nil {
+		return types.JID{}, err
+	}
+	return types.NewJID(number, types.DefaultUserServer), nil
+}
+
+// Get a cached IsOnWhatsApp result for a phone number, if it's still fresh
+func (store *MessageStore) getRecipientCheck(phoneNumber string, maxAge time.Duration) (jid string, isOnWhatsApp bool, found bool, err error) {
+	var checkedAt time.Time
+	var cachedJID sql.NullString
+	err = store.Db.QueryRow(
+		"SELECT jid, is_on_whatsapp, checked_at FROM recipient_checks WHERE phone_number = $1",
+		phoneNumber,
+	).Scan(&cachedJID, &isOnWhatsApp, &checkedAt)
+	if err == sql.ErrNoRows {
+		return "", false, false, nil
+	} else if err != nil {
+		return "", false, false, err
+	}
+	if time.Since(checkedAt) > maxAge {
+		return "", false, false, nil
+	}
+	return cachedJID.String, isOnWhatsApp, true, nil
+}
+
+// Store an IsOnWhatsApp result for a phone number
+func (store *MessageStore) storeRecipientCheck(phoneNumber, jid string, isOnWhatsApp bool) error {
+	_, err := store.Db.Exec(
+		`INSERT INTO recipient_checks (phone_number, jid, is_on_whatsapp, checked_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (phone_number) DO UPDATE SET
+			jid = EXCLUDED.jid,
+			is_on_whatsapp = EXCLUDED.is_on_whatsapp,
+			checked_at = EXCLUDED.checked_at`,
+		phoneNumber, jid, isOnWhatsApp, time.Now(),
+	)
+	return err
+}
+
+// Check whether a phone number is registered on WhatsApp, using the cache when possible.
+// Returns the canonical JID reported by WhatsApp for registered numbers
+func verifyPhoneOnWhatsApp(ctx context.Context, client *whatsmeow.Client, messageStore MessageRepository, phoneNumber string) (types.JID, bool, error) {
+	cachedJID, isOnWhatsApp, found, err := messageStore.getRecipientCheck(phoneNumber, recipientCheckTTL())
+	if err != nil {
+		fmt.Printf("Failed to read recipient check cache for %s: %v\n", phoneNumber, err)
+	} else if found {
+		if !isOnWhatsApp {
+			return types.JID{}, false, nil
+		}
+		if jid, err := types.ParseJID(cachedJID); err == nil {
+			return jid, true, nil
+		}
+	}
+
+	results, err := client.IsOnWhatsApp(ctx, []string{"+" + phoneNumber})
+	if err != nil {
+		return types.JID{}, false, fmt.Errorf("failed to check if %s is on WhatsApp: %v", phoneNumber, err)
+	}
+	var jid types.JID
+	isOnWhatsApp = false
+	for _, result := range results {
+		if result.IsIn {
+			jid = result.JID
+			isOnWhatsApp = true
+			break
+		}
+	}
+
+	if err = messageStore.storeRecipientCheck(phoneNumber, jid.String(), isOnWhatsApp); err != nil {
+		fmt.Printf("Failed to cache recipient check for %s: %v\n", phoneNumber, err)
+	}
+	return jid, isOnWhatsApp, nil
+}
+
+// Resolve a recipient into the JID to send to. Phone numbers are normalized to E.164 and,
+// if verification is requested, checked to be registered on WhatsApp.
+// Errors wrapping errInvalidRecipient are caused by bad input
+func resolveRecipient(ctx context.Context, client *whatsmeow.Client, messageStore MessageRepository, recipient string, verify bool) (types.JID, error) {
+	jid, err := parseRecipientJID(recipient)
+	if err != nil {
+		return types.JID{}, err
+	}
+	if !verify || jid.Server != types.DefaultUserServer {
+		return jid, nil
+	}
+
+	verifiedJID, isOnWhatsApp, err := verifyPhoneOnWhatsApp(ctx, client, messageStore, jid.User)
+	if err != nil {
+		return types.JID{}, err
+	}
+	if !isOnWhatsApp {
+		return types.JID{}, fmt.Errorf("%w: %s is not registered on WhatsApp", errInvalidRecipient, jid.User)
+	}
+	return verifiedJID, nil
+}
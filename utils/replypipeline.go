@@ -0,0 +1,319 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.mau.fi/whatsmeow"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+const (
+	// Prefixes replies are picked up from, claimed into while being sent, and moved to once
+	// sent or once they turn out to be unsendable. Replies are stored as {prefix}{chatJID}/{name}
+	replyOutputPrefix     = "output/"
+	replyProcessingPrefix = "processing/"
+	replySentPrefix       = "sent/"
+	replyFailedPrefix     = "failed/"
+	// Pause between looks for new replies when REPLY_PIPELINE_INTERVAL is not set
+	defaultReplyPollInterval = 10 * time.Second
+	// Folder holding the output, processing, sent and failed folders in local mode when REPLY_PIPELINE_DIR is not set
+	defaultReplyPipelineDir = "replies"
+	// Metadata holding the ID of the message a reply quotes (x-amz-meta-reply-to on S3)
+	replyToMetadataKey = "reply-to"
+	// Suffix of the JSON files holding the metadata of a reply in local mode, e.g. answer.ogg.meta.json
+	localReplyMetadataSuffix = ".meta.json"
+)
+
+// errInvalidReply is returned for replies that can never be sent, e.g. ones outside a chat folder
+var errInvalidReply = errors.New("invalid reply")
+
+// replySource is where the reply pipeline picks up the replies written by processors
+type replySource interface {
+	// List the keys of the pending replies, relative to the output prefix
+	list(ctx context.Context) ([]string, error)
+	// Read a reply and its metadata from a prefix
+	read(ctx context.Context, prefix, key string) (data []byte, metadata map[string]string, err error)
+	// Move a reply from one prefix to another, e.g. from processing/ to sent/
+	move(ctx context.Context, key, from, to string) error
+}
+
+// s3ReplySource picks up replies from the output prefix of an S3 bucket
+type s3ReplySource struct {
+	client     *s3.Client
+	bucketName string
+}
+
+func (source *s3ReplySource) list(ctx context.Context) ([]string, error) {
+	var keys []string
+	paginator := s3.NewListObjectsV2Paginator(source.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(source.bucketName),
+		Prefix: aws.String(replyOutputPrefix),
+	})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range output.Contents {
+			// Skip the empty objects the S3 console creates for folders
+			if key := aws.ToString(object.Key); !strings.HasSuffix(key, "/") {
+				keys = append(keys, strings.TrimPrefix(key, replyOutputPrefix))
+			}
+		}
+	}
+	return keys, nil
+}
+
+func (source *s3ReplySource) read(ctx context.Context, prefix, key string) ([]byte, map[string]string, error) {
+	result, err := source.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(source.bucketName),
+		Key:    aws.String(prefix + key),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer result.Body.Close()
+
+	data, err := io.ReadAll(result.Body)
+	return data, result.Metadata, err
+}
+
+// S3 has no move, so replies are copied to the new prefix and then deleted
+func (source *s3ReplySource) move(ctx context.Context, key, from, to string) error {
+	_, err := source.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(source.bucketName),
+		CopySource: aws.String(s3CopySource(source.bucketName, from+key)),
+		Key:        aws.String(to + key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy object: %v", err)
+	}
+	_, err = source.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(source.bucketName),
+		Key:    aws.String(from + key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete object: %v", err)
+	}
+	return nil
+}
+
+// Build the URL-encoded copy source of an S3 object, keeping the slashes of its key
+func s3CopySource(bucketName, objectKey string) string {
+	segments := strings.Split(bucketName+"/"+objectKey, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// localReplySource picks up replies from a local folder laid out like the bucket, for
+// testing without S3. Metadata is read from a JSON object next to each reply
+type localReplySource struct {
+	dir string
+}
+
+func (source *localReplySource) list(ctx context.Context) ([]string, error) {
+	outputDir := filepath.Join(source.dir, replyOutputPrefix)
+	var keys []string
+	err := filepath.WalkDir(outputDir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Skip metadata files and hidden files, e.g. ones still being written by an editor
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, localReplyMetadataSuffix) {
+			return nil
+		}
+		key, err := filepath.Rel(outputDir, filePath)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, filepath.ToSlash(key))
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return keys, err
+}
+
+func (source *localReplySource) read(ctx context.Context, prefix, key string) ([]byte, map[string]string, error) {
+	filePath := filepath.Join(source.dir, prefix, filepath.FromSlash(key))
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var metadata map[string]string
+	metadataJSON, err := os.ReadFile(filePath + localReplyMetadataSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return data, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if err = json.Unmarshal(metadataJSON, &metadata); err != nil {
+		return nil, nil, fmt.Errorf("%w: invalid metadata file: %v", errInvalidReply, err)
+	}
+	return data, metadata, nil
+}
+
+func (source *localReplySource) move(ctx context.Context, key, from, to string) error {
+	fromPath := filepath.Join(source.dir, from, filepath.FromSlash(key))
+	toPath := filepath.Join(source.dir, to, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(toPath), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Rename(fromPath, toPath); err != nil {
+		return err
+	}
+	err := os.Rename(fromPath+localReplyMetadataSuffix, toPath+localReplyMetadataSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Get where the reply pipeline picks up replies: "s3", "local", or "" when it's disabled
+func replyPipelineMode() string {
+	return strings.ToLower(strings.TrimSpace(os.Getenv("REPLY_PIPELINE_MODE")))
+}
+
+// Get how long the reply pipeline waits between looks for new replies
+func replyPipelineInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("REPLY_PIPELINE_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return defaultReplyPollInterval
+	}
+	return interval
+}
+
+// Get the folder replies are picked up from in local mode
+func replyPipelineDir() string {
+	if dir := os.Getenv("REPLY_PIPELINE_DIR"); dir != "" {
+		return dir
+	}
+	return defaultReplyPipelineDir
+}
+
+// Send a claimed reply to the chat whose folder it's in. Text files are sent as text and
+// anything else through the media path, which turns audio into voice notes. The reply-to
+// metadata makes it quote the message it answers. Errors wrapping errInvalidReply or
+// errInvalidRecipient mean the reply can never be sent
+func sendReply(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, s3Client *s3.Client, source replySource, key string) error {
+	chat, name, found := strings.Cut(key, "/")
+	if !found {
+		return fmt.Errorf("%w: not in a chat folder", errInvalidReply)
+	}
+	recipientJID, err := parseRecipientJID(chat)
+	if err != nil {
+		return err
+	}
+
+	data, metadata, err := source.read(ctx, replyProcessingPrefix, key)
+	if err != nil {
+		return fmt.Errorf("failed to read reply: %v", err)
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("%w: reply is empty", errInvalidReply)
+	}
+
+	req := SendMessageRequest{Recipient: chat, ReplyTo: metadata[replyToMetadataKey]}
+	if strings.EqualFold(path.Ext(name), ".txt") {
+		req.Message = strings.TrimSpace(string(data))
+	} else {
+		req.ObjectKey, req.media = name, data
+	}
+
+	if success, message := sendWhatsAppMessage(client, messageStore, s3Client, recipientJID, req); !success {
+		return errors.New(message)
+	}
+	return nil
+}
+
+// Send all pending replies. Each one is claimed by moving it to the processing prefix first,
+// so it's never sent twice, even if it can't be moved to the sent prefix afterwards. Replies
+// that can never be sent go to the failed prefix, and ones that failed for other reasons,
+// e.g. a timeout, go back to the output prefix to be retried on the next pass
+func processReplies(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, s3Client *s3.Client, source replySource, logger waLog.Logger) {
+	keys, err := source.list(ctx)
+	if err != nil {
+		logger.Warnf("Failed to list replies: %v", err)
+		return
+	}
+
+	for _, key := range keys {
+		// Replies can't be sent while disconnected, leave them for the next pass
+		if ctx.Err() != nil || !client.IsConnected() {
+			return
+		}
+
+		if err = source.move(ctx, key, replyOutputPrefix, replyProcessingPrefix); err != nil {
+			logger.Warnf("Failed to claim reply %s: %v", key, err)
+			continue
+		}
+
+		prefix := replySentPrefix
+		err = sendReply(ctx, client, messageStore, s3Client, source, key)
+		switch {
+		case err == nil:
+			logger.Infof("Sent reply %s", key)
+		case errors.Is(err, errInvalidReply), errors.Is(err, errInvalidRecipient):
+			logger.Warnf("Failed to send reply %s: %v", key, err)
+			prefix = replyFailedPrefix
+		default:
+			logger.Warnf("Failed to send reply %s, retrying on the next pass: %v", key, err)
+			prefix = replyOutputPrefix
+		}
+		if err = source.move(ctx, key, replyProcessingPrefix, prefix); err != nil {
+			logger.Warnf("Failed to move reply %s to %s: %v", key, prefix, err)
+		}
+	}
+}
+
+// Run the reply pipeline until ctx is cancelled. It polls the output prefix for the replies
+// processors write for each chat, at output/{chatJID}/{name}, and sends them to that chat.
+// Replies are picked up from the S3 bucket or, for testing, from a local folder. Replies left
+// in the processing prefix were claimed but not moved on, e.g. because of a restart mid-send,
+// and may or may not have been sent, so they're left for someone to check
+func RunReplyPipeline(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, s3Client *s3.Client, logger waLog.Logger) {
+	var source replySource
+	mode := replyPipelineMode()
+	switch mode {
+	case "":
+		return
+	case "s3":
+		source = &s3ReplySource{client: s3Client, bucketName: os.Getenv("AWS_S3_BUCKET_NAME")}
+	case "local":
+		source = &localReplySource{dir: replyPipelineDir()}
+	default:
+		logger.Errorf("Unknown REPLY_PIPELINE_MODE %q, not watching for replies", mode)
+		return
+	}
+	interval := replyPipelineInterval()
+	logger.Infof("Watching for replies in %s mode every %s", mode, interval)
+
+	for {
+		if client.IsConnected() {
+			processReplies(ctx, client, messageStore, s3Client, source, logger)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
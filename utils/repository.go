@@ -0,0 +1,200 @@
+package utils
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Number of messages inserted per statement by storeMessages. Larger statements save
+// few round trips but get slower to bind with the SQLite driver
+const messageBatchSize = 100
+
+// StoredMessage represents a row of the messages table
+type StoredMessage struct {
+	ID        string
+	ChatJID   string
+	Sender    string
+	Content   string
+	Timestamp time.Time
+	IsFromMe  bool
+	MediaInfo
+	// System events are only written by storeSystemEvent
+	IsSystem bool
+}
+
+// Columns written by storeMessages, in the order of storedMessageValues
+var storedMessageColumns = []string{
+	"id", "chat_jid", "sender", "content", "timestamp", "is_from_me",
+	"media_type", "filename", "url", "direct_path", "media_key", "file_sha256", "file_enc_sha256", "file_length",
+	"mimetype", "caption", "width", "height", "seconds", "jpeg_thumbnail", "ptt", "is_animated",
+}
+
+// Columns read by scanStoredMessage
+const storedMessageSelect = `id, chat_jid, COALESCE(sender, ''), COALESCE(content, ''), timestamp, COALESCE(is_from_me, FALSE),
+	COALESCE(media_type, ''), COALESCE(filename, ''), COALESCE(url, ''), COALESCE(direct_path, ''), media_key, file_sha256,
+	file_enc_sha256, COALESCE(file_length, 0), COALESCE(mimetype, ''), COALESCE(caption, ''), COALESCE(width, 0),
+	COALESCE(height, 0), COALESCE(seconds, 0), jpeg_thumbnail, COALESCE(ptt, FALSE), COALESCE(is_animated, FALSE), is_system`
+
+// rowScanner is a single row of a query result, either *sql.Row or *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Scan a message selected with storedMessageSelect
+func scanStoredMessage(row rowScanner) (StoredMessage, error) {
+	var msg StoredMessage
+	err := row.Scan(&msg.ID, &msg.ChatJID, &msg.Sender, &msg.Content, &msg.Timestamp, &msg.IsFromMe,
+		&msg.MediaType, &msg.Filename, &msg.URL, &msg.DirectPath, &msg.MediaKey, &msg.FileSHA256,
+		&msg.FileEncSHA256, &msg.FileLength, &msg.MimeType, &msg.Caption, &msg.Width,
+		&msg.Height, &msg.Seconds, &msg.JPEGThumbnail, &msg.PTT, &msg.IsAnimated, &msg.IsSystem)
+	return msg, err
+}
+
+// Get the values of the storedMessageColumns of a message
+func storedMessageValues(msg StoredMessage) []interface{} {
+	return []interface{}{
+		msg.ID, msg.ChatJID, msg.Sender, msg.Content, msg.Timestamp, msg.IsFromMe,
+		msg.MediaType, msg.Filename, msg.URL, msg.DirectPath, msg.MediaKey, msg.FileSHA256, msg.FileEncSHA256, msg.FileLength,
+		msg.MimeType, msg.Caption, msg.Width, msg.Height, msg.Seconds, msg.JPEGThumbnail, msg.PTT, msg.IsAnimated,
+	}
+}
+
+// MessageRepository is the storage used for chats and their metadata, messages, media info, contacts and history sync progress.
+// MessageStore implements it on Postgres or SQLite, MemoryMessageStore keeps everything in memory
+type MessageRepository interface {
+	// Chats
+	storeChat(jid, name string, lastMessageTime time.Time) error
+	advanceChat(jid, name string, lastMessageTime time.Time) error
+	getStoredChatName(jid string) (string, error)
+	storeChatMetadata(jid string, metadata ChatMetadata) error
+	setChatArchived(jid string, archived bool) error
+	setChatPinned(jid string, pinnedAt *time.Time) error
+	setChatMuted(jid string, muted bool, mutedUntil *time.Time) error
+	setChatRead(jid string, read bool) error
+
+	// Messages
+	storeMessage(msg StoredMessage) error
+	storeMessages(messages []StoredMessage) error
+	storeSystemEvent(id, chatJID, sender, content string, timestamp time.Time) error
+	getStoredMessage(id, chatJID string) (StoredMessage, error)
+	getOldestMessage(chatJID string) (StoredMessage, error)
+	searchMessages(req SearchMessagesRequest) (*SearchResponse, error)
+
+	// History sync progress
+	recordHistorySyncChunk(chunk HistorySyncChunk) error
+	getHistorySyncSessions(limit int) ([]HistorySyncSession, error)
+
+	// Media
+	getMediaInfo(id, chatJID string) (MediaInfo, error)
+
+	// Contacts
+	storeContactPushName(jid types.JID, pushName string) error
+	storeContactBusinessName(jid types.JID, businessName string) error
+	storeContactDetails(jid types.JID, phoneNumber, lid, fullName, firstName string, timestamp time.Time) error
+	getContactName(jid string) string
+	searchContacts(query string, limit, offset int) ([]ContactResponse, error)
+	setContactTags(jid string, tags []string) error
+	getContactTags(jid string) ([]string, error)
+	getTaggedContacts(tag string) ([]string, error)
+	getRecipientCheck(phoneNumber string, maxAge time.Duration) (jid string, isOnWhatsApp bool, found bool, err error)
+	storeRecipientCheck(phoneNumber, jid string, isOnWhatsApp bool) error
+
+	Close() error
+}
+
+var _ MessageRepository = (*MessageStore)(nil)
+
+// Get the name stored for a chat, or an empty string if the chat isn't known
+func (store *MessageStore) getStoredChatName(jid string) (string, error) {
+	var name *string
+	err := store.Db.QueryRow("SELECT name FROM chats WHERE jid = $1", jid).Scan(&name)
+	if err == sql.ErrNoRows || name == nil {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return *name, nil
+}
+
+// Get the placeholder for the nth parameter of a query. The SQLite driver matches numbered
+// parameters by comparing them with every argument, which is slow for the thousands of
+// parameters in a batch insert, so plain positional parameters are used there
+func (store *MessageStore) placeholder(n int) string {
+	if store.dialect == dialectSQLite {
+		return "?"
+	}
+	return fmt.Sprintf("$%d", n)
+}
+
+// Drop messages that have neither content nor media, and keep only the last copy of
+// messages that appear more than once, as an upsert can't touch the same row twice
+func uniqueStorableMessages(messages []StoredMessage) []StoredMessage {
+	type messageKey struct{ id, chatJID string }
+	index := make(map[messageKey]int, len(messages))
+	unique := make([]StoredMessage, 0, len(messages))
+	for _, msg := range messages {
+		if msg.Content == "" && msg.MediaType == "" {
+			continue
+		}
+		key := messageKey{msg.ID, msg.ChatJID}
+		if i, ok := index[key]; ok {
+			unique[i] = msg
+			continue
+		}
+		index[key] = len(unique)
+		unique = append(unique, msg)
+	}
+	return unique
+}
+
+// Store many messages at once using multi-row upserts in a single transaction.
+// Either all messages are stored or none are
+func (store *MessageStore) storeMessages(messages []StoredMessage) error {
+	messages = uniqueStorableMessages(messages)
+	if len(messages) == 0 {
+		return nil
+	}
+
+	tx, err := store.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Every column but the primary key is updated when a message is stored again
+	updates := make([]string, 0, len(storedMessageColumns)-2)
+	for _, column := range storedMessageColumns[2:] {
+		updates = append(updates, column+" = EXCLUDED."+column)
+	}
+	columnCount := len(storedMessageColumns)
+
+	for start := 0; start < len(messages); start += messageBatchSize {
+		batch := messages[start:min(start+messageBatchSize, len(messages))]
+
+		values := make([]string, len(batch))
+		args := make([]interface{}, 0, len(batch)*columnCount)
+		for i, msg := range batch {
+			placeholders := make([]string, columnCount)
+			for j := range placeholders {
+				placeholders[j] = store.placeholder(i*columnCount + j + 1)
+			}
+			values[i] = "(" + strings.Join(placeholders, ", ") + ")"
+			args = append(args, storedMessageValues(msg)...)
+		}
+
+		_, err = tx.Exec(
+			"INSERT INTO messages ("+strings.Join(storedMessageColumns, ", ")+") VALUES "+strings.Join(values, ", ")+
+				" ON CONFLICT (id, chat_jid) DO UPDATE SET "+strings.Join(updates, ", "),
+			args...,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
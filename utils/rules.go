@@ -0,0 +1,627 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+const (
+	// How long a rule webhook may take to answer
+	ruleWebhookTimeout = 10 * time.Second
+	// Most matched messages waiting for their actions to run. Messages matched while the
+	// queue is full are dropped, so slow actions never hold up incoming events
+	ruleQueueSize = 256
+)
+
+// Actions a rule can run
+const (
+	ruleActionReply   = "reply"
+	ruleActionReact   = "react"
+	ruleActionForward = "forward"
+	ruleActionWebhook = "webhook"
+	ruleActionStop    = "stop"
+)
+
+// Auto-responder rules. Conditions and actions are kept as JSON, as they're only ever
+// read whole when evaluating a message
+const rulesTable = `
+	CREATE TABLE IF NOT EXISTS rules (
+		id %s,
+		name TEXT,
+		enabled BOOLEAN NOT NULL DEFAULT TRUE,
+		priority INTEGER NOT NULL DEFAULT 0,
+		conditions TEXT,
+		actions TEXT,
+		created_at TIMESTAMP,
+		updated_at TIMESTAMP
+	);
+`
+
+// RuleRequest represents the request body for creating or replacing a rule
+type RuleRequest struct {
+	Name string `json:"name"`
+	// Defaults to true
+	Enabled *bool `json:"enabled,omitempty"`
+	// Rules are evaluated from the lowest priority up, in order of creation for equal priorities
+	Priority int          `json:"priority"`
+	Match    RuleMatch    `json:"match"`
+	Actions  []RuleAction `json:"actions"`
+}
+
+// Rule represents an auto-responder rule
+type Rule struct {
+	ID        int64        `json:"id"`
+	Name      string       `json:"name"`
+	Enabled   bool         `json:"enabled"`
+	Priority  int          `json:"priority"`
+	Match     RuleMatch    `json:"match"`
+	Actions   []RuleAction `json:"actions"`
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
+}
+
+// RuleMatch holds the conditions a message must meet for a rule to apply. Empty conditions
+// match any message, and a message must meet all of the conditions that are set
+type RuleMatch struct {
+	// Chats the message must be in, as JIDs or phone numbers
+	Chats []string `json:"chats,omitempty"`
+	// Senders the message must come from, as JIDs or phone numbers
+	Senders []string `json:"senders,omitempty"`
+	// Only match group messages when true, or direct messages when false
+	IsGroup *bool `json:"is_group,omitempty"`
+	// Regular expression the text or caption must match
+	Content string `json:"content,omitempty"`
+	// Media types the message must have, "text" for messages without media
+	MediaTypes []string `json:"media_types,omitempty"`
+	// Times the message must be sent in; any of the windows will do
+	TimeWindows []RuleTimeWindow `json:"time_windows,omitempty"`
+	// Also match our own messages. They're skipped by default so rules don't answer themselves
+	IncludeFromMe bool `json:"include_from_me,omitempty"`
+
+	// Content, compiled when the rule is validated or loaded
+	pattern *regexp.Regexp
+}
+
+// RuleTimeWindow is a daily time range, e.g. 18:00 to 09:00 for out-of-hours replies
+type RuleTimeWindow struct {
+	// Days of the week, 0 for Sunday to 6 for Saturday; empty means every day
+	Days []time.Weekday `json:"days,omitempty"`
+	// Start and end as HH:MM. Windows that end before they start span midnight
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// IANA time zone of the window, defaults to UTC
+	TimeZone string `json:"time_zone,omitempty"`
+}
+
+// RuleAction is something a rule does with a matching message
+type RuleAction struct {
+	// reply, react, forward, webhook or stop. stop keeps later rules from being evaluated
+	Type string `json:"type"`
+	// Text of a reply, or caption of a media reply
+	Text string `json:"text,omitempty"`
+	// S3 object sent as a reply
+	BucketName string `json:"bucket_name,omitempty"`
+	ObjectKey  string `json:"object_key,omitempty"`
+	// Quote the matching message in the reply
+	Quote bool `json:"quote,omitempty"`
+	// Emoji to react with
+	Emoji string `json:"emoji,omitempty"`
+	// Chat to forward the message to, as a JID or phone number
+	Recipient string `json:"recipient,omitempty"`
+	// URL the message is posted to as JSON
+	URL string `json:"url,omitempty"`
+}
+
+// RuleWebhookPayload is the body posted by webhook actions
+type RuleWebhookPayload struct {
+	RuleID   int64           `json:"rule_id"`
+	RuleName string          `json:"rule_name"`
+	Message  MessageEnvelope `json:"message"`
+}
+
+// Parse an HH:MM time of day into minutes since midnight
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Validate a time window
+func (window *RuleTimeWindow) validate() error {
+	if _, err := parseClock(window.Start); err != nil {
+		return err
+	}
+	if _, err := parseClock(window.End); err != nil {
+		return err
+	}
+	for _, day := range window.Days {
+		if day < time.Sunday || day > time.Saturday {
+			return fmt.Errorf("invalid day %d, expected 0 (Sunday) to 6 (Saturday)", day)
+		}
+	}
+	if _, err := time.LoadLocation(window.TimeZone); err != nil {
+		return fmt.Errorf("invalid time zone %q", window.TimeZone)
+	}
+	return nil
+}
+
+// Whether a time falls in the window
+func (window *RuleTimeWindow) contains(t time.Time) bool {
+	location, err := time.LoadLocation(window.TimeZone)
+	if err != nil {
+		return false
+	}
+	t = t.In(location)
+	if len(window.Days) > 0 && !slices.Contains(window.Days, t.Weekday()) {
+		return false
+	}
+
+	start, _ := parseClock(window.Start)
+	end, _ := parseClock(window.End)
+	minutes := t.Hour()*60 + t.Minute()
+	if start <= end {
+		return minutes >= start && minutes < end
+	}
+	return minutes >= start || minutes < end
+}
+
+// Compile the content pattern of the conditions
+func (match *RuleMatch) compile() error {
+	if match.Content == "" {
+		match.pattern = nil
+		return nil
+	}
+	pattern, err := regexp.Compile(match.Content)
+	if err != nil {
+		return err
+	}
+	match.pattern = pattern
+	return nil
+}
+
+// Validate the payload of a rule request, normalizing the JIDs in it
+func (req *RuleRequest) validate() error {
+	if req.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if len(req.Actions) == 0 {
+		return fmt.Errorf("at least one action is required")
+	}
+
+	for i, chat := range req.Match.Chats {
+		jid, err := parseRecipientJID(chat)
+		if err != nil {
+			return fmt.Errorf("invalid chat: %v", err)
+		}
+		req.Match.Chats[i] = jid.String()
+	}
+	for i, sender := range req.Match.Senders {
+		jid, err := parseRecipientJID(sender)
+		if err != nil {
+			return fmt.Errorf("invalid sender: %v", err)
+		}
+		req.Match.Senders[i] = jid.String()
+	}
+	if err := req.Match.compile(); err != nil {
+		return fmt.Errorf("invalid content pattern: %v", err)
+	}
+	for i := range req.Match.TimeWindows {
+		if err := req.Match.TimeWindows[i].validate(); err != nil {
+			return err
+		}
+	}
+
+	for i := range req.Actions {
+		action := &req.Actions[i]
+		switch action.Type {
+		case ruleActionReply:
+			hasMedia := action.BucketName != "" && action.ObjectKey != ""
+			if action.Text == "" && !hasMedia {
+				return fmt.Errorf("reply actions need a text or an S3 object")
+			}
+		case ruleActionReact:
+			if action.Emoji == "" {
+				return fmt.Errorf("react actions need an emoji")
+			}
+		case ruleActionForward:
+			jid, err := parseRecipientJID(action.Recipient)
+			if err != nil {
+				return fmt.Errorf("invalid forward recipient: %v", err)
+			}
+			action.Recipient = jid.String()
+		case ruleActionWebhook:
+			if webhookURL, err := url.Parse(action.URL); err != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") {
+				return fmt.Errorf("webhook actions need an http or https URL")
+			}
+		case ruleActionStop:
+		default:
+			return fmt.Errorf("unknown action type %q", action.Type)
+		}
+	}
+	return nil
+}
+
+// Get the columns of a rule to store from a request
+func (req *RuleRequest) columns() (enabled bool, conditions, actions []byte, err error) {
+	enabled = req.Enabled == nil || *req.Enabled
+	if conditions, err = json.Marshal(req.Match); err != nil {
+		return false, nil, nil, err
+	}
+	if actions, err = json.Marshal(req.Actions); err != nil {
+		return false, nil, nil, err
+	}
+	return enabled, conditions, actions, nil
+}
+
+// Scan a rule selected with ruleColumns
+func scanRule(row rowScanner) (Rule, error) {
+	var rule Rule
+	var conditions, actions string
+	err := row.Scan(&rule.ID, &rule.Name, &rule.Enabled, &rule.Priority, &conditions, &actions, &rule.CreatedAt, &rule.UpdatedAt)
+	if err != nil {
+		return Rule{}, err
+	}
+	if err = json.Unmarshal([]byte(conditions), &rule.Match); err != nil {
+		return Rule{}, fmt.Errorf("invalid conditions of rule %d: %v", rule.ID, err)
+	}
+	if err = rule.Match.compile(); err != nil {
+		return Rule{}, fmt.Errorf("invalid content pattern of rule %d: %v", rule.ID, err)
+	}
+	if err = json.Unmarshal([]byte(actions), &rule.Actions); err != nil {
+		return Rule{}, fmt.Errorf("invalid actions of rule %d: %v", rule.ID, err)
+	}
+	return rule, nil
+}
+
+const ruleColumns = "id, name, enabled, priority, conditions, actions, created_at, updated_at"
+
+// Get the rules in evaluation order, optionally only the enabled ones
+func (store *MessageStore) getRules(enabledOnly bool) ([]Rule, error) {
+	query := "SELECT " + ruleColumns + " FROM rules"
+	if enabledOnly {
+		query += " WHERE enabled = TRUE"
+	}
+	rows, err := store.Db.Query(query + " ORDER BY priority, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []Rule{}
+	for rows.Next() {
+		rule, err := scanRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// Get a rule by ID
+func (store *MessageStore) getRule(id int64) (Rule, error) {
+	return scanRule(store.Db.QueryRow("SELECT "+ruleColumns+" FROM rules WHERE id = $1", id))
+}
+
+// Store a new rule
+func (store *MessageStore) createRule(req RuleRequest) (Rule, error) {
+	enabled, conditions, actions, err := req.columns()
+	if err != nil {
+		return Rule{}, err
+	}
+	now := time.Now()
+	return scanRule(store.Db.QueryRow(
+		`INSERT INTO rules (name, enabled, priority, conditions, actions, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $6)
+		RETURNING `+ruleColumns,
+		req.Name, enabled, req.Priority, string(conditions), string(actions), now,
+	))
+}
+
+// Replace a rule. Returns sql.ErrNoRows if it doesn't exist
+func (store *MessageStore) updateRule(id int64, req RuleRequest) (Rule, error) {
+	enabled, conditions, actions, err := req.columns()
+	if err != nil {
+		return Rule{}, err
+	}
+	return scanRule(store.Db.QueryRow(
+		`UPDATE rules SET name = $2, enabled = $3, priority = $4, conditions = $5, actions = $6, updated_at = $7
+		WHERE id = $1
+		RETURNING `+ruleColumns,
+		id, req.Name, enabled, req.Priority, string(conditions), string(actions), time.Now(),
+	))
+}
+
+// Delete a rule. Returns sql.ErrNoRows if it doesn't exist
+func (store *MessageStore) deleteRule(id int64) error {
+	result, err := store.Db.Exec("DELETE FROM rules WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Whether a message meets the conditions of a rule
+func (match *RuleMatch) matches(msg *events.Message, content string, mediaType string) bool {
+	if msg.Info.IsFromMe && !match.IncludeFromMe {
+		return false
+	}
+	if len(match.Chats) > 0 && !slices.Contains(match.Chats, msg.Info.Chat.String()) {
+		return false
+	}
+	if len(match.Senders) > 0 && !slices.Contains(match.Senders, msg.Info.Sender.ToNonAD().String()) &&
+		(msg.Info.SenderAlt.IsEmpty() || !slices.Contains(match.Senders, msg.Info.SenderAlt.ToNonAD().String())) {
+		return false
+	}
+	if match.IsGroup != nil && *match.IsGroup != msg.Info.IsGroup {
+		return false
+	}
+	if mediaType == "" {
+		mediaType = "text"
+	}
+	if len(match.MediaTypes) > 0 && !slices.Contains(match.MediaTypes, mediaType) {
+		return false
+	}
+	if match.Content != "" && (match.pattern == nil || !match.pattern.MatchString(content)) {
+		return false
+	}
+	if len(match.TimeWindows) > 0 && !slices.ContainsFunc(match.TimeWindows, func(window RuleTimeWindow) bool {
+		return window.contains(msg.Info.Timestamp)
+	}) {
+		return false
+	}
+	return true
+}
+
+// Post a matching message to a webhook
+func postRuleWebhook(ctx context.Context, webhookURL string, payload RuleWebhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, ruleWebhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Run an action of a rule on a matching message
+func runRuleAction(client *whatsmeow.Client, messageStore *MessageStore, s3Client *s3.Client, rule Rule, action RuleAction, msg *events.Message, stored StoredMessage) error {
+	ctx := context.Background()
+	switch action.Type {
+	case ruleActionReply:
+		req := SendMessageRequest{
+			Recipient:  msg.Info.Chat.String(),
+			Message:    action.Text,
+			BucketName: action.BucketName,
+			ObjectKey:  action.ObjectKey,
+		}
+		if action.Quote {
+			req.ReplyTo = msg.Info.ID
+		}
+		if success, message := sendWhatsAppMessage(client, messageStore, s3Client, msg.Info.Chat, req); !success {
+			return errors.New(message)
+		}
+	case ruleActionReact:
+		_, err := client.SendMessage(ctx, msg.Info.Chat, client.BuildReaction(msg.Info.Chat, msg.Info.Sender, msg.Info.ID, action.Emoji))
+		return err
+	case ruleActionForward:
+		recipientJID, err := types.ParseJID(action.Recipient)
+		if err != nil {
+			return err
+		}
+		_, err = client.SendMessage(ctx, recipientJID, buildForwardMessage(msg.Message))
+		return err
+	case ruleActionWebhook:
+		return postRuleWebhook(ctx, action.URL, RuleWebhookPayload{
+			RuleID:   rule.ID,
+			RuleName: rule.Name,
+			Message:  newMessageEnvelope(stored, "", msg.Info.PushName, extractContextInfo(msg.Message)),
+		})
+	}
+	return nil
+}
+
+// A message and the rules it matched, waiting for their actions to run
+type ruleJob struct {
+	msg    *events.Message
+	stored StoredMessage
+	rules  []Rule
+}
+
+var ruleJobs = make(chan ruleJob, ruleQueueSize)
+
+// Evaluate the enabled rules against an incoming message and queue the actions of the ones
+// it matches, in priority order, up to the first rule with a stop action. The actions are run
+// by RunRuleActions, as they send messages and call webhooks, which can't hold up event handling
+func applyRules(messageStore *MessageStore, msg *events.Message, stored StoredMessage, logger waLog.Logger) {
+	rules, err := messageStore.getRules(true)
+	if err != nil {
+		logger.Warnf("Failed to get rules: %v", err)
+		return
+	}
+
+	var matched []Rule
+	for _, rule := range rules {
+		if !rule.Match.matches(msg, stored.Content, stored.MediaType) {
+			continue
+		}
+		logger.Infof("Message %s matched rule %d (%s)", msg.Info.ID, rule.ID, rule.Name)
+		matched = append(matched, rule)
+		if slices.ContainsFunc(rule.Actions, func(action RuleAction) bool { return action.Type == ruleActionStop }) {
+			break
+		}
+	}
+	if len(matched) == 0 {
+		return
+	}
+
+	select {
+	case ruleJobs <- ruleJob{msg: msg, stored: stored, rules: matched}:
+	default:
+		logger.Warnf("Too many messages waiting for rule actions, skipping the actions for message %s", msg.Info.ID)
+	}
+}
+
+// Run the actions of the rules messages matched until ctx is cancelled, one message at a
+// time so replies go out in the order the messages came in
+func RunRuleActions(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, s3Client *s3.Client, logger waLog.Logger) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-ruleJobs:
+			for _, rule := range job.rules {
+				for _, action := range rule.Actions {
+					if action.Type == ruleActionStop {
+						continue
+					}
+					if err := runRuleAction(client, messageStore, s3Client, rule, action, job.msg, job.stored); err != nil {
+						logger.Warnf("Rule %d failed to %s message %s: %v", rule.ID, action.Type, job.msg.Info.ID, err)
+					}
+				}
+			}
+		}
+	}
+}
+
+func registerRuleRoutes(messageStore *MessageStore) {
+	// Parse the rule ID of a request, answering with an error if it's invalid
+	ruleID := func(w http.ResponseWriter, r *http.Request) (int64, bool) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid rule ID", http.StatusBadRequest)
+			return 0, false
+		}
+		return id, true
+	}
+
+	// Decode and validate a rule request, answering with an error if it's invalid
+	decodeRule := func(w http.ResponseWriter, r *http.Request) (RuleRequest, bool) {
+		var req RuleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return req, false
+		}
+		if err := req.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return req, false
+		}
+		return req, true
+	}
+
+	// List all rules in evaluation order
+	http.HandleFunc("GET /api/rules", func(w http.ResponseWriter, r *http.Request) {
+		rules, err := messageStore.getRules(false)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting rules: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, rules)
+	})
+
+	// Create a rule
+	http.HandleFunc("POST /api/rules", func(w http.ResponseWriter, r *http.Request) {
+		req, ok := decodeRule(w, r)
+		if !ok {
+			return
+		}
+		rule, err := messageStore.createRule(req)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error creating rule: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, rule)
+	})
+
+	// Get a rule
+	http.HandleFunc("GET /api/rules/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := ruleID(w, r)
+		if !ok {
+			return
+		}
+		rule, err := messageStore.getRule(id)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Rule not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting rule: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, rule)
+	})
+
+	// Replace a rule
+	http.HandleFunc("PUT /api/rules/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := ruleID(w, r)
+		if !ok {
+			return
+		}
+		req, ok := decodeRule(w, r)
+		if !ok {
+			return
+		}
+		rule, err := messageStore.updateRule(id, req)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Rule not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Error updating rule: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, rule)
+	})
+
+	// Delete a rule
+	http.HandleFunc("DELETE /api/rules/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := ruleID(w, r)
+		if !ok {
+			return
+		}
+		err := messageStore.deleteRule(id)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Rule not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Error deleting rule: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -3,6 +3,7 @@ package utils
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -12,11 +13,14 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
-	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/smithy-go"
 	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/proto/waE2E"
 )
 
+// Returned by uploadToS3 when the object key is already taken
+var errS3ObjectExists = errors.New("already exists")
+
 func downloadS3Object(ctx context.Context, s3Client *s3.Client, bucketName string, objectKey string) (audioBytes []byte, err error) {
 	// TODO: Implement S3 object download
 	// https://docs.aws.amazon.com/code-library/latest/ug/go_2_s3_code_examples.html#:r5d:-trigger
@@ -44,43 +48,27 @@ func downloadS3Object(ctx context.Context, s3Client *s3.Client, bucketName strin
 	return body, err
 }
 
+// Upload an object unless its key is already taken, in which case errS3ObjectExists is returned.
+// The check is a conditional write, so it costs nothing however many objects the bucket holds
 func uploadToS3(ctx context.Context, s3Client *s3.Client, bucketName string, objectKey string, mediaData []byte) error {
 	reader := bytes.NewReader(mediaData)
 
-	input := &s3.ListObjectsV2Input{
-		Bucket: aws.String(bucketName),
-	}
-	
-	objectPaginator := s3.NewListObjectsV2Paginator(s3Client, input)
-	for objectPaginator.HasMorePages() {
-		output, err := objectPaginator.NextPage(ctx)
-		if err != nil {
-			var noBucket *s3Types.NoSuchBucket
-			if errors.As(err, &noBucket) {
-				log.Printf("Bucket %s does not exist.\n", bucketName)
-				return noBucket
-			}
-			break
-		} else {
-			for _, object := range output.Contents {
-				if *object.Key == objectKey {
-					// Return early if object already exists
-					log.Printf("Object %s already exists in bucket %s. Skipping upload.\n", objectKey, bucketName)
-					return fmt.Errorf("object %s already exists", objectKey)
-				}
-			}
-		}
-	}
-
 	_, err := s3Client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: &bucketName,
-		Key:    &objectKey,
-		Body:   reader,
+		Bucket:      &bucketName,
+		Key:         &objectKey,
+		Body:        reader,
+		IfNoneMatch: aws.String("*"),
 	})
 
 	if err != nil {
 		var apiErr smithy.APIError
-		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "EntityTooLarge" {
+		// A conflict means another conditional write of the same key is in progress
+		if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "PreconditionFailed" || apiErr.ErrorCode() == "ConditionalRequestConflict") {
+			log.Printf("Object %s already exists in bucket %s. Skipping upload.\n", objectKey, bucketName)
+			return fmt.Errorf("object %s %w", objectKey, errS3ObjectExists)
+		} else if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchBucket" {
+			log.Printf("Bucket %s does not exist.\n", bucketName)
+		} else if errors.As(err, &apiErr) && apiErr.ErrorCode() == "EntityTooLarge" {
 			log.Printf("Error while uploading object to %s. The object is too large.\n"+
 				"To upload objects larger than 5GB, use the S3 console (160GB max)\n"+
 				"or the multipart upload API (5TB max).", bucketName)
@@ -88,6 +76,7 @@ func uploadToS3(ctx context.Context, s3Client *s3.Client, bucketName string, obj
 			log.Printf("Couldn't upload file to %v:%v. Here's why: %v\n",
 				bucketName, objectKey, err)
 		}
+		return err
 	}
 
 	err = s3.NewObjectExistsWaiter(s3Client).Wait(
@@ -99,34 +88,55 @@ func uploadToS3(ctx context.Context, s3Client *s3.Client, bucketName string, obj
 	return err
 }
 
-// Handle S3 upload for a WhatsApp message (text or media).
-// If both content and mediaType are provided, media upload takes precedence
-func uploadMessageToS3(client *whatsmeow.Client, s3Client *s3.Client, bucketName string, content string, messageID string, chatJID string, mediaType string, filename string, url string, mediaKey []byte, fileSHA256 []byte, fileEncSHA256 []byte, fileLength uint64) (filePath string, err error) {
+// Handle S3 upload for a WhatsApp message (text or media) and return the key of its raw
+// object. A versioned JSON envelope with the message details is written next to it, and both
+// keys come from S3_KEY_TEMPLATE. If the object already exists, its key is returned with errS3ObjectExists.
+// Expired media is asked of the phone again, waiting for it only if waitForMediaRetry is set
+func uploadMessageToS3(client *whatsmeow.Client, messageStore *MessageStore, s3Client *s3.Client, bucketName string, msg StoredMessage, pushName string, contextInfo *waProto.ContextInfo, waitForMediaRetry bool) (objectKey string, err error) {
 	// initialize variables
 	var mediaData []byte
 
-	if content == "" && mediaType == "" {
-		return "", fmt.Errorf("no content or media to upload for message %s", messageID)
+	if msg.Content == "" && msg.MediaType == "" {
+		return "", fmt.Errorf("no content or media to upload for message %s", msg.ID)
 	}
 
-	if content != "" {
-		mediaData = []byte(content)
+	if msg.Content != "" {
+		mediaData = []byte(msg.Content)
 	}
 	
-	if mediaType != "" {
-		mediaData, err = downloadWhatsAppMedia(client, messageID, chatJID, mediaType, url, mediaKey, fileSHA256, fileEncSHA256, fileLength)
+	if msg.MediaType != "" {
+		if waitForMediaRetry {
+			mediaData, err = downloadWhatsAppMediaWithRetry(client, messageStore, msg.ID, msg.ChatJID, msg.MediaInfo)
+		} else {
+			mediaData, err = downloadWhatsAppMediaOrRequestRetry(client, messageStore, msg)
+		}
 		if err != nil {
-			return "", fmt.Errorf("failed to download media for S3 upload: %v", err)
+			return "", fmt.Errorf("failed to download media for S3 upload: %w", err)
 		}
 	} 
 
-	objectKey := fmt.Sprintf("input/%s/%s", chatJID, filename)
+	template := s3KeyTemplate()
+	objectKey = renderS3Key(template, msg, messageObjectExtension(msg))
 
-	// upload to S3
-	err = uploadToS3(context.Background(), s3Client, bucketName, objectKey, mediaData)
+	// upload to S3. An existing object was left by an earlier attempt, which may have
+	// stopped before writing the envelope, so carry on with it
+	uploadErr := uploadToS3(context.Background(), s3Client, bucketName, objectKey, mediaData)
+	if uploadErr != nil && !errors.Is(uploadErr, errS3ObjectExists) {
+		return "", fmt.Errorf("failed to upload media to S3: %w", uploadErr)
+	}
+
+	envelope, err := json.MarshalIndent(newMessageEnvelope(msg, objectKey, pushName, contextInfo), "", "  ")
 	if err != nil {
-		return "", fmt.Errorf("failed to upload media to S3: %v", err)
+		return "", fmt.Errorf("failed to encode envelope: %v", err)
+	}
+	envelopeKey := renderS3Key(template, msg, "json")
+	err = uploadToS3(context.Background(), s3Client, bucketName, envelopeKey, envelope)
+	if err != nil && !errors.Is(err, errS3ObjectExists) {
+		return "", fmt.Errorf("failed to upload envelope to S3: %w", err)
 	}
 
-	return fmt.Sprintf("%s/%s", bucketName, objectKey), nil
+	if uploadErr != nil {
+		return objectKey, fmt.Errorf("failed to upload media to S3: %w", uploadErr)
+	}
+	return objectKey, nil
 }
\ No newline at end of file
@@ -0,0 +1,183 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.mau.fi/whatsmeow"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+const (
+	// Number of messages fetched per pass of the S3 backfill
+	s3BackfillBatchSize = 50
+	// Pause between uploads when S3_BACKFILL_DELAY is not set
+	defaultS3BackfillDelay = 2 * time.Second
+	// Pause before looking for more work once everything is archived, or after an error
+	s3BackfillIdleInterval = 5 * time.Minute
+	// A failed message is retried after this long, up to s3BackfillMaxAttempts times
+	s3BackfillRetryDelay  = time.Hour
+	s3BackfillMaxAttempts = 5
+)
+
+// Columns tracking which messages have been archived to S3, and the state of the backfill
+// of the ones that haven't
+const s3BackfillColumns = `
+	ALTER TABLE messages ADD COLUMN s3_key TEXT;
+	ALTER TABLE messages ADD COLUMN s3_backfill_attempts INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE messages ADD COLUMN s3_backfill_attempted_at TIMESTAMP;
+	ALTER TABLE messages ADD COLUMN s3_backfill_error TEXT;
+	ALTER TABLE messages ADD COLUMN media_retry_requested_at TIMESTAMP;
+	CREATE INDEX IF NOT EXISTS messages_s3_backfill_idx ON messages (timestamp) WHERE s3_key IS NULL;
+`
+
+// Whether the S3 backfill worker should run
+func s3BackfillEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("S3_BACKFILL_ENABLED"))
+	return enabled
+}
+
+// Get how long the S3 backfill waits between uploads
+func s3BackfillDelay() time.Duration {
+	delay, err := time.ParseDuration(os.Getenv("S3_BACKFILL_DELAY"))
+	if err != nil || delay < 0 {
+		return defaultS3BackfillDelay
+	}
+	return delay
+}
+
+// Get the messages that should be archived to S3 but have no object yet, newest first.
+// Like live messages, only text, captioned media, voice notes and stickers are archived, and
+// messages sent through the API are left out
+func (store *MessageStore) getS3BackfillItems(limit int) ([]StoredMessage, error) {
+	attemptedBefore := "s3_backfill_attempted_at < $2"
+	if store.dialect == dialectSQLite {
+		attemptedBefore = "julianday(s3_backfill_attempted_at) < julianday($2)"
+	}
+	rows, err := store.Db.Query(
+		`SELECT `+storedMessageSelect+`
+		FROM messages
+		WHERE s3_key IS NULL AND is_system = FALSE AND sent_via_api = FALSE AND s3_backfill_attempts < $1
+			AND (s3_backfill_attempted_at IS NULL OR `+attemptedBefore+`)
+			AND (media_type IN ('audio', 'sticker') OR COALESCE(content, '') <> '')
+		ORDER BY timestamp DESC, chat_jid, id
+		LIMIT $3`,
+		s3BackfillMaxAttempts, time.Now().Add(-s3BackfillRetryDelay), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []StoredMessage
+	for rows.Next() {
+		item, err := scanStoredMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// Record the S3 object a message was archived to
+func (store *MessageStore) setMessageS3Key(id, chatJID, objectKey string) error {
+	_, err := store.Db.Exec(
+		"UPDATE messages SET s3_key = $3, s3_backfill_error = NULL WHERE id = $1 AND chat_jid = $2",
+		id, chatJID, objectKey,
+	)
+	return err
+}
+
+// Record a failed attempt to archive a message to S3
+func (store *MessageStore) recordS3BackfillFailure(id, chatJID, reason string) error {
+	_, err := store.Db.Exec(
+		`UPDATE messages SET
+			s3_backfill_attempts = s3_backfill_attempts + 1,
+			s3_backfill_attempted_at = $3,
+			s3_backfill_error = $4
+		WHERE id = $1 AND chat_jid = $2`,
+		id, chatJID, time.Now(), reason,
+	)
+	return err
+}
+
+// Archive a single message to S3. Expired media is requested again from the phone while
+// uploading, and if it's re-uploaded too late for that, a later pass picks it up
+func backfillMessageToS3(client *whatsmeow.Client, messageStore *MessageStore, s3Client *s3.Client, bucketName string, msg StoredMessage) error {
+	// Push names and context info aren't stored, so the envelope goes without them
+	objectKey, err := uploadMessageToS3(client, messageStore, s3Client, bucketName, msg, "", nil, true)
+	if errors.Is(err, errS3ObjectExists) {
+		// Uploaded by an earlier pass that stopped before recording it
+		err = nil
+	}
+	if err != nil {
+		if recordErr := messageStore.recordS3BackfillFailure(msg.ID, msg.ChatJID, err.Error()); recordErr != nil {
+			return fmt.Errorf("%v (failed to record failure: %v)", err, recordErr)
+		}
+		return err
+	}
+
+	return messageStore.setMessageS3Key(msg.ID, msg.ChatJID, objectKey)
+}
+
+// Run the S3 backfill until ctx is cancelled. It archives the stored messages that never
+// reached the bucket, such as the ones imported by history syncs, one at a time with a pause
+// in between. Progress is kept on the message rows, so a restart picks up where it stopped.
+// Messages archived before object keys were recorded have none and are uploaded again
+func RunS3Backfill(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, s3Client *s3.Client, logger waLog.Logger) {
+	if !s3BackfillEnabled() {
+		return
+	}
+	bucketName := os.Getenv("AWS_S3_BUCKET_NAME")
+	delay := s3BackfillDelay()
+	logger.Infof("Starting S3 backfill to bucket %s", bucketName)
+
+	wait := func(d time.Duration) bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(d):
+			return true
+		}
+	}
+
+	for {
+		// Media can only be downloaded, and re-upload requested, while connected
+		if !client.IsConnected() {
+			if !wait(time.Minute) {
+				return
+			}
+			continue
+		}
+
+		items, err := messageStore.getS3BackfillItems(s3BackfillBatchSize)
+		if err != nil {
+			logger.Warnf("Failed to get messages for S3 backfill: %v", err)
+		}
+		if len(items) == 0 {
+			if !wait(s3BackfillIdleInterval) {
+				return
+			}
+			continue
+		}
+
+		archived := 0
+		for _, item := range items {
+			if err = backfillMessageToS3(client, messageStore, s3Client, bucketName, item); err != nil {
+				logger.Warnf("Failed to backfill message %s to S3: %v", item.ID, err)
+			} else {
+				archived++
+			}
+			if !wait(delay) {
+				return
+			}
+		}
+		logger.Infof("S3 backfill archived %d of %d messages", archived, len(items))
+	}
+}
@@ -0,0 +1,534 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/robfig/cron/v3"
+	"go.mau.fi/whatsmeow"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+const (
+	// How often the scheduler looks for schedules that are due
+	schedulerInterval = 10 * time.Second
+	// Number of due schedules handled per pass of the scheduler
+	schedulerBatchSize = 50
+	// A run is missed when it's overdue by more than this, e.g. because the server was down
+	scheduledMissedAfter = time.Minute
+)
+
+// Statuses of a schedule
+const (
+	scheduleActive    = "active"
+	schedulePaused    = "paused"
+	scheduleCancelled = "cancelled"
+	scheduleCompleted = "completed"
+	scheduleFailed    = "failed"
+)
+
+// What to do with a missed run: send it once, however many runs were missed, or skip it
+const (
+	missedRunOnce = "run_once"
+	missedRunSkip = "skip"
+)
+
+// Scheduled and recurring messages. The send payload is kept as JSON, as it's only ever
+// read whole when sending
+const scheduledMessagesTable = `
+	CREATE TABLE IF NOT EXISTS scheduled_messages (
+		id %s,
+		payload TEXT,
+		send_at TIMESTAMP,
+		cron_expression TEXT,
+		time_zone TEXT,
+		missed_run_policy TEXT,
+		status TEXT,
+		next_run_at TIMESTAMP,
+		last_run_at TIMESTAMP,
+		last_error TEXT,
+		run_count INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP,
+		updated_at TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS scheduled_messages_due_idx ON scheduled_messages (status, next_run_at);
+`
+
+// ScheduleRequest represents the request body for the schedule message API: a send
+// payload plus when to send it, either once at send_at or on a cron schedule
+type ScheduleRequest struct {
+	SendMessageRequest
+	SendAt *time.Time `json:"send_at,omitempty"`
+	// Standard five field cron expression or descriptor such as @daily
+	Cron string `json:"cron,omitempty"`
+	// IANA time zone the cron expression is evaluated in, defaults to UTC
+	TimeZone string `json:"time_zone,omitempty"`
+	// run_once (default) sends a missed run late, skip drops it
+	MissedRunPolicy string `json:"missed_run_policy,omitempty"`
+}
+
+// ScheduledMessage represents a scheduled or recurring message
+type ScheduledMessage struct {
+	ID              int64              `json:"id"`
+	Request         SendMessageRequest `json:"request"`
+	SendAt          *time.Time         `json:"send_at,omitempty"`
+	Cron            string             `json:"cron,omitempty"`
+	TimeZone        string             `json:"time_zone,omitempty"`
+	MissedRunPolicy string             `json:"missed_run_policy"`
+	Status          string             `json:"status"`
+	// Nil once the schedule has no more runs
+	NextRunAt *time.Time `json:"next_run_at,omitempty"`
+	LastRunAt *time.Time `json:"last_run_at,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	RunCount  int        `json:"run_count"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// Parse a cron expression evaluated in a time zone
+func parseCronSchedule(expression, timeZone string) (cron.Schedule, *time.Location, error) {
+	location, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid time zone %q", timeZone)
+	}
+	schedule, err := cron.ParseStandard(expression)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid cron expression: %v", err)
+	}
+	return schedule, location, nil
+}
+
+// Validate the payload of a schedule request
+func (req *ScheduleRequest) validate() error {
+	if req.Recipient == "" {
+		return fmt.Errorf("recipient is required")
+	}
+	if _, err := parseRecipientJID(req.Recipient); err != nil {
+		return err
+	}
+	if err := req.SendMessageRequest.validate(); err != nil {
+		return err
+	}
+
+	if (req.SendAt == nil) == (req.Cron == "") {
+		return fmt.Errorf("exactly one of send_at or cron is required")
+	}
+	if req.Cron != "" {
+		if _, _, err := parseCronSchedule(req.Cron, req.TimeZone); err != nil {
+			return err
+		}
+	} else if req.TimeZone != "" {
+		return fmt.Errorf("time_zone only applies to cron schedules")
+	}
+
+	switch req.MissedRunPolicy {
+	case "":
+		req.MissedRunPolicy = missedRunOnce
+	case missedRunOnce, missedRunSkip:
+	default:
+		return fmt.Errorf("missed_run_policy must be %s or %s", missedRunOnce, missedRunSkip)
+	}
+	return nil
+}
+
+// Get the first run of a schedule after a time, or nil if it has no more runs.
+// One-off schedules only run at their send time
+func (scheduled *ScheduledMessage) nextRunAfter(t time.Time) (*time.Time, error) {
+	if scheduled.Cron == "" {
+		return nil, nil
+	}
+	schedule, location, err := parseCronSchedule(scheduled.Cron, scheduled.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	next := schedule.Next(t.In(location))
+	if next.IsZero() {
+		return nil, nil
+	}
+	return &next, nil
+}
+
+const scheduledMessageColumns = `id, payload, send_at, COALESCE(cron_expression, ''), COALESCE(time_zone, ''), missed_run_policy,
+	status, next_run_at, last_run_at, COALESCE(last_error, ''), run_count, created_at, updated_at`
+
+// Scan a scheduled message selected with scheduledMessageColumns
+func scanScheduledMessage(row rowScanner) (ScheduledMessage, error) {
+	var scheduled ScheduledMessage
+	var payload string
+	var sendAt, nextRunAt, lastRunAt sql.NullTime
+	err := row.Scan(&scheduled.ID, &payload, &sendAt, &scheduled.Cron, &scheduled.TimeZone, &scheduled.MissedRunPolicy,
+		&scheduled.Status, &nextRunAt, &lastRunAt, &scheduled.LastError, &scheduled.RunCount, &scheduled.CreatedAt, &scheduled.UpdatedAt)
+	if err != nil {
+		return ScheduledMessage{}, err
+	}
+	if err = json.Unmarshal([]byte(payload), &scheduled.Request); err != nil {
+		return ScheduledMessage{}, fmt.Errorf("invalid payload of scheduled message %d: %v", scheduled.ID, err)
+	}
+	scheduled.SendAt = nullTimePointer(sendAt)
+	scheduled.NextRunAt = nullTimePointer(nextRunAt)
+	scheduled.LastRunAt = nullTimePointer(lastRunAt)
+	return scheduled, nil
+}
+
+// Get a nullable time column as a pointer, nil when NULL
+func nullTimePointer(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// Store a new schedule, with its first run
+func (store *MessageStore) createScheduledMessage(req ScheduleRequest) (ScheduledMessage, error) {
+	payload, err := json.Marshal(req.SendMessageRequest)
+	if err != nil {
+		return ScheduledMessage{}, err
+	}
+
+	scheduled := ScheduledMessage{SendAt: req.SendAt, Cron: req.Cron, TimeZone: req.TimeZone}
+	nextRunAt := req.SendAt
+	if req.Cron != "" {
+		if nextRunAt, err = scheduled.nextRunAfter(time.Now()); err != nil {
+			return ScheduledMessage{}, err
+		}
+	}
+	status := scheduleActive
+	if nextRunAt == nil {
+		status = scheduleCompleted
+	}
+
+	now := time.Now()
+	return scanScheduledMessage(store.Db.QueryRow(
+		`INSERT INTO scheduled_messages (payload, send_at, cron_expression, time_zone, missed_run_policy, status, next_run_at, created_at, updated_at)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), $5, $6, $7, $8, $8)
+		RETURNING `+scheduledMessageColumns,
+		string(payload), req.SendAt, req.Cron, req.TimeZone, req.MissedRunPolicy, status, nextRunAt, now,
+	))
+}
+
+// Get the schedules, newest first, optionally only the ones with a status
+func (store *MessageStore) getScheduledMessages(status string) ([]ScheduledMessage, error) {
+	query := "SELECT " + scheduledMessageColumns + " FROM scheduled_messages"
+	args := []interface{}{}
+	if status != "" {
+		query += " WHERE status = $1"
+		args = append(args, status)
+	}
+	rows, err := store.Db.Query(query+" ORDER BY created_at DESC, id DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules := []ScheduledMessage{}
+	for rows.Next() {
+		scheduled, err := scanScheduledMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, scheduled)
+	}
+	return schedules, rows.Err()
+}
+
+// Get a schedule by ID
+func (store *MessageStore) getScheduledMessage(id int64) (ScheduledMessage, error) {
+	return scanScheduledMessage(store.Db.QueryRow("SELECT "+scheduledMessageColumns+" FROM scheduled_messages WHERE id = $1", id))
+}
+
+// Get the active schedules whose next run is due, oldest first
+func (store *MessageStore) getDueScheduledMessages(now time.Time, limit int) ([]ScheduledMessage, error) {
+	due := "next_run_at <= $2"
+	if store.dialect == dialectSQLite {
+		due = "julianday(next_run_at) <= julianday($2)"
+	}
+	rows, err := store.Db.Query(
+		`SELECT `+scheduledMessageColumns+`
+		FROM scheduled_messages
+		WHERE status = $1 AND `+due+`
+		ORDER BY next_run_at, id
+		LIMIT $3`,
+		scheduleActive, now, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var schedules []ScheduledMessage
+	for rows.Next() {
+		scheduled, err := scanScheduledMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, scheduled)
+	}
+	return schedules, rows.Err()
+}
+
+// Move a schedule from one status to another, setting its next run.
+// Returns sql.ErrNoRows if it doesn't exist or isn't in the expected status
+func (store *MessageStore) setScheduledMessageStatus(id int64, from, to string, nextRunAt *time.Time) (ScheduledMessage, error) {
+	return scanScheduledMessage(store.Db.QueryRow(
+		`UPDATE scheduled_messages SET status = $3, next_run_at = $4, updated_at = $5
+		WHERE id = $1 AND status = $2
+		RETURNING `+scheduledMessageColumns,
+		id, from, to, nextRunAt, time.Now(),
+	))
+}
+
+// Claim the due run of a schedule by moving it on to its next run. Returns false if another
+// instance claimed it first, or it was paused or cancelled in the meantime
+func (store *MessageStore) claimScheduledRun(scheduled ScheduledMessage, status string, nextRunAt *time.Time) (bool, error) {
+	sameRun := "next_run_at = $3"
+	if store.dialect == dialectSQLite {
+		sameRun = "julianday(next_run_at) = julianday($3)"
+	}
+	result, err := store.Db.Exec(
+		`UPDATE scheduled_messages SET status = $4, next_run_at = $5, updated_at = $6
+		WHERE id = $1 AND status = $2 AND `+sameRun,
+		scheduled.ID, scheduleActive, *scheduled.NextRunAt, status, nextRunAt, time.Now(),
+	)
+	if err != nil {
+		return false, err
+	}
+	claimed, err := result.RowsAffected()
+	return claimed > 0, err
+}
+
+// Record the outcome of a run of a schedule. One-off schedules whose run failed are marked as failed
+func (store *MessageStore) recordScheduledRun(scheduled ScheduledMessage, runErr error) error {
+	var lastError *string
+	if runErr != nil {
+		reason := runErr.Error()
+		lastError = &reason
+	}
+	now := time.Now()
+	_, err := store.Db.Exec(
+		`UPDATE scheduled_messages SET last_run_at = $2, last_error = $3, run_count = run_count + 1, updated_at = $2
+		WHERE id = $1`,
+		scheduled.ID, now, lastError,
+	)
+	if err != nil || runErr == nil || scheduled.Cron != "" {
+		return err
+	}
+	_, err = store.Db.Exec("UPDATE scheduled_messages SET status = $2 WHERE id = $1 AND status = $3",
+		scheduled.ID, scheduleFailed, scheduleCompleted)
+	return err
+}
+
+// Send a scheduled message
+func sendScheduledMessage(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, s3Client *s3.Client, req SendMessageRequest) error {
+	recipientJID, err := resolveRecipient(ctx, client, messageStore, req.Recipient, shouldVerifyRecipient(req.Verify))
+	if err != nil {
+		return err
+	}
+	// Templates are rendered at send time, so each run gets the current template and names
+	if req.TemplateID != 0 {
+		if err = renderTemplateRequest(messageStore, &req, recipientJID); errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("template %d not found", req.TemplateID)
+		} else if err != nil {
+			return err
+		}
+	}
+	if success, message := sendWhatsAppMessage(client, messageStore, s3Client, recipientJID, req); !success {
+		return errors.New(message)
+	}
+	return nil
+}
+
+// Handle a due run of a schedule: claim it, move the schedule on to its next run and send
+// the message, unless the run was missed and the schedule skips missed runs
+func runScheduledMessage(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, s3Client *s3.Client, scheduled ScheduledMessage, logger waLog.Logger) {
+	now := time.Now()
+	missed := now.Sub(*scheduled.NextRunAt) > scheduledMissedAfter
+
+	// Recurring schedules continue from now, so however many runs were missed, at most one is sent
+	nextRunAt, err := scheduled.nextRunAfter(now)
+	if err != nil {
+		logger.Warnf("Failed to get next run of scheduled message %d: %v", scheduled.ID, err)
+		return
+	}
+	status := scheduleActive
+	if nextRunAt == nil {
+		status = scheduleCompleted
+	}
+
+	claimed, err := messageStore.claimScheduledRun(scheduled, status, nextRunAt)
+	if err != nil {
+		logger.Warnf("Failed to claim run of scheduled message %d: %v", scheduled.ID, err)
+		return
+	} else if !claimed {
+		return
+	}
+
+	if missed && scheduled.MissedRunPolicy == missedRunSkip {
+		logger.Infof("Skipped missed run of scheduled message %d due at %s", scheduled.ID, scheduled.NextRunAt.Format(time.RFC3339))
+		return
+	}
+
+	err = sendScheduledMessage(ctx, client, messageStore, s3Client, scheduled.Request)
+	if err != nil {
+		logger.Warnf("Failed to send scheduled message %d: %v", scheduled.ID, err)
+	} else {
+		logger.Infof("Sent scheduled message %d to %s", scheduled.ID, scheduled.Request.Recipient)
+	}
+	if err = messageStore.recordScheduledRun(scheduled, err); err != nil {
+		logger.Warnf("Failed to record run of scheduled message %d: %v", scheduled.ID, err)
+	}
+}
+
+// Run the scheduler until ctx is cancelled. Schedules and their next runs are stored, so
+// runs that fall due while the server is down are handled on start, according to the
+// missed run policy of their schedule
+func RunScheduler(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, s3Client *s3.Client, logger waLog.Logger) {
+	for {
+		// Runs that fall due while disconnected are handled once reconnected
+		if client.IsConnected() {
+			schedules, err := messageStore.getDueScheduledMessages(time.Now(), schedulerBatchSize)
+			if err != nil {
+				logger.Warnf("Failed to get due scheduled messages: %v", err)
+			}
+			for _, scheduled := range schedules {
+				runScheduledMessage(ctx, client, messageStore, s3Client, scheduled, logger)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(schedulerInterval):
+		}
+	}
+}
+
+func registerScheduledRoutes(messageStore *MessageStore) {
+	// Parse the schedule ID of a request, answering with an error if it's invalid
+	scheduleID := func(w http.ResponseWriter, r *http.Request) (int64, bool) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid schedule ID", http.StatusBadRequest)
+			return 0, false
+		}
+		return id, true
+	}
+
+	// Answer a status change of a schedule, telling apart missing schedules from ones in another status
+	writeStatusChange := func(w http.ResponseWriter, id int64, scheduled ScheduledMessage, err error, conflict string) {
+		if errors.Is(err, sql.ErrNoRows) {
+			if _, err = messageStore.getScheduledMessage(id); errors.Is(err, sql.ErrNoRows) {
+				http.Error(w, "Scheduled message not found", http.StatusNotFound)
+			} else {
+				http.Error(w, conflict, http.StatusConflict)
+			}
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Error updating scheduled message: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, scheduled)
+	}
+
+	// Schedule a message to be sent once or on a cron schedule
+	http.HandleFunc("POST /api/scheduled", func(w http.ResponseWriter, r *http.Request) {
+		var req ScheduleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		if err := req.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		scheduled, err := messageStore.createScheduledMessage(req)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error scheduling message: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, scheduled)
+	})
+
+	// List scheduled messages, optionally only the ones with a ?status=
+	http.HandleFunc("GET /api/scheduled", func(w http.ResponseWriter, r *http.Request) {
+		schedules, err := messageStore.getScheduledMessages(r.URL.Query().Get("status"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting scheduled messages: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, schedules)
+	})
+
+	// Get a scheduled message
+	http.HandleFunc("GET /api/scheduled/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := scheduleID(w, r)
+		if !ok {
+			return
+		}
+		scheduled, err := messageStore.getScheduledMessage(id)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Scheduled message not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting scheduled message: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, scheduled)
+	})
+
+	// Pause an active schedule
+	http.HandleFunc("POST /api/scheduled/{id}/pause", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := scheduleID(w, r)
+		if !ok {
+			return
+		}
+		scheduled, err := messageStore.getScheduledMessage(id)
+		if err == nil {
+			scheduled, err = messageStore.setScheduledMessageStatus(id, scheduleActive, schedulePaused, scheduled.NextRunAt)
+		}
+		writeStatusChange(w, id, scheduled, err, "Only active schedules can be paused")
+	})
+
+	// Resume a paused schedule. Recurring schedules continue from their next run after now,
+	// and one-off ones whose time has passed are handled as missed
+	http.HandleFunc("POST /api/scheduled/{id}/resume", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := scheduleID(w, r)
+		if !ok {
+			return
+		}
+		scheduled, err := messageStore.getScheduledMessage(id)
+		if err == nil && scheduled.Cron != "" {
+			scheduled.NextRunAt, err = scheduled.nextRunAfter(time.Now())
+		}
+		if err == nil {
+			scheduled, err = messageStore.setScheduledMessageStatus(id, schedulePaused, scheduleActive, scheduled.NextRunAt)
+		}
+		writeStatusChange(w, id, scheduled, err, "Only paused schedules can be resumed")
+	})
+
+	// Cancel a schedule. It's kept, with its history, as cancelled
+	http.HandleFunc("DELETE /api/scheduled/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := scheduleID(w, r)
+		if !ok {
+			return
+		}
+		scheduled, err := messageStore.getScheduledMessage(id)
+		if err == nil {
+			switch scheduled.Status {
+			case scheduleActive, schedulePaused:
+				scheduled, err = messageStore.setScheduledMessageStatus(id, scheduled.Status, scheduleCancelled, nil)
+			default:
+				err = sql.ErrNoRows
+			}
+		}
+		writeStatusChange(w, id, scheduled, err, "Only active or paused schedules can be cancelled")
+	})
+}
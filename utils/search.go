@@ -0,0 +1,301 @@
+package utils
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Text search configuration used when SEARCH_LANGUAGE is not set
+	defaultSearchLanguage = "english"
+	// Markers wrapped around matched terms in search snippets
+	searchHighlightStart = "<mark>"
+	searchHighlightStop  = "</mark>"
+)
+
+// Text search configuration names are plain identifiers, e.g. "english" or "portuguese"
+var searchLanguagePattern = regexp.MustCompile(`^[a-z_]+$`)
+
+// SearchMessagesRequest represents the filters of a message search
+type SearchMessagesRequest struct {
+	Query     string
+	ChatJID   string
+	Sender    string
+	MediaType string
+	From      time.Time
+	To        time.Time
+	Cursor    *searchCursor
+	Limit     int
+}
+
+// SearchResult represents a single message matching a search
+type SearchResult struct {
+	ID        string    `json:"id"`
+	ChatJID   string    `json:"chat_jid"`
+	ChatName  string    `json:"chat_name,omitempty"`
+	Sender    string    `json:"sender"`
+	Content   string    `json:"content"`
+	Snippet   string    `json:"snippet"`
+	Timestamp time.Time `json:"timestamp"`
+	IsFromMe  bool      `json:"is_from_me"`
+	MediaType string    `json:"media_type,omitempty"`
+	Rank      float64   `json:"rank"`
+}
+
+// SearchResponse represents the response for the search API
+type SearchResponse struct {
+	Results    []SearchResult `json:"results"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// Position of the last result of a search page. Results are ordered newest first,
+// so the next page continues with messages that sort after this one
+type searchCursor struct {
+	Timestamp time.Time
+	ChatJID   string
+	ID        string
+}
+
+// Encode a cursor as an opaque URL-safe token. The timestamp keeps the offset it was read
+// with, so it compares equal to the stored value in both Postgres and SQLite
+func (cursor searchCursor) encode() string {
+	raw := cursor.Timestamp.Format(time.RFC3339Nano) + "|" + cursor.ChatJID + "|" + cursor.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// Decode a cursor token returned by a previous search
+func decodeSearchCursor(token string) (*searchCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	parts := strings.SplitN(string(raw), "|", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &searchCursor{Timestamp: timestamp, ChatJID: parts[1], ID: parts[2]}, nil
+}
+
+// Get the text search configuration used to index and query message content.
+// The index is built with this configuration when the column is created, so changing
+// it later requires dropping the content_tsv column to rebuild it
+func searchLanguage() string {
+	language := strings.ToLower(strings.TrimSpace(os.Getenv("SEARCH_LANGUAGE")))
+	if !searchLanguagePattern.MatchString(language) {
+		return defaultSearchLanguage
+	}
+	return language
+}
+
+// Schema for full-text search: a generated tsvector column kept up to date by Postgres
+// on every insert and update of a message, and a GIN index over it
+func searchSchema() string {
+	return fmt.Sprintf(`
+		ALTER TABLE messages ADD COLUMN IF NOT EXISTS content_tsv TSVECTOR
+			GENERATED ALWAYS AS (to_tsvector('%s'::regconfig, COALESCE(content, ''))) STORED;
+		CREATE INDEX IF NOT EXISTS messages_content_tsv_idx ON messages USING GIN (content_tsv);
+	`, searchLanguage())
+}
+
+// Schema for full-text search on SQLite: an FTS5 index over message content, kept up to
+// date by triggers on the messages table and built from the existing messages
+const sqliteSearchSchema = `
+	CREATE VIRTUAL TABLE messages_fts USING fts5(
+		content, content='messages', content_rowid='rowid', tokenize='unicode61 remove_diacritics 2'
+	);
+	CREATE TRIGGER messages_fts_insert AFTER INSERT ON messages BEGIN
+		INSERT INTO messages_fts (rowid, content) VALUES (new.rowid, new.content);
+	END;
+	CREATE TRIGGER messages_fts_delete AFTER DELETE ON messages BEGIN
+		INSERT INTO messages_fts (messages_fts, rowid, content) VALUES ('delete', old.rowid, old.content);
+	END;
+	CREATE TRIGGER messages_fts_update AFTER UPDATE OF content ON messages BEGIN
+		INSERT INTO messages_fts (messages_fts, rowid, content) VALUES ('delete', old.rowid, old.content);
+		INSERT INTO messages_fts (rowid, content) VALUES (new.rowid, new.content);
+	END;
+	INSERT INTO messages_fts (messages_fts) VALUES ('rebuild');
+`
+
+// Turn a search query into an FTS5 query matching all of its words. Each word is quoted
+// so characters with a meaning in the FTS5 query syntax are matched literally
+func sqliteSearchQuery(query string) string {
+	words := strings.Fields(query)
+	for i, word := range words {
+		words[i] = `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+	}
+	return strings.Join(words, " ")
+}
+
+// Search message content, newest first, with highlighted snippets of the matches
+func (store *MessageStore) searchMessages(req SearchMessagesRequest) (*SearchResponse, error) {
+	var args []interface{}
+	var conditions []string
+	var from, snippet, rank string
+	if store.dialect == dialectSQLite {
+		args = []interface{}{sqliteSearchQuery(req.Query)}
+		conditions = []string{"messages_fts MATCH $1"}
+		from = "messages_fts JOIN messages m ON m.rowid = messages_fts.rowid"
+		snippet = fmt.Sprintf("snippet(messages_fts, 0, '%s', '%s', '...', 20)", searchHighlightStart, searchHighlightStop)
+		// bm25 scores better matches lower
+		rank = "-bm25(messages_fts)"
+	} else {
+		args = []interface{}{searchLanguage(), req.Query}
+		conditions = []string{"m.content_tsv @@ websearch_to_tsquery($1::regconfig, $2)"}
+		from = "messages m"
+		snippet = fmt.Sprintf(
+			"ts_headline($1::regconfig, COALESCE(m.content, ''), websearch_to_tsquery($1::regconfig, $2), "+
+				"'StartSel=%s, StopSel=%s, MaxFragments=2, MaxWords=20, MinWords=5')",
+			searchHighlightStart, searchHighlightStop,
+		)
+		rank = "ts_rank(m.content_tsv, websearch_to_tsquery($1::regconfig, $2))"
+	}
+	addCondition := func(condition string, values ...interface{}) {
+		for _, value := range values {
+			args = append(args, value)
+			condition = strings.Replace(condition, "?", fmt.Sprintf("$%d", len(args)), 1)
+		}
+		conditions = append(conditions, condition)
+	}
+
+	if req.ChatJID != "" {
+		addCondition("m.chat_jid = ?", req.ChatJID)
+	}
+	if req.Sender != "" {
+		addCondition("m.sender = ?", req.Sender)
+	}
+	if req.MediaType != "" {
+		addCondition("m.media_type = ?", req.MediaType)
+	}
+	// SQLite stores timestamps as text with the offset they were written with, so compare and
+	// order them as times, both in the date range and in the cursor
+	timestampColumn, timeParam := "m.timestamp", "?"
+	if store.dialect == dialectSQLite {
+		timestampColumn, timeParam = "julianday(m.timestamp)", "julianday(?)"
+	}
+	if !req.From.IsZero() {
+		addCondition(timestampColumn+" >= "+timeParam, req.From)
+	}
+	if !req.To.IsZero() {
+		addCondition(timestampColumn+" < "+timeParam, req.To)
+	}
+	if req.Cursor != nil {
+		addCondition("("+timestampColumn+", m.chat_jid, m.id) < ("+timeParam+", ?, ?)", req.Cursor.Timestamp, req.Cursor.ChatJID, req.Cursor.ID)
+	}
+
+	// Fetch one extra row to know whether there's a next page
+	args = append(args, req.Limit+1)
+	query := fmt.Sprintf(
+		`SELECT m.id, m.chat_jid, COALESCE(c.name, ''), COALESCE(m.sender, ''), COALESCE(m.content, ''),
+			%s, m.timestamp, COALESCE(m.is_from_me, FALSE), COALESCE(m.media_type, ''), %s
+		FROM %s
+		LEFT JOIN chats c ON c.jid = m.chat_jid
+		WHERE %s
+		ORDER BY %s DESC, m.chat_jid DESC, m.id DESC
+		LIMIT $%d`,
+		snippet, rank, from, strings.Join(conditions, " AND "), timestampColumn, len(args),
+	)
+
+	rows, err := store.Db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	response := &SearchResponse{Results: []SearchResult{}}
+	for rows.Next() {
+		var result SearchResult
+		err = rows.Scan(&result.ID, &result.ChatJID, &result.ChatName, &result.Sender, &result.Content,
+			&result.Snippet, &result.Timestamp, &result.IsFromMe, &result.MediaType, &result.Rank)
+		if err != nil {
+			return nil, err
+		}
+		response.Results = append(response.Results, result)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(response.Results) > req.Limit {
+		response.Results = response.Results[:req.Limit]
+		last := response.Results[len(response.Results)-1]
+		response.NextCursor = searchCursor{Timestamp: last.Timestamp, ChatJID: last.ChatJID, ID: last.ID}.encode()
+	}
+	return response, nil
+}
+
+// Parse a date range bound given either as RFC 3339 or as a plain date
+func parseSearchTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+func registerSearchRoutes(messageStore MessageRepository) {
+	// Search stored messages, e.g. /api/search?q=invoice&chat=...&sender=...&from=2024-01-01&to=2024-02-01&media_type=audio
+	http.HandleFunc("GET /api/search", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		req := SearchMessagesRequest{
+			Query:     strings.TrimSpace(query.Get("q")),
+			ChatJID:   query.Get("chat"),
+			Sender:    query.Get("sender"),
+			MediaType: query.Get("media_type"),
+			Limit:     20,
+		}
+		if req.Query == "" {
+			http.Error(w, "Search query is required", http.StatusBadRequest)
+			return
+		}
+		if value := query.Get("limit"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 || parsed > 100 {
+				http.Error(w, "Limit must be between 1 and 100", http.StatusBadRequest)
+				return
+			}
+			req.Limit = parsed
+		}
+		if value := query.Get("from"); value != "" {
+			from, err := parseSearchTime(value)
+			if err != nil {
+				http.Error(w, "From must be a date (YYYY-MM-DD) or an RFC 3339 timestamp", http.StatusBadRequest)
+				return
+			}
+			req.From = from
+		}
+		if value := query.Get("to"); value != "" {
+			to, err := parseSearchTime(value)
+			if err != nil {
+				http.Error(w, "To must be a date (YYYY-MM-DD) or an RFC 3339 timestamp", http.StatusBadRequest)
+				return
+			}
+			req.To = to
+		}
+		if value := query.Get("cursor"); value != "" {
+			cursor, err := decodeSearchCursor(value)
+			if err != nil {
+				http.Error(w, "Invalid cursor", http.StatusBadRequest)
+				return
+			}
+			req.Cursor = cursor
+		}
+
+		results, err := messageStore.searchMessages(req)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error searching messages: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, results)
+	})
+}
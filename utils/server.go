@@ -1,7 +1,10 @@
 package utils
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -15,6 +18,28 @@ type SendMessageRequest struct {
 	Message   string `json:"message"`
 	BucketName string `json:"bucket_name,omitempty"`
 	ObjectKey string `json:"object_key,omitempty"`
+	// Send a location pin instead of text or media
+	Location *LocationPayload `json:"location,omitempty"`
+	// Send one or more contact cards instead of text or media
+	Contacts []ContactCardPayload `json:"contacts,omitempty"`
+	// Send the media (PNG, JPEG or GIF) as a sticker
+	Sticker bool `json:"sticker,omitempty"`
+	// Generate a preview for the first link in a text message
+	LinkPreview bool `json:"link_preview,omitempty"`
+	// Check that a phone number recipient is on WhatsApp before sending.
+	// Defaults to the VERIFY_RECIPIENTS setting
+	Verify *bool `json:"verify,omitempty"`
+	// ID of a message in the recipient's chat to quote, sending this one as a reply
+	ReplyTo string `json:"reply_to,omitempty"`
+	// Template to render the message from, see /api/templates, with the values of its
+	// placeholders and the language variant to use, which defaults to the template's language
+	TemplateID int64             `json:"template_id,omitempty"`
+	Variables  map[string]string `json:"variables,omitempty"`
+	Language   string            `json:"language,omitempty"`
+
+	// Media already read by the caller, sent instead of downloading ObjectKey from S3.
+	// ObjectKey still names the media
+	media []byte
 }
 
 // SendMessageResponse represents the response for the send message API
@@ -23,8 +48,58 @@ type SendMessageResponse struct {
 	Message string `json:"message"`
 }
 
+// Validate the payload of a send message request
+func (req *SendMessageRequest) validate() error {
+	hasMedia := req.BucketName != "" && req.ObjectKey != ""
 
-func StartRESTServer(client *whatsmeow.Client, port string, s3Client *s3.Client) {
+	payloads := 0
+	for _, present := range []bool{hasMedia, req.Location != nil, len(req.Contacts) > 0} {
+		if present {
+			payloads++
+		}
+	}
+	if payloads > 1 {
+		return fmt.Errorf("only one of media, location or contacts can be sent at once")
+	}
+	if req.TemplateID != 0 && (req.Message != "" || req.Location != nil || len(req.Contacts) > 0) {
+		return fmt.Errorf("a template can't be combined with a message, location or contacts")
+	}
+	if req.Message == "" && payloads == 0 && req.TemplateID == 0 {
+		return fmt.Errorf("message, media path, location, contacts or template is required")
+	}
+	if req.Sticker && !hasMedia {
+		return fmt.Errorf("sending a sticker requires a media path")
+	}
+
+	if req.Location != nil {
+		if err := req.Location.validate(); err != nil {
+			return err
+		}
+	}
+	for i := range req.Contacts {
+		if err := req.Contacts[i].validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the media of a send request, downloading it from S3 unless the caller already read it
+func (req *SendMessageRequest) readMedia(ctx context.Context, s3Client *s3.Client) ([]byte, error) {
+	if req.media != nil {
+		return req.media, nil
+	}
+	return downloadS3Object(ctx, s3Client, req.BucketName, req.ObjectKey)
+}
+
+// writeJSON writes v as a JSON response body with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func StartRESTServer(client *whatsmeow.Client, messageStore *MessageStore, port string, s3Client *s3.Client) {
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Hello World!")
 	})
@@ -57,15 +132,40 @@ func StartRESTServer(client *whatsmeow.Client, port string, s3Client *s3.Client)
 			return
 		}
 
-		if req.Message == "" && (req.BucketName == "" || req.ObjectKey == "") {
-			http.Error(w, "Message or media path is required", http.StatusBadRequest)
+		if err := req.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
 		fmt.Println("Received request to send message", req.Message, req.BucketName, req.ObjectKey)
 
+		// Normalize and optionally verify the recipient
+		recipientJID, err := resolveRecipient(r.Context(), client, messageStore, req.Recipient, shouldVerifyRecipient(req.Verify))
+		if errors.Is(err, errInvalidRecipient) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Render the template the message is based on
+		if req.TemplateID != 0 {
+			err = renderTemplateRequest(messageStore, &req, recipientJID)
+			if errors.Is(err, sql.ErrNoRows) {
+				http.Error(w, "Template not found", http.StatusNotFound)
+				return
+			} else if errors.Is(err, errMissingTemplateVariables) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			} else if err != nil {
+				http.Error(w, fmt.Sprintf("Error rendering template: %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
+
 		// Send the message
-		success, message := sendWhatsAppMessage(client, s3Client, req.Recipient, req.Message, req.BucketName, req.ObjectKey)
+		success, message := sendWhatsAppMessage(client, messageStore, s3Client, recipientJID, req)
 		fmt.Printf("Message sent: success=%v, message=%s\n", success, message)
 		// Set response headers
 		w.Header().Set("Content-Type", "application/json")
@@ -82,6 +182,42 @@ func StartRESTServer(client *whatsmeow.Client, port string, s3Client *s3.Client)
 		})
 	})
 
+	// Group management endpoints
+	registerGroupRoutes(client, messageStore, s3Client)
+
+	// Contact directory endpoints
+	registerContactRoutes(client, messageStore)
+
+	// Poll endpoints
+	registerPollRoutes(client, messageStore)
+
+	// Message search endpoints
+	registerSearchRoutes(messageStore)
+
+	// History sync endpoints
+	registerHistorySyncRoutes(client, messageStore)
+
+	// Media endpoints
+	registerMediaRoutes(client, messageStore)
+
+	// Auto-responder rule endpoints
+	registerRuleRoutes(messageStore)
+
+	// Scheduled message endpoints
+	registerScheduledRoutes(messageStore)
+
+	// Message template endpoints
+	registerTemplateRoutes(messageStore)
+
+	// Broadcast endpoints
+	registerBroadcastRoutes(messageStore)
+
+	// Message forwarding endpoints
+	registerForwardRoutes(client, messageStore, s3Client)
+
+	// Message revoke and edit endpoints
+	registerMessageChangeRoutes(client, messageStore)
+
 	http.ListenAndServe(":"+port, nil)
 }
 
@@ -0,0 +1,226 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image/gif"
+	"os"
+	"strings"
+	"time"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// WhatsApp stickers are always 512x512 WebP images
+const stickerSize = 512
+
+// Sticker pack metadata embedded in the EXIF chunk of a sticker, shown by WhatsApp in the sticker info
+type stickerMetadata struct {
+	PackID    string   `json:"sticker-pack-id"`
+	PackName  string   `json:"sticker-pack-name"`
+	Publisher string   `json:"sticker-pack-publisher"`
+	Emojis    []string `json:"emojis,omitempty"`
+}
+
+// Get the sticker pack name and publisher embedded in sent stickers
+func stickerPackInfo() (packName string, publisher string) {
+	packName = os.Getenv("STICKER_PACK_NAME")
+	publisher = os.Getenv("STICKER_PACK_PUBLISHER")
+	if packName == "" {
+		packName = "WhatsApp Server"
+	}
+	return packName, publisher
+}
+
+// Check whether a GIF has more than one frame
+func isAnimatedGIF(data []byte) bool {
+	animation, err := gif.DecodeAll(bytes.NewReader(data))
+	return err == nil && len(animation.Image) > 1
+}
+
+// Convert a PNG, JPEG or GIF image into a 512x512 WebP sticker using ffmpeg.
+// The image is scaled to fit and padded with transparency. Animated GIFs become animated stickers
+func convertImageToSticker(inputMediaData []byte, objectKey string) (stickerData []byte, isAnimated bool, err error) {
+	fileExt := strings.ToLower(objectKey[strings.LastIndex(objectKey, ".")+1:])
+	switch fileExt {
+	case "png", "jpg", "jpeg":
+	case "gif":
+		isAnimated = isAnimatedGIF(inputMediaData)
+	default:
+		return nil, false, fmt.Errorf("unsupported sticker source format: %s", fileExt)
+	}
+
+	tempInputFolderPath := "temp/input"
+	tempOutputFolderPath := "temp/output"
+	tempInputFilePath := fmt.Sprintf("%s/%d_%s", tempInputFolderPath, time.Now().UnixNano(), objectKey[strings.LastIndex(objectKey, "/")+1:])
+	tempOutputFilePath := fmt.Sprintf("%s/%d_%s", tempOutputFolderPath, time.Now().UnixNano(), "sticker.webp")
+
+	// create temporary folders
+	err = os.MkdirAll(tempInputFolderPath, os.ModePerm)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create temp input directory: %v", err)
+	}
+	err = os.MkdirAll(tempOutputFolderPath, os.ModePerm)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create temp output directory: %v", err)
+	}
+
+	// save inputMediaData to temp file
+	err = os.WriteFile(tempInputFilePath, inputMediaData, 0644)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to write temp file: %v", err)
+	}
+	defer os.Remove(tempInputFilePath)
+	defer os.Remove(tempOutputFilePath)
+
+	// scale to fit 512x512 keeping the aspect ratio, and pad the rest with transparency
+	filter := fmt.Sprintf(
+		"scale=%d:%d:force_original_aspect_ratio=decrease,format=rgba,pad=%d:%d:(ow-iw)/2:(oh-ih)/2:color=#00000000",
+		stickerSize, stickerSize, stickerSize, stickerSize,
+	)
+	outputArgs := ffmpeg.KwArgs{"vf": filter, "c:v": "libwebp", "an": ""}
+	if isAnimated {
+		// WhatsApp rejects animated stickers over 500 KB, so keep them short and low frame rate
+		outputArgs["vf"] = "fps=15," + filter
+		outputArgs["loop"] = "0"
+		outputArgs["t"] = "10"
+		outputArgs["q:v"] = "50"
+	} else {
+		outputArgs["frames:v"] = "1"
+		outputArgs["q:v"] = "75"
+	}
+
+	err = ffmpeg.Input(tempInputFilePath).Output(tempOutputFilePath, outputArgs).Run()
+	if err != nil {
+		return nil, false, fmt.Errorf("FFmpeg processing failed: %v", err)
+	}
+
+	stickerData, err = os.ReadFile(tempOutputFilePath)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read processed file: %v", err)
+	}
+
+	packName, publisher := stickerPackInfo()
+	stickerData, err = addStickerMetadata(stickerData, stickerMetadata{
+		PackID:    "whatsapp-server-" + packName,
+		PackName:  packName,
+		Publisher: publisher,
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to add sticker metadata: %v", err)
+	}
+
+	return stickerData, isAnimated, nil
+}
+
+// Build the EXIF payload WhatsApp reads sticker pack metadata from: a little-endian TIFF
+// header with a single IFD entry (tag 0x5741) pointing at the JSON metadata
+func buildStickerExif(metadata stickerMetadata) ([]byte, error) {
+	metadataJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	exif := []byte{
+		0x49, 0x49, 0x2A, 0x00, 0x08, 0x00, 0x00, 0x00, // TIFF header, IFD at offset 8
+		0x01, 0x00, // one IFD entry
+		0x41, 0x57, 0x07, 0x00, // tag 0x5741, type UNDEFINED
+		0x00, 0x00, 0x00, 0x00, // value length, filled in below
+		0x16, 0x00, 0x00, 0x00, // value offset (22)
+	}
+	binary.LittleEndian.PutUint32(exif[14:18], uint32(len(metadataJSON)))
+	return append(exif, metadataJSON...), nil
+}
+
+// Append a RIFF chunk, padding it to an even length
+func appendRIFFChunk(data []byte, fourCC string, payload []byte) []byte {
+	header := make([]byte, 8)
+	copy(header, fourCC)
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(payload)))
+	data = append(data, header...)
+	data = append(data, payload...)
+	if len(payload)%2 == 1 {
+		data = append(data, 0)
+	}
+	return data
+}
+
+// Embed sticker pack metadata in a WebP file as an EXIF chunk. Simple (VP8/VP8L) files
+// are converted to the extended format first, since only that format supports EXIF
+func addStickerMetadata(webp []byte, metadata stickerMetadata) ([]byte, error) {
+	if len(webp) < 20 || string(webp[0:4]) != "RIFF" || string(webp[8:12]) != "WEBP" {
+		return nil, fmt.Errorf("not a WebP file")
+	}
+
+	exif, err := buildStickerExif(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	const (
+		vp8xAlphaFlag = 0x10
+		vp8xExifFlag  = 0x08
+	)
+
+	body := webp[12:]
+	var out []byte
+	if string(body[0:4]) == "VP8X" {
+		// Already extended, just set the EXIF flag
+		out = append([]byte{}, webp[:12]...)
+		out = append(out, body...)
+		out[20] |= vp8xExifFlag
+	} else {
+		// Wrap the bitstream in an extended format header with the canvas size
+		vp8x := make([]byte, 10)
+		vp8x[0] = vp8xAlphaFlag | vp8xExifFlag
+		width, height := stickerSize-1, stickerSize-1
+		vp8x[4], vp8x[5], vp8x[6] = byte(width), byte(width>>8), byte(width>>16)
+		vp8x[7], vp8x[8], vp8x[9] = byte(height), byte(height>>8), byte(height>>16)
+
+		out = append([]byte{}, webp[:12]...)
+		out = appendRIFFChunk(out, "VP8X", vp8x)
+		out = append(out, body...)
+	}
+
+	out = appendRIFFChunk(out, "EXIF", exif)
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(out)-8))
+	return out, nil
+}
+
+// Upload a converted sticker to WhatsApp and build the sticker message for it
+func buildStickerMessage(ctx context.Context, client *whatsmeow.Client, recipientJID types.JID, stickerData []byte, isAnimated bool) (*waProto.Message, string, error) {
+	var resp whatsmeow.UploadResponse
+	var err error
+	var mediaHandle string
+	if recipientJID.Server == types.NewsletterServer {
+		resp, err = client.UploadNewsletter(ctx, stickerData, whatsmeow.MediaImage)
+		mediaHandle = resp.Handle
+	} else {
+		resp, err = client.Upload(ctx, stickerData, whatsmeow.MediaImage)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("error uploading sticker: %v", err)
+	}
+
+	return &waProto.Message{
+		StickerMessage: &waProto.StickerMessage{
+			Mimetype:      proto.String("image/webp"),
+			URL:           &resp.URL,
+			DirectPath:    &resp.DirectPath,
+			MediaKey:      resp.MediaKey,
+			FileEncSHA256: resp.FileEncSHA256,
+			FileSHA256:    resp.FileSHA256,
+			FileLength:    &resp.FileLength,
+			Width:         proto.Uint32(stickerSize),
+			Height:        proto.Uint32(stickerSize),
+			IsAnimated:    proto.Bool(isAnimated),
+		},
+	}, mediaHandle, nil
+}
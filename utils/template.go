@@ -0,0 +1,385 @@
+package utils
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Placeholders in template bodies, e.g. {{name}} or {{ order_id }}
+var templatePlaceholder = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+// Returned when rendering a template without a value for some of its placeholders
+var errMissingTemplateVariables = errors.New("missing template variables")
+
+// Message templates. Language variants are kept as JSON, as they're only ever read whole
+const messageTemplatesTable = `
+	CREATE TABLE IF NOT EXISTS message_templates (
+		id %s,
+		name TEXT,
+		body TEXT,
+		language TEXT,
+		variants TEXT,
+		bucket_name TEXT,
+		object_key TEXT,
+		created_at TIMESTAMP,
+		updated_at TIMESTAMP
+	);
+`
+
+// TemplateRequest represents the request body for creating or replacing a template
+type TemplateRequest struct {
+	Name string `json:"name"`
+	// Text with {{name}} placeholders, in the default language. {{contact_name}} and
+	// {{phone_number}} are filled in from the recipient unless given as variables
+	Body string `json:"body"`
+	// Default language of the template, e.g. "en"
+	Language string `json:"language,omitempty"`
+	// Bodies in other languages, by language
+	Variants map[string]string `json:"variants,omitempty"`
+	// S3 object sent with the template, with the body as its caption
+	BucketName string `json:"bucket_name,omitempty"`
+	ObjectKey  string `json:"object_key,omitempty"`
+}
+
+// MessageTemplate represents a stored message template
+type MessageTemplate struct {
+	ID         int64             `json:"id"`
+	Name       string            `json:"name"`
+	Body       string            `json:"body"`
+	Language   string            `json:"language,omitempty"`
+	Variants   map[string]string `json:"variants,omitempty"`
+	BucketName string            `json:"bucket_name,omitempty"`
+	ObjectKey  string            `json:"object_key,omitempty"`
+	// Placeholders used by the body and its variants
+	Placeholders []string  `json:"placeholders"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// Validate the payload of a template request
+func (req *TemplateRequest) validate() error {
+	if req.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if (req.BucketName == "") != (req.ObjectKey == "") {
+		return fmt.Errorf("media needs both a bucket name and an object key")
+	}
+	if req.Body == "" && req.ObjectKey == "" {
+		return fmt.Errorf("body or media is required")
+	}
+	if len(req.Variants) > 0 && req.Language == "" {
+		return fmt.Errorf("language of the body is required when there are variants")
+	}
+	for language, body := range req.Variants {
+		if language == "" || body == "" {
+			return fmt.Errorf("variants need a language and a body")
+		}
+	}
+	return nil
+}
+
+// Get the names of the placeholders in template bodies, sorted and without duplicates
+func templatePlaceholders(bodies ...string) []string {
+	seen := make(map[string]bool)
+	placeholders := []string{}
+	for _, body := range bodies {
+		for _, match := range templatePlaceholder.FindAllStringSubmatch(body, -1) {
+			if !seen[match[1]] {
+				seen[match[1]] = true
+				placeholders = append(placeholders, match[1])
+			}
+		}
+	}
+	sort.Strings(placeholders)
+	return placeholders
+}
+
+// Get the body of a template in a language. Regional languages such as pt-BR fall back to
+// their base language, and languages without a variant to the default body
+func (template *MessageTemplate) body(language string) string {
+	if language == "" || strings.EqualFold(language, template.Language) {
+		return template.Body
+	}
+	for variant, body := range template.Variants {
+		if strings.EqualFold(variant, language) {
+			return body
+		}
+	}
+	if base, _, regional := strings.Cut(language, "-"); regional {
+		return template.body(base)
+	}
+	return template.Body
+}
+
+// Fill in the placeholders of a template body. Every placeholder must have a value
+func renderTemplateBody(body string, values map[string]string) (string, error) {
+	var missing []string
+	for _, placeholder := range templatePlaceholders(body) {
+		if _, ok := values[placeholder]; !ok {
+			missing = append(missing, placeholder)
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("%w: %s", errMissingTemplateVariables, strings.Join(missing, ", "))
+	}
+
+	return templatePlaceholder.ReplaceAllStringFunc(body, func(placeholder string) string {
+		return values[templatePlaceholder.FindStringSubmatch(placeholder)[1]]
+	}), nil
+}
+
+// Render the template a send request references into its message and media. The recipient's
+// contact name and phone number are available as placeholders, and variables override them.
+// Returns sql.ErrNoRows if the template doesn't exist
+func renderTemplateRequest(messageStore *MessageStore, req *SendMessageRequest, recipientJID types.JID) error {
+	template, err := messageStore.getTemplate(req.TemplateID)
+	if err != nil {
+		return err
+	}
+
+	values := map[string]string{
+		"contact_name": recipientName(messageStore, recipientJID),
+		"phone_number": jidPhoneNumber(recipientJID),
+	}
+	for name, value := range req.Variables {
+		values[name] = value
+	}
+	if req.Message, err = renderTemplateBody(template.body(req.Language), values); err != nil {
+		return err
+	}
+	if req.BucketName == "" && req.ObjectKey == "" {
+		req.BucketName, req.ObjectKey = template.BucketName, template.ObjectKey
+	}
+	return nil
+}
+
+// Get the name to address a recipient by: their contact name, the name of the chat for
+// groups, or else their phone number
+func recipientName(messageStore *MessageStore, recipientJID types.JID) string {
+	if name := messageStore.getContactName(recipientJID.String()); name != "" {
+		return name
+	}
+	if name, err := messageStore.getStoredChatName(recipientJID.String()); err == nil && name != "" {
+		return name
+	}
+	return recipientJID.User
+}
+
+const templateColumns = "id, name, COALESCE(body, ''), COALESCE(language, ''), variants, COALESCE(bucket_name, ''), COALESCE(object_key, ''), created_at, updated_at"
+
+// Scan a template selected with templateColumns
+func scanTemplate(row rowScanner) (MessageTemplate, error) {
+	var template MessageTemplate
+	var variants sql.NullString
+	err := row.Scan(&template.ID, &template.Name, &template.Body, &template.Language, &variants,
+		&template.BucketName, &template.ObjectKey, &template.CreatedAt, &template.UpdatedAt)
+	if err != nil {
+		return MessageTemplate{}, err
+	}
+	if variants.Valid && variants.String != "" {
+		if err = json.Unmarshal([]byte(variants.String), &template.Variants); err != nil {
+			return MessageTemplate{}, fmt.Errorf("invalid variants of template %d: %v", template.ID, err)
+		}
+	}
+	bodies := []string{template.Body}
+	for _, body := range template.Variants {
+		bodies = append(bodies, body)
+	}
+	template.Placeholders = templatePlaceholders(bodies...)
+	return template, nil
+}
+
+// Get the language variants of a template request to store
+func (req *TemplateRequest) variantsJSON() (*string, error) {
+	if len(req.Variants) == 0 {
+		return nil, nil
+	}
+	variants, err := json.Marshal(req.Variants)
+	if err != nil {
+		return nil, err
+	}
+	value := string(variants)
+	return &value, nil
+}
+
+// Get the templates, by name
+func (store *MessageStore) getTemplates() ([]MessageTemplate, error) {
+	rows, err := store.Db.Query("SELECT " + templateColumns + " FROM message_templates ORDER BY name, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	templates := []MessageTemplate{}
+	for rows.Next() {
+		template, err := scanTemplate(rows)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, template)
+	}
+	return templates, rows.Err()
+}
+
+// Get a template by ID
+func (store *MessageStore) getTemplate(id int64) (MessageTemplate, error) {
+	return scanTemplate(store.Db.QueryRow("SELECT "+templateColumns+" FROM message_templates WHERE id = $1", id))
+}
+
+// Store a new template
+func (store *MessageStore) createTemplate(req TemplateRequest) (MessageTemplate, error) {
+	variants, err := req.variantsJSON()
+	if err != nil {
+		return MessageTemplate{}, err
+	}
+	return scanTemplate(store.Db.QueryRow(
+		`INSERT INTO message_templates (name, body, language, variants, bucket_name, object_key, created_at, updated_at)
+		VALUES ($1, $2, NULLIF($3, ''), $4, NULLIF($5, ''), NULLIF($6, ''), $7, $7)
+		RETURNING `+templateColumns,
+		req.Name, req.Body, req.Language, variants, req.BucketName, req.ObjectKey, time.Now(),
+	))
+}
+
+// Replace a template. Returns sql.ErrNoRows if it doesn't exist
+func (store *MessageStore) updateTemplate(id int64, req TemplateRequest) (MessageTemplate, error) {
+	variants, err := req.variantsJSON()
+	if err != nil {
+		return MessageTemplate{}, err
+	}
+	return scanTemplate(store.Db.QueryRow(
+		`UPDATE message_templates SET name = $2, body = $3, language = NULLIF($4, ''), variants = $5,
+			bucket_name = NULLIF($6, ''), object_key = NULLIF($7, ''), updated_at = $8
+		WHERE id = $1
+		RETURNING `+templateColumns,
+		id, req.Name, req.Body, req.Language, variants, req.BucketName, req.ObjectKey, time.Now(),
+	))
+}
+
+// Delete a template. Returns sql.ErrNoRows if it doesn't exist
+func (store *MessageStore) deleteTemplate(id int64) error {
+	result, err := store.Db.Exec("DELETE FROM message_templates WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func registerTemplateRoutes(messageStore *MessageStore) {
+	// Parse the template ID of a request, answering with an error if it's invalid
+	templateID := func(w http.ResponseWriter, r *http.Request) (int64, bool) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid template ID", http.StatusBadRequest)
+			return 0, false
+		}
+		return id, true
+	}
+
+	// Decode and validate a template request, answering with an error if it's invalid
+	decodeTemplate := func(w http.ResponseWriter, r *http.Request) (TemplateRequest, bool) {
+		var req TemplateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return req, false
+		}
+		if err := req.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return req, false
+		}
+		return req, true
+	}
+
+	// List all templates
+	http.HandleFunc("GET /api/templates", func(w http.ResponseWriter, r *http.Request) {
+		templates, err := messageStore.getTemplates()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting templates: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, templates)
+	})
+
+	// Create a template
+	http.HandleFunc("POST /api/templates", func(w http.ResponseWriter, r *http.Request) {
+		req, ok := decodeTemplate(w, r)
+		if !ok {
+			return
+		}
+		template, err := messageStore.createTemplate(req)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error creating template: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, template)
+	})
+
+	// Get a template
+	http.HandleFunc("GET /api/templates/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := templateID(w, r)
+		if !ok {
+			return
+		}
+		template, err := messageStore.getTemplate(id)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Template not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting template: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, template)
+	})
+
+	// Replace a template
+	http.HandleFunc("PUT /api/templates/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := templateID(w, r)
+		if !ok {
+			return
+		}
+		req, ok := decodeTemplate(w, r)
+		if !ok {
+			return
+		}
+		template, err := messageStore.updateTemplate(id, req)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Template not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Error updating template: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, template)
+	})
+
+	// Delete a template
+	http.HandleFunc("DELETE /api/templates/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := templateID(w, r)
+		if !ok {
+			return
+		}
+		err := messageStore.deleteTemplate(id)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Template not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Error deleting template: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -78,207 +78,272 @@ func ConnectToWhatsApp(client *whatsmeow.Client, logger waLog.Logger) bool {
 }
 
 // Function to send a WhatsApp message
-func sendWhatsAppMessage(client *whatsmeow.Client, s3Client *s3.Client, recipient string, message string, bucketName string, objectKey string) (bool, string) {
+func sendWhatsAppMessage(client *whatsmeow.Client, messageStore *MessageStore, s3Client *s3.Client, recipientJID types.JID, req SendMessageRequest) (bool, string) {
 	if !client.IsConnected() {
 		return false, "Not connected to WhatsApp"
 	}
 
-	// Create JID for recipient
-	var recipientJID types.JID
-	var err error
-
-	// Check if recipient is a JID
-	isJID := strings.Contains(recipient, "@")
-
-	if isJID {
-		// Parse the JID string
-		recipientJID, err = types.ParseJID(recipient)
-		if err != nil {
-			return false, fmt.Sprintf("Error parsing JID: %v", err)
-		}
-	} else {
-		// Create JID from phone number
-		recipientJID = types.JID{
-			User:   recipient,
-			Server: "s.whatsapp.net", // For personal chats
-		}
-	}
-
+	message, objectKey := req.Message, req.ObjectKey
+	hasMedia := req.media != nil || (req.BucketName != "" && objectKey != "")
 	msg := &waProto.Message{}
-
-	// Check if we have media to send
-	if bucketName != "" && objectKey != "" {
-		// Read media file from S3
-		inputMediaData, err := downloadS3Object(context.Background(), s3Client, bucketName, objectKey)
+	var mediaHandle string
+
+	if req.Location != nil {
+		// Send a location pin
+		msg = buildLocationMessage(*req.Location)
+	} else if len(req.Contacts) > 0 {
+		// Send one or more contact cards
+		msg = buildContactsMessage(req.Contacts)
+	} else if req.Sticker && hasMedia {
+		// Send an image from S3 as a sticker
+		inputMediaData, err := req.readMedia(context.Background(), s3Client)
 		if err != nil {
 			return false, fmt.Sprintf("Error reading media file: %v", err)
 		}
 
-		mediaData, fileExt, err := convertAudioToSendableFormat(inputMediaData, objectKey)
+		stickerData, isAnimated, err := convertImageToSticker(inputMediaData, objectKey)
 		if err != nil {
-			return false, fmt.Sprintf("Error converting audio to sendable format: %v", err)
+			return false, fmt.Sprintf("Error converting image to sticker: %v", err)
 		}
 
-		// Determine media type and mime type based on file extension
-		var mediaType whatsmeow.MediaType
-		var mimeType string
-
-		// Handle different media types
-		switch fileExt {
-		// Image types
-		case "jpg", "jpeg":
-			mediaType = whatsmeow.MediaImage
-			mimeType = "image/jpeg"
-		case "png":
-			mediaType = whatsmeow.MediaImage
-			mimeType = "image/png"
-		case "gif":
-			mediaType = whatsmeow.MediaImage
-			mimeType = "image/gif"
-		case "webp":
-			mediaType = whatsmeow.MediaImage
-			mimeType = "image/webp"
-
-		// Audio types
-		case "ogg":
-			mediaType = whatsmeow.MediaAudio
-			mimeType = "audio/ogg; codecs=opus"
-		case "mp3":
-			mediaType = whatsmeow.MediaAudio
-			mimeType = "audio/mpeg"
-
-		// Video types
-		case "mp4":
-			mediaType = whatsmeow.MediaVideo
-			mimeType = "video/mp4"
-		case "avi":
-			mediaType = whatsmeow.MediaVideo
-			mimeType = "video/avi"
-		case "mov":
-			mediaType = whatsmeow.MediaVideo
-			mimeType = "video/quicktime"
-
-		// Document types (for any other file type)
-		default:
-			mediaType = whatsmeow.MediaDocument
-			mimeType = "application/octet-stream"
+		msg, mediaHandle, err = buildStickerMessage(context.Background(), client, recipientJID, stickerData, isAnimated)
+		if err != nil {
+			return false, fmt.Sprintf("Error sending sticker: %v", err)
 		}
-
-		// Upload media to WhatsApp servers
-		resp, err := client.Upload(context.Background(), mediaData, mediaType)
+	} else if hasMedia {
+		// Send media from S3
+		// Read media file from S3, unless the caller already read it
+		inputMediaData, err := req.readMedia(context.Background(), s3Client)
 		if err != nil {
-			return false, fmt.Sprintf("Error uploading media: %v", err)
+			return false, fmt.Sprintf("Error reading media file: %v", err)
 		}
 
-		fmt.Println("Media uploaded", resp)
-
-		// Create the appropriate message type based on media type
-		switch mediaType {
-		case whatsmeow.MediaImage:
-			msg.ImageMessage = &waProto.ImageMessage{
-				Caption:       proto.String(message),
-				Mimetype:      proto.String(mimeType),
-				URL:           &resp.URL,
-				DirectPath:    &resp.DirectPath,
-				MediaKey:      resp.MediaKey,
-				FileEncSHA256: resp.FileEncSHA256,
-				FileSHA256:    resp.FileSHA256,
-				FileLength:    &resp.FileLength,
-			}
-		case whatsmeow.MediaAudio:
-			// Handle ogg audio files
-			var seconds uint32 = 30 // Default fallback
-			var waveform []byte = nil
-
-			// Try to analyze the ogg file
-			if strings.Contains(mimeType, "ogg") {
-				analyzedSeconds, analyzedWaveform, err := analyzeOggOpus(mediaData)
-				if err == nil {
-					seconds = analyzedSeconds
-					waveform = analyzedWaveform
-				} else {
-					return false, fmt.Sprintf("Failed to analyze Ogg Opus file: %v", err)
-				}
-			} else {
-				fmt.Printf("Not an Ogg Opus file: %s\n", mimeType)
-			}
-
-			msg.AudioMessage = &waProto.AudioMessage{
-				Mimetype:      proto.String(mimeType),
-				URL:           &resp.URL,
-				DirectPath:    &resp.DirectPath,
-				MediaKey:      resp.MediaKey,
-				FileEncSHA256: resp.FileEncSHA256,
-				FileSHA256:    resp.FileSHA256,
-				FileLength:    &resp.FileLength,
-				Seconds:       proto.Uint32(seconds),
-				PTT:           proto.Bool(true),
-				Waveform:      waveform,
-			}
-		case whatsmeow.MediaVideo:
-			msg.VideoMessage = &waProto.VideoMessage{
-				Caption:       proto.String(message),
-				Mimetype:      proto.String(mimeType),
-				URL:           &resp.URL,
-				DirectPath:    &resp.DirectPath,
-				MediaKey:      resp.MediaKey,
-				FileEncSHA256: resp.FileEncSHA256,
-				FileSHA256:    resp.FileSHA256,
-				FileLength:    &resp.FileLength,
-			}
-		case whatsmeow.MediaDocument:
-			msg.DocumentMessage = &waProto.DocumentMessage{
-				Title:         proto.String(objectKey[strings.LastIndex(objectKey, "/")+1:]),
-				Caption:       proto.String(message),
-				Mimetype:      proto.String(mimeType),
-				URL:           &resp.URL,
-				DirectPath:    &resp.DirectPath,
-				MediaKey:      resp.MediaKey,
-				FileEncSHA256: resp.FileEncSHA256,
-				FileSHA256:    resp.FileSHA256,
-				FileLength:    &resp.FileLength,
-			}
+		msg, mediaHandle, err = buildMediaMessage(context.Background(), client, recipientJID, inputMediaData, objectKey, message)
+		if err != nil {
+			return false, err.Error()
+		}
+	} else if pageURL := findFirstURL(message); req.LinkPreview && pageURL != "" {
+		// Send text with a preview of the first link in it
+		preview, err := generateLinkPreview(context.Background(), pageURL)
+		if err != nil {
+			fmt.Printf("Failed to generate link preview, sending without it: %v\n", err)
 		}
+		msg = buildLinkPreviewMessage(message, preview)
 	} else {
 		msg.Conversation = proto.String(message)
 	}
 
+	// Quote the message being replied to
+	if req.ReplyTo != "" {
+		setMessageContextInfo(msg, buildReplyContext(client, messageStore, recipientJID, req.ReplyTo))
+	}
+
 	// Send message
-	_, err = client.SendMessage(context.Background(), recipientJID, msg)
+	resp, err := client.SendMessage(context.Background(), recipientJID, msg, whatsmeow.SendRequestExtra{MediaHandle: mediaHandle})
 
 	if err != nil {
 		return false, fmt.Sprintf("Error sending message: %v", err)
 	}
+	recordSentMessage(client, messageStore, recipientJID, resp, msg)
 
-	return true, fmt.Sprintf("Message sent to %s", recipient)
+	return true, fmt.Sprintf("Message sent to %s", recipientJID)
+}
+
+// Store a message sent from here like received ones, so it can be found, revoked and
+// edited later. Like received ones, only text and media are stored, but they aren't archived to S3
+func recordSentMessage(client *whatsmeow.Client, messageStore *MessageStore, chatJID types.JID, resp whatsmeow.SendResponse, msg *waProto.Message) {
+	content, media := extractMessageContent(msg)
+	if content == "" && media.MediaType == "" {
+		return
+	}
+
+	chat := chatJID.String()
+	if err := messageStore.touchChat(chat, resp.Timestamp); err != nil {
+		fmt.Printf("Failed to store chat of sent message %s: %v\n", resp.ID, err)
+		return
+	}
+	err := messageStore.storeMessage(StoredMessage{
+		ID:        resp.ID,
+		ChatJID:   chat,
+		Sender:    client.Store.ID.User,
+		Content:   content,
+		Timestamp: resp.Timestamp,
+		IsFromMe:  true,
+		MediaInfo: media,
+	})
+	if err != nil {
+		fmt.Printf("Failed to store sent message %s: %v\n", resp.ID, err)
+	} else if err = messageStore.markMessageSentViaAPI(resp.ID, chat); err != nil {
+		fmt.Printf("Failed to mark sent message %s: %v\n", resp.ID, err)
+	}
+}
+
+// Upload media to WhatsApp and build the message sending it to a recipient, with message
+// as its caption. The message can be sent again to other recipients, except for newsletters,
+// whose media is referenced by the returned handle
+func buildMediaMessage(ctx context.Context, client *whatsmeow.Client, recipientJID types.JID, inputMediaData []byte, objectKey string, message string) (msg *waProto.Message, mediaHandle string, err error) {
+	msg = &waProto.Message{}
+
+	mediaData, fileExt, err := convertAudioToSendableFormat(inputMediaData, objectKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error converting audio to sendable format: %v", err)
+	}
+
+	// Determine media type and mime type based on file extension
+	var mediaType whatsmeow.MediaType
+	var mimeType string
+
+	// Handle different media types
+	switch fileExt {
+	// Image types
+	case "jpg", "jpeg":
+		mediaType = whatsmeow.MediaImage
+		mimeType = "image/jpeg"
+	case "png":
+		mediaType = whatsmeow.MediaImage
+		mimeType = "image/png"
+	case "gif":
+		mediaType = whatsmeow.MediaImage
+		mimeType = "image/gif"
+	case "webp":
+		mediaType = whatsmeow.MediaImage
+		mimeType = "image/webp"
+
+	// Audio types
+	case "ogg":
+		mediaType = whatsmeow.MediaAudio
+		mimeType = "audio/ogg; codecs=opus"
+	case "mp3":
+		mediaType = whatsmeow.MediaAudio
+		mimeType = "audio/mpeg"
+
+	// Video types
+	case "mp4":
+		mediaType = whatsmeow.MediaVideo
+		mimeType = "video/mp4"
+	case "avi":
+		mediaType = whatsmeow.MediaVideo
+		mimeType = "video/avi"
+	case "mov":
+		mediaType = whatsmeow.MediaVideo
+		mimeType = "video/quicktime"
+
+	// Document types (for any other file type)
+	default:
+		mediaType = whatsmeow.MediaDocument
+		mimeType = "application/octet-stream"
+	}
+
+	// Upload media to WhatsApp servers.
+	// Newsletter media isn't encrypted and is referenced by a media handle when sending
+	var resp whatsmeow.UploadResponse
+	if recipientJID.Server == types.NewsletterServer {
+		resp, err = client.UploadNewsletter(ctx, mediaData, mediaType)
+		mediaHandle = resp.Handle
+	} else {
+		resp, err = client.Upload(ctx, mediaData, mediaType)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("Error uploading media: %v", err)
+	}
+
+	fmt.Println("Media uploaded", resp)
+
+	// Create the appropriate message type based on media type
+	switch mediaType {
+	case whatsmeow.MediaImage:
+		msg.ImageMessage = &waProto.ImageMessage{
+			Caption:       proto.String(message),
+			Mimetype:      proto.String(mimeType),
+			URL:           &resp.URL,
+			DirectPath:    &resp.DirectPath,
+			MediaKey:      resp.MediaKey,
+			FileEncSHA256: resp.FileEncSHA256,
+			FileSHA256:    resp.FileSHA256,
+			FileLength:    &resp.FileLength,
+		}
+	case whatsmeow.MediaAudio:
+		// Handle ogg audio files
+		var seconds uint32 = 30 // Default fallback
+		var waveform []byte = nil
+
+		// Try to analyze the ogg file
+		if strings.Contains(mimeType, "ogg") {
+			analyzedSeconds, analyzedWaveform, err := analyzeOggOpus(mediaData)
+			if err == nil {
+				seconds = analyzedSeconds
+				waveform = analyzedWaveform
+			} else {
+				return nil, "", fmt.Errorf("Failed to analyze Ogg Opus file: %v", err)
+			}
+		} else {
+			fmt.Printf("Not an Ogg Opus file: %s\n", mimeType)
+		}
+
+		msg.AudioMessage = &waProto.AudioMessage{
+			Mimetype:      proto.String(mimeType),
+			URL:           &resp.URL,
+			DirectPath:    &resp.DirectPath,
+			MediaKey:      resp.MediaKey,
+			FileEncSHA256: resp.FileEncSHA256,
+			FileSHA256:    resp.FileSHA256,
+			FileLength:    &resp.FileLength,
+			Seconds:       proto.Uint32(seconds),
+			PTT:           proto.Bool(true),
+			Waveform:      waveform,
+		}
+	case whatsmeow.MediaVideo:
+		msg.VideoMessage = &waProto.VideoMessage{
+			Caption:       proto.String(message),
+			Mimetype:      proto.String(mimeType),
+			URL:           &resp.URL,
+			DirectPath:    &resp.DirectPath,
+			MediaKey:      resp.MediaKey,
+			FileEncSHA256: resp.FileEncSHA256,
+			FileSHA256:    resp.FileSHA256,
+			FileLength:    &resp.FileLength,
+		}
+	case whatsmeow.MediaDocument:
+		msg.DocumentMessage = &waProto.DocumentMessage{
+			Title:         proto.String(objectKey[strings.LastIndex(objectKey, "/")+1:]),
+			Caption:       proto.String(message),
+			Mimetype:      proto.String(mimeType),
+			URL:           &resp.URL,
+			DirectPath:    &resp.DirectPath,
+			MediaKey:      resp.MediaKey,
+			FileEncSHA256: resp.FileEncSHA256,
+			FileSHA256:    resp.FileSHA256,
+			FileLength:    &resp.FileLength,
+		}
+	}
+
+	return msg, mediaHandle, nil
 }
 
 // Download WhatsApp media from a message
-func downloadWhatsAppMedia(client *whatsmeow.Client, messageID string, chatJID string, mediaType string, url string, mediaKey []byte, fileSHA256 []byte, fileEncSHA256 []byte, fileLength uint64) (mediaData []byte, err error) {
+func downloadWhatsAppMedia(client *whatsmeow.Client, messageID string, chatJID string, media MediaInfo) (mediaData []byte, err error) {
 	// Check if this is a media message
-	if mediaType == "" {
+	if media.MediaType == "" {
 		return nil, fmt.Errorf("not a media message")
 	}
 
-	// Check if media type is audio
-	if mediaType != "audio" {
-		return nil, fmt.Errorf("unsupported media type: %s", mediaType)
-	}
-
 	// If we don't have all the media info we need, we can't download
-	if url == "" || len(mediaKey) == 0 || len(fileSHA256) == 0 || len(fileEncSHA256) == 0 || fileLength == 0 {
+	if (media.URL == "" && media.DirectPath == "") || len(media.MediaKey) == 0 || len(media.FileSHA256) == 0 || len(media.FileEncSHA256) == 0 || media.FileLength == 0 {
 		return nil, fmt.Errorf("incomplete media information for download")
 	}
 
 	fmt.Printf("Attempting to download media for message %s in chat %s...\n", messageID, chatJID)
 
-	// Extract direct path from URL
-	directPath := extractDirectPathFromURL(url)
+	// Messages stored before direct paths were kept only have the URL
+	directPath := media.DirectPath
+	if directPath == "" {
+		directPath = extractDirectPathFromURL(media.URL)
+	}
 
 	// Create a downloader that implements DownloadableMessage
 	var waMediaType whatsmeow.MediaType
-	switch mediaType {
-	case "image":
+	switch media.MediaType {
+	case "image", "sticker":
 		waMediaType = whatsmeow.MediaImage
 	case "video":
 		waMediaType = whatsmeow.MediaVideo
@@ -287,23 +352,23 @@ func downloadWhatsAppMedia(client *whatsmeow.Client, messageID string, chatJID s
 	case "document":
 		waMediaType = whatsmeow.MediaDocument
 	default:
-		return nil, fmt.Errorf("unsupported media type: %s", mediaType)
+		return nil, fmt.Errorf("unsupported media type: %s", media.MediaType)
 	}
 
 	downloader := &MediaDownloader{
-		URL:           url,
+		URL:           media.URL,
 		DirectPath:    directPath,
-		MediaKey:      mediaKey,
-		FileLength:    fileLength,
-		FileSHA256:    fileSHA256,
-		FileEncSHA256: fileEncSHA256,
+		MediaKey:      media.MediaKey,
+		FileLength:    media.FileLength,
+		FileSHA256:    media.FileSHA256,
+		FileEncSHA256: media.FileEncSHA256,
 		MediaType:     waMediaType,
 	}
 
 	// Download the media using whatsmeow client
 	mediaData, err = client.Download(context.Background(), downloader)
 	if err != nil {
-		return nil, fmt.Errorf("failed to download media: %v", err)
+		return nil, fmt.Errorf("failed to download media: %w", err)
 	}
 
 	return mediaData, nil